@@ -0,0 +1,352 @@
+// planetexpress-api/auth.go
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	roleCustomer   = "customer"
+	roleDispatcher = "dispatcher"
+	roleAdmin      = "admin"
+
+	// Headers carrying the authenticated caller to downstream services.
+	callerHeader = "X-Planet-Express-Caller"
+	roleHeader   = "X-Planet-Express-Role"
+)
+
+// Identity is an authenticated caller.
+type Identity struct {
+	Name   string
+	Role   string
+	Method string // "api_key", "jwt" or "none"
+}
+
+// APIKey is one entry of API_KEYS_FILE.
+type APIKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Role string `json:"role"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type authenticator struct {
+	enabled  bool
+	apiKeys  []APIKey
+	jwks     map[string]crypto.PublicKey // kid -> key
+	issuer   string
+	audience string
+}
+
+type (
+	identityKey struct{}
+	authErrKey  struct{}
+)
+
+func identityFrom(ctx context.Context) Identity {
+	if id, ok := ctx.Value(identityKey{}).(Identity); ok {
+		return id
+	}
+	return Identity{Name: "anonymous", Method: "none"}
+}
+
+// newAuthenticatorFromEnv loads API keys from API_KEYS_FILE and JWT signing
+// keys from JWKS_FILE. One of them has to be set: running without
+// authentication takes AUTH_DISABLED=true, so a missing Secret can't quietly
+// open every route.
+func newAuthenticatorFromEnv() (*authenticator, error) {
+	a := &authenticator{
+		issuer:   os.Getenv("JWT_ISSUER"),
+		audience: os.Getenv("JWT_AUDIENCE"),
+	}
+
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &a.apiKeys); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		for _, k := range a.apiKeys {
+			if k.Key == "" || !validRole(k.Role) {
+				return nil, fmt.Errorf("api key %q needs a key and a valid role", k.Name)
+			}
+		}
+		a.enabled = true
+	}
+
+	if path := os.Getenv("JWKS_FILE"); path != "" {
+		jwks, err := loadJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		a.jwks = jwks
+		a.enabled = true
+	}
+
+	disabled, _ := strconv.ParseBool(os.Getenv("AUTH_DISABLED"))
+	switch {
+	case disabled && a.enabled:
+		return nil, errors.New("AUTH_DISABLED is set along with API_KEYS_FILE or JWKS_FILE")
+	case !disabled && !a.enabled:
+		return nil, errors.New("no API_KEYS_FILE or JWKS_FILE configured; set AUTH_DISABLED=true to run without authentication")
+	}
+	return a, nil
+}
+
+func validRole(role string) bool {
+	return role == roleCustomer || role == roleDispatcher || role == roleAdmin
+}
+
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q in %s: %w", k.Kid, path, err)
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+func (k JWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		point := append([]byte{4}, append(x, y...)...)
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// authenticate identifies the caller from an X-API-Key header or a bearer
+// token. An error means credentials were presented but are not valid.
+func (a *authenticator) authenticate(r *http.Request) (Identity, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		for _, k := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+				return Identity{Name: k.Name, Role: k.Role, Method: "api_key"}, nil
+			}
+		}
+		return Identity{}, errors.New("unknown api key")
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if a.jwks == nil {
+			return Identity{}, errors.New("bearer tokens are not accepted")
+		}
+		return a.verifyJWT(token)
+	}
+
+	return Identity{}, errors.New("missing credentials")
+}
+
+func (a *authenticator) verifyJWT(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, fmt.Errorf("token header: %w", err)
+	}
+	key, ok := a.jwks[header.Kid]
+	if !ok {
+		return Identity{}, fmt.Errorf("unknown signing key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, fmt.Errorf("token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return Identity{}, fmt.Errorf("unexpected alg %q for RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return Identity{}, errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return Identity{}, fmt.Errorf("unexpected alg %q for EC key", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return Identity{}, errors.New("invalid token signature")
+		}
+	}
+
+	var claims struct {
+		Sub  string          `json:"sub"`
+		Iss  string          `json:"iss"`
+		Aud  json.RawMessage `json:"aud"`
+		Exp  float64         `json:"exp"`
+		Nbf  float64         `json:"nbf"`
+		Role string          `json:"role"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, fmt.Errorf("token claims: %w", err)
+	}
+
+	now := float64(time.Now().Unix())
+	switch {
+	case claims.Exp == 0 || now >= claims.Exp:
+		return Identity{}, errors.New("token expired")
+	case claims.Nbf != 0 && now < claims.Nbf:
+		return Identity{}, errors.New("token not yet valid")
+	case a.issuer != "" && claims.Iss != a.issuer:
+		return Identity{}, fmt.Errorf("unexpected issuer %q", claims.Iss)
+	case a.audience != "" && !audienceContains(claims.Aud, a.audience):
+		return Identity{}, errors.New("token not issued for this audience")
+	case !validRole(claims.Role):
+		return Identity{}, fmt.Errorf("invalid role %q", claims.Role)
+	}
+	return Identity{Name: claims.Sub, Role: claims.Role, Method: "jwt"}, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains handles "aud" being either a string or a list of strings.
+func audienceContains(raw json.RawMessage, want string) bool {
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return one == want
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err == nil {
+		return slices.Contains(many, want)
+	}
+	return false
+}
+
+// identify authenticates the caller if auth is enabled, and records who
+// they are, or why their credentials were refused, on the request's context
+// for the rate limiter and require. Client-supplied caller headers are
+// dropped either way.
+func (a *authenticator) identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(callerHeader)
+		r.Header.Del(roleHeader)
+
+		if !a.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		if id, err := a.authenticate(r); err != nil {
+			ctx = context.WithValue(ctx, authErrKey{}, err)
+		} else {
+			ctx = context.WithValue(ctx, identityKey{}, id)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// require only lets callers identify authenticated with one of roles
+// through, and passes who they are on in the caller headers.
+func (a *authenticator) require(roles []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, ok := r.Context().Value(identityKey{}).(Identity)
+		if !ok {
+			err, _ := r.Context().Value(authErrKey{}).(error)
+			slog.Warn("Authentication failed", "path", r.URL.Path, "err", err)
+			requestsReceived.WithLabelValues(r.Method).Inc()
+			requestsRejected.WithLabelValues("unauthenticated").Inc()
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusUnauthorized)).Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="planet-express"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(roles, id.Role) {
+			slog.Warn("Caller not allowed on route", "path", r.URL.Path, "caller", id.Name, "role", id.Role)
+			requestsReceived.WithLabelValues(r.Method).Inc()
+			requestsRejected.WithLabelValues("forbidden").Inc()
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusForbidden)).Inc()
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		r.Header.Set(callerHeader, id.Name)
+		r.Header.Set(roleHeader, id.Role)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,352 @@
+// planetexpress-api/auth_test.go
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// signJWT builds a token with the given header and claims, signed by key.
+func signJWT(t *testing.T, header, claims map[string]any, key crypto.Signer) string {
+	t.Helper()
+	enc := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := enc(header) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// testJWKS writes the public halves of the test keys to a JWKS file, as
+// "rsa" and "ec".
+func testJWKS(t *testing.T) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	point, err := testECKey.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := map[string][]JWK{"keys": {
+		{Kty: "RSA", Kid: "rsa", Alg: "RS256", N: b64(testRSAKey.N.Bytes()), E: b64(big.NewInt(int64(testRSAKey.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Alg: "ES256", Crv: "P-256", X: b64(point[1:33]), Y: b64(point[33:])},
+	}}
+	data, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	jwks, err := loadJWKS(testJWKS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authenticator{
+		enabled: true,
+		apiKeys: []APIKey{
+			{Name: "hermes", Key: "cust-key", Role: roleCustomer},
+			{Name: "boss", Key: "admin-key", Role: roleAdmin},
+		},
+		jwks:     jwks,
+		issuer:   "https://auth.planetexpress.earth",
+		audience: "planet-express",
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	a := testAuthenticator(t)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    Identity
+		wantErr string
+	}{
+		{"customer key", map[string]string{"X-API-Key": "cust-key"}, Identity{Name: "hermes", Role: roleCustomer, Method: "api_key"}, ""},
+		{"admin key", map[string]string{"X-API-Key": "admin-key"}, Identity{Name: "boss", Role: roleAdmin, Method: "api_key"}, ""},
+		{"unknown key", map[string]string{"X-API-Key": "cust-key-2"}, Identity{}, "unknown api key"},
+		{"key wins over a token", map[string]string{"X-API-Key": "nope", "Authorization": "Bearer x.y.z"}, Identity{}, "unknown api key"},
+		{"no credentials", nil, Identity{}, "missing credentials"},
+		{"basic auth", map[string]string{"Authorization": "Basic aGVybWVzOmtleQ=="}, Identity{}, "missing credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/deliveries", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			got, err := a.authenticate(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("authenticate() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("authenticate() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearerWithoutJWKS(t *testing.T) {
+	a := &authenticator{enabled: true, apiKeys: []APIKey{{Name: "hermes", Key: "cust-key", Role: roleCustomer}}}
+	r := httptest.NewRequest(http.MethodPost, "/deliveries", nil)
+	r.Header.Set("Authorization", "Bearer x.y.z")
+	if _, err := a.authenticate(r); err == nil || !strings.Contains(err.Error(), "not accepted") {
+		t.Errorf("authenticate() error = %v, want bearer tokens refused", err)
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	a := testAuthenticator(t)
+	now := time.Now().Unix()
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() map[string]any {
+		return map[string]any{"sub": "zapp", "role": roleDispatcher, "iss": a.issuer, "aud": a.audience, "exp": now + 60}
+	}
+	with := func(k string, v any) map[string]any {
+		c := valid()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	rs256 := map[string]any{"alg": "RS256", "kid": "rsa"}
+	es256 := map[string]any{"alg": "ES256", "kid": "ec"}
+
+	tests := []struct {
+		name    string
+		header  map[string]any
+		claims  map[string]any
+		key     crypto.Signer
+		wantErr string
+	}{
+		{"RS256", rs256, valid(), testRSAKey, ""},
+		{"ES256", es256, valid(), testECKey, ""},
+		{"audience list", rs256, with("aud", []string{"billing", "planet-express"}), testRSAKey, ""},
+		{"not before in the past", rs256, with("nbf", now-60), testRSAKey, ""},
+		{"none alg", map[string]any{"alg": "none", "kid": "rsa"}, valid(), testRSAKey, "unexpected alg"},
+		{"HS256 with the RSA key", map[string]any{"alg": "HS256", "kid": "rsa"}, valid(), testRSAKey, "unexpected alg"},
+		{"ES256 naming the RSA key", map[string]any{"alg": "ES256", "kid": "rsa"}, valid(), testECKey, "unexpected alg"},
+		{"RS256 naming the EC key", map[string]any{"alg": "RS256", "kid": "ec"}, valid(), testRSAKey, "unexpected alg"},
+		{"unknown kid", map[string]any{"alg": "RS256", "kid": "old"}, valid(), testRSAKey, "unknown signing key"},
+		{"signed by someone else", rs256, valid(), otherRSA, "invalid token signature"},
+		{"expired", rs256, with("exp", now-1), testRSAKey, "expired"},
+		{"no expiry", rs256, with("exp", nil), testRSAKey, "expired"},
+		{"not yet valid", rs256, with("nbf", now+60), testRSAKey, "not yet valid"},
+		{"wrong issuer", rs256, with("iss", "https://mom.corp"), testRSAKey, "unexpected issuer"},
+		{"no issuer", rs256, with("iss", nil), testRSAKey, "unexpected issuer"},
+		{"wrong audience", rs256, with("aud", "mom-corp"), testRSAKey, "audience"},
+		{"audience list without us", rs256, with("aud", []string{"billing"}), testRSAKey, "audience"},
+		{"no role", rs256, with("role", nil), testRSAKey, "invalid role"},
+		{"made-up role", rs256, with("role", "overlord"), testRSAKey, "invalid role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.verifyJWT(signJWT(t, tt.header, tt.claims, tt.key))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyJWT() = %+v, %v, want error %s", id, err, tt.wantErr)
+				}
+				return
+			}
+			if want := (Identity{Name: "zapp", Role: roleDispatcher, Method: "jwt"}); err != nil || id != want {
+				t.Errorf("verifyJWT() = %+v, %v, want %+v", id, err, want)
+			}
+		})
+	}
+}
+
+func TestVerifyJWTMalformed(t *testing.T) {
+	a := testAuthenticator(t)
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!!.e30.sig", "e30.e30.!!"} {
+		if _, err := a.verifyJWT(token); err == nil {
+			t.Errorf("verifyJWT(%q) succeeded, want an error", token)
+		}
+	}
+}
+
+func TestLoadJWKSErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		keys string
+		want string
+	}{
+		{"unsupported key type", `{"keys":[{"kty":"oct","kid":"k"}]}`, "unsupported key type"},
+		{"unsupported curve", `{"keys":[{"kty":"EC","kid":"k","crv":"P-384"}]}`, "unsupported curve"},
+		{"point off the curve", `{"keys":[{"kty":"EC","kid":"k","crv":"P-256","x":"AQ","y":"AQ"}]}`, `key "k"`},
+		{"not json", `keys`, "parsing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jwks.json")
+			if err := os.WriteFile(path, []byte(tt.keys), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadJWKS(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadJWKS() error = %v, want it to mention %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequire(t *testing.T) {
+	a := testAuthenticator(t)
+	token := signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa"},
+		map[string]any{"sub": "zapp", "role": roleDispatcher, "iss": a.issuer, "aud": a.audience, "exp": time.Now().Unix() + 60}, testRSAKey)
+
+	tests := []struct {
+		name       string
+		roles      []string
+		headers    map[string]string
+		wantCode   int
+		wantCaller string
+		wantRole   string
+	}{
+		{"allowed", []string{roleCustomer, roleAdmin}, map[string]string{"X-API-Key": "cust-key"}, http.StatusOK, "hermes", roleCustomer},
+		{"allowed by token", []string{roleDispatcher}, map[string]string{"Authorization": "Bearer " + token}, http.StatusOK, "zapp", roleDispatcher},
+		{"wrong role", []string{roleAdmin}, map[string]string{"X-API-Key": "cust-key"}, http.StatusForbidden, "", ""},
+		{"no credentials", []string{roleCustomer}, nil, http.StatusUnauthorized, "", ""},
+		{"bad credentials", []string{roleCustomer}, map[string]string{"X-API-Key": "guess"}, http.StatusUnauthorized, "", ""},
+		{"spoofed caller replaced", []string{roleCustomer}, map[string]string{
+			"X-API-Key": "cust-key", callerHeader: "boss", roleHeader: roleAdmin,
+		}, http.StatusOK, "hermes", roleCustomer},
+		{"spoofed role doesn't grant access", []string{roleAdmin}, map[string]string{
+			"X-API-Key": "cust-key", roleHeader: roleAdmin,
+		}, http.StatusForbidden, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var caller, role string
+			var id Identity
+			h := a.identify(a.require(tt.roles, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				caller, role = r.Header.Get(callerHeader), r.Header.Get(roleHeader)
+				id = identityFrom(r.Context())
+			})))
+			r := httptest.NewRequest(http.MethodPost, "/deliveries", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d", w.Code, tt.wantCode)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate header")
+			}
+			if caller != tt.wantCaller || role != tt.wantRole {
+				t.Errorf("handler saw caller %q role %q, want %q %q", caller, role, tt.wantCaller, tt.wantRole)
+			}
+			if w.Code == http.StatusOK && (id.Name != tt.wantCaller || id.Role != tt.wantRole) {
+				t.Errorf("identityFrom() = %+v, want %s %s", id, tt.wantCaller, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestRequireDisabled(t *testing.T) {
+	a := &authenticator{}
+	var caller, role string
+	h := a.identify(a.require([]string{roleAdmin}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, role = r.Header.Get(callerHeader), r.Header.Get(roleHeader)
+	})))
+	r := httptest.NewRequest(http.MethodPost, "/deliveries", nil)
+	r.Header.Set(callerHeader, "boss")
+	r.Header.Set(roleHeader, roleAdmin)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || caller != "" || role != "" {
+		t.Errorf("code %d, handler saw caller %q role %q, want 200 with the client's headers stripped", w.Code, caller, role)
+	}
+}
+
+func TestNewAuthenticatorFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantEnabled bool
+		wantErr     bool
+	}{
+		{"nothing configured", nil, false, true},
+		{"explicitly disabled", map[string]string{"AUTH_DISABLED": "true"}, false, false},
+		{"disabled with keys", map[string]string{"AUTH_DISABLED": "true", "JWKS_FILE": testJWKS(t)}, false, true},
+		{"api keys", map[string]string{"API_KEYS_FILE": write("keys.json", `[{"name":"hermes","key":"k","role":"customer"}]`)}, true, false},
+		{"jwks", map[string]string{"JWKS_FILE": testJWKS(t)}, true, false},
+		{"key without a role", map[string]string{"API_KEYS_FILE": write("norole.json", `[{"name":"hermes","key":"k"}]`)}, false, true},
+		{"missing file", map[string]string{"API_KEYS_FILE": filepath.Join(dir, "missing.json")}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEYS_FILE", "")
+			t.Setenv("JWKS_FILE", "")
+			t.Setenv("AUTH_DISABLED", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			a, err := newAuthenticatorFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newAuthenticatorFromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && a.enabled != tt.wantEnabled {
+				t.Errorf("enabled = %v, want %v", a.enabled, tt.wantEnabled)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// planetexpress-api/gateway.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration wraps time.Duration so it can be written as "5s" in the route file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Route maps a public path onto an upstream service.
+type Route struct {
+	// Pattern is a ServeMux pattern such as "POST /deliveries".
+	Pattern string `json:"pattern"`
+	// Upstream names an entry in GatewayConfig.Upstreams.
+	Upstream string `json:"upstream"`
+	// UpstreamPath replaces the request path when set. The query is kept.
+	UpstreamPath string   `json:"upstream_path,omitempty"`
+	Roles        []string `json:"roles"`
+	Timeout      Duration `json:"timeout"`
+}
+
+// GatewayConfig is the format of ROUTES_FILE.
+type GatewayConfig struct {
+	Upstreams      map[string]string `json:"upstreams"`
+	ForwardHeaders []string          `json:"forward_headers"`
+	Routes         []Route           `json:"routes"`
+}
+
+var (
+	allRoles       = []string{roleCustomer, roleDispatcher, roleAdmin}
+	dispatchRoles  = []string{roleDispatcher, roleAdmin}
+	adminRoles     = []string{roleAdmin}
+	defaultTimeout = Duration(10 * time.Second)
+)
+
+// defaultGatewayConfig is used when ROUTES_FILE is not set.
+func defaultGatewayConfig() GatewayConfig {
+	return GatewayConfig{
+		Upstreams: map[string]string{
+			"delivery": deliveryServiceURL,
+			"package":  getEnv("PACKAGE_SERVICE_URL", "http://package-service"),
+			"crew":     getEnv("CREW_SERVICE_URL", "http://crew-service"),
+			"ship":     getEnv("SHIP_SERVICE_URL", "http://ship-service"),
+		},
+		ForwardHeaders: []string{
+			"Accept", "Content-Type", "User-Agent", "X-Request-Id",
+			"If-Match", "If-None-Match", callerHeader, roleHeader,
+		},
+		Routes: []Route{
+			{Pattern: "POST /deliveries", Upstream: "delivery", Roles: allRoles, Timeout: defaultTimeout},
+			{Pattern: "POST /deliveries/{id}/cancel", Upstream: "delivery", Roles: allRoles, Timeout: defaultTimeout},
+			{Pattern: "POST /quotes", Upstream: "delivery", Roles: allRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /packages", Upstream: "package", Roles: dispatchRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /packages/get", Upstream: "package", Roles: allRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /packages/proof", Upstream: "package", Roles: allRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /packages/incident", Upstream: "package", Roles: allRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /billing/ledger", Upstream: "package", Roles: allRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /billing/invoices", Upstream: "package", Roles: allRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /crew", Upstream: "crew", Roles: dispatchRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /ships", Upstream: "ship", Roles: dispatchRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /ship/status", Upstream: "ship", Roles: dispatchRoles, Timeout: defaultTimeout},
+			// Internal operations, for admins putting state right by hand.
+			// Other callers can't reach them through the gateway at all.
+			{Pattern: "PATCH /packages/update", Upstream: "package", Roles: adminRoles, Timeout: defaultTimeout},
+			{Pattern: "DELETE /packages/delete", Upstream: "package", Roles: adminRoles, Timeout: defaultTimeout},
+			{Pattern: "POST /crew/return", Upstream: "crew", Roles: adminRoles, Timeout: defaultTimeout},
+			{Pattern: "POST /ship/return", Upstream: "ship", Roles: adminRoles, Timeout: defaultTimeout},
+			{Pattern: "GET /admin/outbox", Upstream: "delivery", Roles: adminRoles, Timeout: defaultTimeout},
+			{Pattern: "POST /admin/outbox/replay", Upstream: "delivery", Roles: adminRoles, Timeout: defaultTimeout},
+			{Pattern: "POST /admin/simulate", Upstream: "delivery", Roles: adminRoles, Timeout: Duration(time.Minute)},
+		},
+	}
+}
+
+func loadGatewayConfig() (GatewayConfig, error) {
+	cfg := defaultGatewayConfig()
+	path := os.Getenv("ROUTES_FILE")
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	var file GatewayConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	// Upstreams in the file override the env-derived defaults; routes and
+	// forwarded headers replace them outright.
+	for name, u := range file.Upstreams {
+		cfg.Upstreams[name] = u
+	}
+	if file.ForwardHeaders != nil {
+		cfg.ForwardHeaders = file.ForwardHeaders
+	}
+	if file.Routes != nil {
+		cfg.Routes = file.Routes
+	}
+	return cfg, nil
+}
+
+// registerRoutes adds a proxy for every route in cfg to mux. Callers are
+// authenticated first, so the rate limiter can count requests against who
+// is making them, and the role check comes last.
+func registerRoutes(mux *http.ServeMux, cfg GatewayConfig, auth *authenticator, limiter *rateLimiter) error {
+	forward := make(map[string]bool, len(cfg.ForwardHeaders))
+	for _, h := range cfg.ForwardHeaders {
+		forward[http.CanonicalHeaderKey(h)] = true
+	}
+
+	for _, route := range cfg.Routes {
+		raw, ok := cfg.Upstreams[route.Upstream]
+		if !ok {
+			return fmt.Errorf("route %q: unknown upstream %q", route.Pattern, route.Upstream)
+		}
+		target, err := url.Parse(raw)
+		if err != nil {
+			return fmt.Errorf("route %q: %w", route.Pattern, err)
+		}
+		for _, role := range route.Roles {
+			if !validRole(role) {
+				return fmt.Errorf("route %q: unknown role %q", route.Pattern, role)
+			}
+		}
+
+		proxy := newRouteProxy(route, target, forward)
+		mux.Handle(route.Pattern, auth.identify(limiter.middleware(auth.require(route.Roles, proxy))))
+		slog.Info("Registered route", "pattern", route.Pattern, "upstream", target.String(), "roles", route.Roles)
+	}
+	return nil
+}
+
+// upstreamURLs returns the distinct upstreams referenced by the routes.
+func (cfg GatewayConfig) upstreamURLs() map[string]string {
+	used := make(map[string]string)
+	for _, route := range cfg.Routes {
+		used[route.Upstream] = cfg.Upstreams[route.Upstream]
+	}
+	return used
+}
+
+type statusKey struct{}
+
+func newRouteProxy(route Route, target *url.URL, forward map[string]bool) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Transport: httpClient.Transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			if route.UpstreamPath != "" {
+				pr.Out.URL.Path = strings.TrimRight(target.Path, "/") + route.UpstreamPath
+				pr.Out.URL.RawPath = ""
+			}
+			for name := range pr.Out.Header {
+				if !forward[name] {
+					pr.Out.Header.Del(name)
+				}
+			}
+			pr.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			*resp.Request.Context().Value(statusKey{}).(*int) = resp.StatusCode
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			code := http.StatusBadGateway
+			if errors.Is(err, context.DeadlineExceeded) {
+				code = http.StatusGatewayTimeout
+			}
+			*r.Context().Value(statusKey{}).(*int) = code
+			slog.Error("Upstream request failed", "route", route.Pattern, "upstream", target.String(), "err", err)
+			http.Error(w, "Error contacting upstream service", code)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsReceived.WithLabelValues(r.Method).Inc()
+		caller := identityFrom(r.Context())
+		slog.Debug("Proxying request", "route", route.Pattern, "path", r.URL.Path, "caller", caller.Name)
+
+		status := 0
+		ctx := context.WithValue(r.Context(), statusKey{}, &status)
+		if route.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(route.Timeout))
+			defer cancel()
+		}
+
+		start := time.Now()
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+		code := strconv.Itoa(status)
+		upstreamDuration.WithLabelValues(route.Pattern, code).Observe(time.Since(start).Seconds())
+		requestsProcessed.WithLabelValues(r.Method, code).Inc()
+	})
+}
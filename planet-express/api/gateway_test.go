@@ -0,0 +1,335 @@
+// planetexpress-api/gateway_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upstreamSeen is what a fake upstream received.
+type upstreamSeen struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query"`
+	Header http.Header `json:"header"`
+}
+
+// echoUpstream answers every request with what it saw, after delay.
+func echoUpstream(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		json.NewEncoder(w).Encode(upstreamSeen{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Header: r.Header})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testLimiter() *rateLimiter {
+	return &rateLimiter{
+		defaultQuota: Quota{RPS: 1000, Burst: 1000},
+		byCaller:     map[string]ClientQuota{},
+		byIP:         map[string]ClientQuota{},
+		buckets:      map[string]*tokenBucket{},
+	}
+}
+
+// testGateway registers cfg's routes with the test authenticator.
+func testGateway(t *testing.T, cfg GatewayConfig) http.Handler {
+	t.Helper()
+	mux := http.NewServeMux()
+	if err := registerRoutes(mux, cfg, testAuthenticator(t), testLimiter()); err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+func TestGatewayProxy(t *testing.T) {
+	up := echoUpstream(t, 0)
+	slow := echoUpstream(t, 200*time.Millisecond)
+	cfg := GatewayConfig{
+		Upstreams:      map[string]string{"delivery": up.URL, "package": up.URL + "/v1/", "slow": slow.URL, "down": "http://127.0.0.1:1"},
+		ForwardHeaders: []string{"Content-Type", "X-Request-Id", callerHeader, roleHeader},
+		Routes: []Route{
+			{Pattern: "POST /deliveries", Upstream: "delivery", Roles: allRoles},
+			{Pattern: "GET /parcels", Upstream: "package", UpstreamPath: "/packages", Roles: allRoles},
+			{Pattern: "GET /slow", Upstream: "slow", Roles: allRoles, Timeout: Duration(20 * time.Millisecond)},
+			{Pattern: "GET /down", Upstream: "down", Roles: allRoles},
+			{Pattern: "GET /crew", Upstream: "delivery", Roles: dispatchRoles},
+		},
+	}
+	gw := testGateway(t, cfg)
+
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		headers   map[string]string
+		wantCode  int
+		wantPath  string
+		wantQuery string
+	}{
+		{"proxied as is", http.MethodPost, "/deliveries?dry_run=1", nil, http.StatusOK, "/deliveries", "dry_run=1"},
+		{"path rewritten, query kept", http.MethodGet, "/parcels?status=pending", nil, http.StatusOK, "/v1/packages", "status=pending"},
+		{"wrong method", http.MethodGet, "/deliveries", nil, http.StatusMethodNotAllowed, "", ""},
+		{"no route", http.MethodGet, "/admin", nil, http.StatusNotFound, "", ""},
+		{"role not allowed", http.MethodGet, "/crew", nil, http.StatusForbidden, "", ""},
+		{"no credentials", http.MethodPost, "/deliveries", map[string]string{"X-API-Key": ""}, http.StatusUnauthorized, "", ""},
+		{"upstream timeout", http.MethodGet, "/slow", nil, http.StatusGatewayTimeout, "", ""},
+		{"upstream down", http.MethodGet, "/down", nil, http.StatusBadGateway, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader("{}"))
+			r.Header.Set("X-API-Key", "cust-key")
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			gw.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var seen upstreamSeen
+			if err := json.NewDecoder(w.Body).Decode(&seen); err != nil {
+				t.Fatal(err)
+			}
+			if seen.Method != tt.method || seen.Path != tt.wantPath || seen.Query != tt.wantQuery {
+				t.Errorf("upstream saw %s %s?%s, want %s %s?%s", seen.Method, seen.Path, seen.Query, tt.method, tt.wantPath, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestGatewayForwardHeaders(t *testing.T) {
+	up := echoUpstream(t, 0)
+	gw := testGateway(t, GatewayConfig{
+		Upstreams:      map[string]string{"delivery": up.URL},
+		ForwardHeaders: []string{"content-type", "X-Request-Id", callerHeader, roleHeader},
+		Routes:         []Route{{Pattern: "POST /deliveries", Upstream: "delivery", Roles: allRoles}},
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/deliveries", strings.NewReader("{}"))
+	r.RemoteAddr = "192.0.2.1:1234"
+	for k, v := range map[string]string{
+		"X-API-Key":    "cust-key",
+		"Content-Type": "application/json",
+		"X-Request-Id": "req-1",
+		"Cookie":       "session=abc",
+		"X-Debug":      "1",
+		callerHeader:   "boss",
+		roleHeader:     roleAdmin,
+	} {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("code = %d, want 200: %s", w.Code, w.Body)
+	}
+	var seen upstreamSeen
+	if err := json.NewDecoder(w.Body).Decode(&seen); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"Content-Type", "application/json"},
+		{"X-Request-Id", "req-1"},
+		{callerHeader, "hermes"},
+		{roleHeader, roleCustomer},
+		{"X-Forwarded-For", "192.0.2.1"},
+		{"X-API-Key", ""},
+		{"Cookie", ""},
+		{"X-Debug", ""},
+	}
+	for _, tt := range tests {
+		if got := seen.Header.Get(tt.header); got != tt.want {
+			t.Errorf("upstream saw %s: %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGatewayRateLimit(t *testing.T) {
+	up := echoUpstream(t, 0)
+	limiter := testLimiter()
+	limiter.defaultQuota = Quota{RPS: 0, Burst: 1}
+	mux := http.NewServeMux()
+	cfg := GatewayConfig{
+		Upstreams: map[string]string{"delivery": up.URL},
+		Routes:    []Route{{Pattern: "POST /deliveries", Upstream: "delivery", Roles: allRoles}},
+	}
+	if err := registerRoutes(mux, cfg, testAuthenticator(t), limiter); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every request comes from the same address; each caller still gets a
+	// bucket of their own, and bad keys share the address's.
+	tests := []struct {
+		key      string
+		wantCode int
+	}{
+		{"cust-key", http.StatusOK},
+		{"cust-key", http.StatusTooManyRequests},
+		{"admin-key", http.StatusOK},
+		{"guess-1", http.StatusUnauthorized},
+		{"guess-2", http.StatusTooManyRequests},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/deliveries", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-API-Key", tt.key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("request %d with %s = %d, want %d", i, tt.key, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestDefaultRoutes(t *testing.T) {
+	up := echoUpstream(t, 0)
+	cfg := defaultGatewayConfig()
+	for name := range cfg.Upstreams {
+		cfg.Upstreams[name] = up.URL
+	}
+	gw := testGateway(t, cfg)
+
+	tests := []struct {
+		method, path string
+		key          string
+		wantCode     int
+	}{
+		{http.MethodPost, "/deliveries", "cust-key", http.StatusOK},
+		{http.MethodGet, "/packages/get?id=P1", "cust-key", http.StatusOK},
+		{http.MethodGet, "/packages", "cust-key", http.StatusForbidden},
+		{http.MethodGet, "/packages", "admin-key", http.StatusOK},
+		{http.MethodGet, "/crew", "cust-key", http.StatusForbidden},
+		{http.MethodGet, "/crew", "admin-key", http.StatusOK},
+		{http.MethodGet, "/ships", "admin-key", http.StatusOK},
+		{http.MethodGet, "/ship/status", "admin-key", http.StatusOK},
+		{http.MethodGet, "/admin/outbox", "cust-key", http.StatusForbidden},
+		{http.MethodGet, "/admin/outbox", "admin-key", http.StatusOK},
+		{http.MethodPost, "/admin/outbox/replay", "admin-key", http.StatusOK},
+		{http.MethodPatch, "/packages/update", "cust-key", http.StatusForbidden},
+		{http.MethodPatch, "/packages/update", "admin-key", http.StatusOK},
+		{http.MethodPost, "/ship/return", "admin-key", http.StatusOK},
+		{http.MethodPost, "/crew/reserve", "admin-key", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set("X-API-Key", tt.key)
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s with %s = %d, want %d", tt.method, tt.path, tt.key, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestRegisterRoutesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+		want  string
+	}{
+		{"unknown upstream", Route{Pattern: "GET /x", Upstream: "billing", Roles: allRoles}, "unknown upstream"},
+		{"unknown role", Route{Pattern: "GET /x", Upstream: "bad", Roles: []string{"intern"}}, "unknown role"},
+		{"bad upstream url", Route{Pattern: "GET /x", Upstream: "broken", Roles: allRoles}, "GET /x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := GatewayConfig{
+				Upstreams: map[string]string{"bad": "http://bad", "broken": "http://[::1"},
+				Routes:    []Route{tt.route},
+			}
+			err := registerRoutes(http.NewServeMux(), cfg, testAuthenticator(t), testLimiter())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("registerRoutes() error = %v, want it to mention %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadGatewayConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name        string
+		file        string
+		wantRoutes  []string
+		wantHeaders int
+		wantErr     bool
+	}{
+		{"defaults", "", []string{"POST /deliveries", "POST /deliveries/{id}/cancel", "POST /quotes", "GET /packages", "GET /packages/get", "GET /packages/proof", "GET /packages/incident", "GET /billing/ledger", "GET /billing/invoices", "GET /crew", "GET /ships", "GET /ship/status", "PATCH /packages/update", "DELETE /packages/delete", "POST /crew/return", "POST /ship/return", "GET /admin/outbox", "POST /admin/outbox/replay", "POST /admin/simulate"}, 8, false},
+		{"routes replaced", write("routes.json", `{
+			"upstreams": {"billing": "http://billing"},
+			"routes": [{"pattern": "GET /invoices", "upstream": "billing", "roles": ["customer"], "timeout": "2s"}]
+		}`), []string{"GET /invoices"}, 8, false},
+		{"headers replaced", write("headers.json", `{"forward_headers": ["Accept"]}`), nil, 1, false},
+		{"bad timeout", write("timeout.json", `{"routes": [{"pattern": "GET /x", "timeout": 5}]}`), nil, 0, true},
+		{"missing file", filepath.Join(dir, "missing.json"), nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ROUTES_FILE", tt.file)
+			cfg, err := loadGatewayConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadGatewayConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var patterns []string
+			for _, r := range cfg.Routes {
+				patterns = append(patterns, r.Pattern)
+			}
+			if tt.wantRoutes != nil && !slices.Equal(patterns, tt.wantRoutes) {
+				t.Errorf("routes = %v, want %v", patterns, tt.wantRoutes)
+			}
+			if len(cfg.ForwardHeaders) != tt.wantHeaders {
+				t.Errorf("forward headers = %v, want %d of them", cfg.ForwardHeaders, tt.wantHeaders)
+			}
+			if cfg.Upstreams["delivery"] == "" {
+				t.Error("default delivery upstream dropped")
+			}
+		})
+	}
+}
+
+func TestUpstreamURLs(t *testing.T) {
+	cfg := GatewayConfig{
+		Upstreams: map[string]string{"delivery": "http://d", "package": "http://p", "unused": "http://u"},
+		Routes: []Route{
+			{Pattern: "POST /deliveries", Upstream: "delivery"},
+			{Pattern: "GET /packages", Upstream: "package"},
+			{Pattern: "GET /packages/get", Upstream: "package"},
+		},
+	}
+	got := cfg.upstreamURLs()
+	if len(got) != 2 || got["delivery"] != "http://d" || got["package"] != "http://p" {
+		t.Errorf("upstreamURLs() = %v, want delivery and package only", got)
+	}
+}
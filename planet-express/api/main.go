@@ -2,14 +2,13 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"time"
 
+	"github.com/gingercookie/planet-express/internal/health"
+	"github.com/gingercookie/planet-express/internal/tlsconfig"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -17,6 +16,10 @@ import (
 var (
 	deliveryServiceURL = getEnv("DELIVERY_SERVICE_URL", "http://planetexpress-delivery")
 
+	// httpClient's transport is shared by all calls to backend services.
+	// main switches it to mutual TLS when certificates are configured.
+	httpClient = &http.Client{Timeout: 30 * time.Second}
+
 	requestsReceived = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "planet_express_api_requests_received_total",
@@ -32,6 +35,31 @@ var (
 		},
 		[]string{"method", "code"},
 	)
+
+	requestsThrottled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_api_requests_throttled_total",
+			Help: "The total number of requests rejected by the api rate limiter",
+		},
+		[]string{"client"},
+	)
+
+	requestsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_api_requests_rejected_total",
+			Help: "The total number of requests rejected by api authentication or authorization",
+		},
+		[]string{"reason"},
+	)
+
+	upstreamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "planet_express_api_upstream_request_duration_seconds",
+			Help:    "Time taken to proxy a request to an upstream service, by route and status code",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "code"},
+	)
 )
 
 func getEnv(key, def string) string {
@@ -41,62 +69,76 @@ func getEnv(key, def string) string {
 	return def
 }
 
-// handleNewDelivery forwards delivery requests to the DeliveryService
-func handleNewDelivery(w http.ResponseWriter, r *http.Request) {
-	slog.Info("Got request for new delivery")
-
-	requestsReceived.WithLabelValues(r.Method).Inc()
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "POST only", http.StatusMethodNotAllowed)
-		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusMethodNotAllowed)).Inc()
-		return
+func main() {
+	levelStr := getEnv("LOG_LEVEL", "INFO")
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+		level = slog.LevelInfo
 	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
 
-	body, err := io.ReadAll(r.Body)
+	certs, err := tlsconfig.FromEnv()
 	if err != nil {
-		http.Error(w, "Unable to read request", http.StatusBadRequest)
-		requestsProcessed.WithLabelValues(http.MethodPost, strconv.Itoa(http.StatusBadRequest)).Inc()
-		return
+		slog.Error("Invalid TLS configuration", "err", err)
+		os.Exit(1)
+	}
+	if certs != nil {
+		transport := certs.Transport()
+		httpClient.Transport = transport
+		health.Client.Transport = transport
 	}
 
-	slog.Info("Dispatching request to delivery-service", "url", deliveryServiceURL)
-	resp, err := http.Post(fmt.Sprintf("%s/deliveries", deliveryServiceURL), "application/json", bytes.NewBuffer(body))
+	readyTTL := 5 * time.Second
+	if val, err := time.ParseDuration(os.Getenv("READINESS_CACHE_TTL")); err == nil {
+		readyTTL = val
+	}
+	routes, err := loadGatewayConfig()
 	if err != nil {
-		http.Error(w, "Error contacting DeliveryService: "+err.Error(), http.StatusServiceUnavailable)
-		requestsProcessed.WithLabelValues(http.MethodPost, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
-		return
+		slog.Error("Invalid route configuration", "err", err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
-
-	w.WriteHeader(resp.StatusCode)
-	if _, err = io.Copy(w, resp.Body); err != nil {
-		slog.Error("Failed to copy response body", "err", err)
+	deps := make(map[string]func() error)
+	for name, u := range routes.upstreamURLs() {
+		deps[name] = health.HTTPDependency(u)
 	}
-	requestsProcessed.WithLabelValues(http.MethodPost, strconv.Itoa(resp.StatusCode)).Inc()
-}
+	readiness := health.NewChecker(deps, readyTTL)
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte(`{"status":"OK"}`))
-}
+	limiter, err := newRateLimiterFromEnv()
+	if err != nil {
+		slog.Error("Invalid rate limit configuration", "err", err)
+		os.Exit(1)
+	}
+	go limiter.evictIdle(10 * time.Minute)
 
-func main() {
-	levelStr := getEnv("LOG_LEVEL", "INFO")
-	var level slog.Level
-	if err := level.UnmarshalText([]byte(levelStr)); err != nil {
-		level = slog.LevelInfo
+	auth, err := newAuthenticatorFromEnv()
+	if err != nil {
+		slog.Error("Invalid authentication configuration", "err", err)
+		os.Exit(1)
+	}
+	if !auth.enabled {
+		slog.Warn("AUTH_DISABLED is set, every route is open to anyone")
 	}
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
 
 	apiMux := http.NewServeMux()
-	apiMux.HandleFunc("/deliveries", handleNewDelivery)
-	apiMux.HandleFunc("/health", healthCheck)
+	if err := registerRoutes(apiMux, routes, auth, limiter); err != nil {
+		slog.Error("Invalid route configuration", "err", err)
+		os.Exit(1)
+	}
+	apiMux.HandleFunc("/health", health.Healthz) // kept for existing clients
+	apiMux.HandleFunc("/healthz", health.Healthz)
+	apiMux.HandleFunc("/readyz", readiness.Readyz)
 
 	prometheus.MustRegister(requestsReceived)
 	prometheus.MustRegister(requestsProcessed)
+	prometheus.MustRegister(requestsThrottled)
+	prometheus.MustRegister(requestsRejected)
+	prometheus.MustRegister(upstreamDuration)
 
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
+	// Probes use the metrics port on every service, see internal/tlsconfig.
+	metricsMux.HandleFunc("/healthz", health.Healthz)
+	metricsMux.HandleFunc("/readyz", readiness.Readyz)
 
 	go func() {
 		slog.Info("Prometheus metrics endpoint running", "addr", ":2112")
@@ -107,7 +149,7 @@ func main() {
 		}
 	}()
 
-	slog.Info("PlanetExpressAPI running", "addr", ":8080")
+	slog.Info("PlanetExpressAPI running", "addr", ":8080", "mtls_upstream", certs != nil)
 	if err := http.ListenAndServe(":8080", apiMux); err != nil {
 		slog.Error("server error", "err", err)
 		os.Exit(1)
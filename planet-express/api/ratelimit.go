@@ -0,0 +1,215 @@
+// planetexpress-api/ratelimit.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Quota struct {
+	RPS   float64 `json:"rps"`
+	Burst float64 `json:"burst"`
+}
+
+// ClientQuota overrides the default quota for one client, matched by the
+// authenticated caller or by source IP.
+type ClientQuota struct {
+	Name   string `json:"name"`
+	Caller string `json:"caller,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Quota
+}
+
+// QuotaConfig is the format of RATE_LIMIT_QUOTAS_FILE.
+type QuotaConfig struct {
+	Default Quota         `json:"default"`
+	Clients []ClientQuota `json:"clients"`
+}
+
+// tokenBucket holds up to quota.Burst tokens and refills at quota.RPS.
+type tokenBucket struct {
+	quota    Quota
+	tokens   float64
+	updated  time.Time
+	lastSeen time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.quota.Burst, b.tokens+now.Sub(b.updated).Seconds()*b.quota.RPS)
+	b.updated = now
+}
+
+// take removes one token if available. When none is, it returns how long
+// until one will be.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	b.lastSeen = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, b.timeUntil(1)
+}
+
+// timeUntil returns how long until the bucket holds n tokens.
+func (b *tokenBucket) timeUntil(n float64) time.Duration {
+	if b.tokens >= n || b.quota.RPS <= 0 {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.quota.RPS * float64(time.Second))
+}
+
+type rateLimiter struct {
+	defaultQuota Quota
+	byCaller     map[string]ClientQuota
+	byIP         map[string]ClientQuota
+	trustedHops  int // proxies in front of us that append to X-Forwarded-For
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiterFromEnv() (*rateLimiter, error) {
+	rps, err := strconv.ParseFloat(getEnv("RATE_LIMIT_RPS", "10"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_RPS: %w", err)
+	}
+	burst, err := strconv.ParseFloat(getEnv("RATE_LIMIT_BURST", "20"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_BURST: %w", err)
+	}
+	hops, err := strconv.Atoi(getEnv("TRUSTED_PROXY_HOPS", "0"))
+	if err != nil || hops < 0 {
+		return nil, fmt.Errorf("TRUSTED_PROXY_HOPS must be a whole number of proxies, got %q", os.Getenv("TRUSTED_PROXY_HOPS"))
+	}
+	cfg := QuotaConfig{Default: Quota{RPS: rps, Burst: burst}}
+
+	if path := os.Getenv("RATE_LIMIT_QUOTAS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	rl := &rateLimiter{
+		defaultQuota: cfg.Default,
+		byCaller:     make(map[string]ClientQuota),
+		byIP:         make(map[string]ClientQuota),
+		trustedHops:  hops,
+		buckets:      make(map[string]*tokenBucket),
+	}
+	for _, c := range cfg.Clients {
+		switch {
+		case c.Caller != "":
+			rl.byCaller[c.Caller] = c
+		case c.IP != "":
+			rl.byIP[c.IP] = c
+		default:
+			return nil, fmt.Errorf("quota for client %q needs a caller or ip", c.Name)
+		}
+	}
+	return rl, nil
+}
+
+// clientIP returns the caller's address. Behind trustedHops proxies such as
+// Traefik, each of which appends the address it got the request from to
+// X-Forwarded-For, that is the trustedHops-th entry from the right. Entries
+// further left come from the client and can say anything.
+func (rl *rateLimiter) clientIP(r *http.Request) string {
+	if rl.trustedHops > 0 {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if len(hops) >= rl.trustedHops {
+			if ip := strings.TrimSpace(hops[len(hops)-rl.trustedHops]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// identify returns the bucket key, the metrics label and the quota for r.
+// Authenticated callers are limited as themselves, whichever key or token
+// they use. Everyone else is limited by IP, including callers whose
+// credentials were refused, so rotating made-up keys doesn't dodge the limit.
+func (rl *rateLimiter) identify(r *http.Request) (string, string, Quota) {
+	if id := identityFrom(r.Context()); id.Method != "none" {
+		if c, ok := rl.byCaller[id.Name]; ok {
+			return "caller:" + id.Name, c.Name, c.Quota
+		}
+		return "caller:" + id.Name, id.Name, rl.defaultQuota
+	}
+	ip := rl.clientIP(r)
+	if c, ok := rl.byIP[ip]; ok {
+		return "ip:" + ip, c.Name, c.Quota
+	}
+	return "ip:" + ip, "anonymous", rl.defaultQuota
+}
+
+// middleware enforces the caller's quota and sets RateLimit-* headers on
+// every response, and Retry-After on 429s.
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, client, quota := rl.identify(r)
+		now := time.Now()
+
+		rl.mu.Lock()
+		b, ok := rl.buckets[key]
+		if !ok {
+			b = &tokenBucket{quota: quota, tokens: quota.Burst, updated: now}
+			rl.buckets[key] = b
+		}
+		allowed, wait := b.take(now)
+		remaining := math.Floor(b.tokens)
+		reset := b.timeUntil(quota.Burst)
+		rl.mu.Unlock()
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(int(quota.Burst)))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			slog.Warn("Rate limit exceeded", "client", client, "key", key, "retry_after", retryAfter)
+			requestsReceived.WithLabelValues(r.Method).Inc()
+			requestsThrottled.WithLabelValues(client).Inc()
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusTooManyRequests)).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// evictIdle drops buckets that have been idle long enough to be full again,
+// so one-off clients don't pile up in memory.
+func (rl *rateLimiter) evictIdle(idle time.Duration) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-idle)
+		rl.mu.Lock()
+		for key, b := range rl.buckets {
+			if b.lastSeen.Before(cutoff) {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
@@ -0,0 +1,163 @@
+// planetexpress-api/ratelimit_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	type take struct {
+		at      time.Duration // since start
+		allowed bool
+		wait    time.Duration
+	}
+	tests := []struct {
+		name  string
+		quota Quota
+		takes []take
+	}{
+		{
+			name:  "burst then empty",
+			quota: Quota{RPS: 1, Burst: 2},
+			takes: []take{{0, true, 0}, {0, true, 0}, {0, false, time.Second}},
+		},
+		{
+			name:  "refills at rps",
+			quota: Quota{RPS: 2, Burst: 1},
+			takes: []take{{0, true, 0}, {250 * time.Millisecond, false, 250 * time.Millisecond}, {500 * time.Millisecond, true, 0}},
+		},
+		{
+			name:  "never refills past burst",
+			quota: Quota{RPS: 10, Burst: 2},
+			takes: []take{{time.Hour, true, 0}, {time.Hour, true, 0}, {time.Hour, false, 100 * time.Millisecond}},
+		},
+		{
+			name:  "zero rps never refills",
+			quota: Quota{RPS: 0, Burst: 1},
+			takes: []take{{0, true, 0}, {time.Hour, false, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &tokenBucket{quota: tt.quota, tokens: tt.quota.Burst, updated: start}
+			for i, tk := range tt.takes {
+				allowed, wait := b.take(start.Add(tk.at))
+				if allowed != tk.allowed || wait != tk.wait {
+					t.Errorf("take %d at %s = %v, %s, want %v, %s", i, tk.at, allowed, wait, tk.allowed, tk.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterIdentify(t *testing.T) {
+	rl := &rateLimiter{
+		defaultQuota: Quota{RPS: 10, Burst: 20},
+		byCaller:     map[string]ClientQuota{"hermes": {Name: "hermes", Caller: "hermes", Quota: Quota{RPS: 1, Burst: 1}}},
+		byIP:         map[string]ClientQuota{"10.0.0.7": {Name: "office", IP: "10.0.0.7", Quota: Quota{RPS: 5, Burst: 5}}},
+	}
+	hermes := &Identity{Name: "hermes", Role: roleCustomer, Method: "api_key"}
+	tests := []struct {
+		name       string
+		caller     *Identity // authenticated caller, if any
+		hops       int
+		remote     string
+		xff        []string
+		wantKey    string
+		wantClient string
+		wantQuota  Quota
+	}{
+		{"caller with a quota", hermes, 0, "192.0.2.1:1234", nil, "caller:hermes", "hermes", Quota{RPS: 1, Burst: 1}},
+		{"caller on the default quota", &Identity{Name: "zapp", Role: roleDispatcher, Method: "jwt"}, 0, "10.0.0.7:1234", nil, "caller:zapp", "zapp", Quota{RPS: 10, Burst: 20}},
+		{"unauthenticated by ip", nil, 0, "192.0.2.1:1234", nil, "ip:192.0.2.1", "anonymous", Quota{RPS: 10, Burst: 20}},
+		{"known ip", nil, 0, "10.0.0.7:1234", nil, "ip:10.0.0.7", "office", Quota{RPS: 5, Burst: 5}},
+		{"forwarded for ignored without trusted proxies", nil, 0, "192.0.2.1:1234", []string{"10.0.0.7"}, "ip:192.0.2.1", "anonymous", Quota{RPS: 10, Burst: 20}},
+		{"rightmost hop behind one proxy", nil, 1, "192.0.2.9:1234", []string{"10.0.0.7"}, "ip:10.0.0.7", "office", Quota{RPS: 5, Burst: 5}},
+		{"spoofed hop ignored", nil, 1, "192.0.2.9:1234", []string{"10.0.0.7, 192.0.2.1"}, "ip:192.0.2.1", "anonymous", Quota{RPS: 10, Burst: 20}},
+		{"spoofed header line ignored", nil, 1, "192.0.2.9:1234", []string{"10.0.0.7", "192.0.2.1"}, "ip:192.0.2.1", "anonymous", Quota{RPS: 10, Burst: 20}},
+		{"two proxies", nil, 2, "192.0.2.9:1234", []string{"10.0.0.8, 10.0.0.7, 192.0.2.5"}, "ip:10.0.0.7", "office", Quota{RPS: 5, Burst: 5}},
+		{"fewer hops than proxies", nil, 2, "192.0.2.9:1234", []string{"10.0.0.7"}, "ip:192.0.2.9", "anonymous", Quota{RPS: 10, Burst: 20}},
+		{"no forwarded for behind a proxy", nil, 1, "192.0.2.9:1234", nil, "ip:192.0.2.9", "anonymous", Quota{RPS: 10, Burst: 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl.trustedHops = tt.hops
+			r := httptest.NewRequest(http.MethodPost, "/deliveries", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.caller != nil {
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, *tt.caller))
+			}
+			key, client, quota := rl.identify(r)
+			if key != tt.wantKey || client != tt.wantClient || quota != tt.wantQuota {
+				t.Errorf("identify() = %q, %q, %+v, want %q, %q, %+v", key, client, quota, tt.wantKey, tt.wantClient, tt.wantQuota)
+			}
+		})
+	}
+}
+
+func TestNewRateLimiterFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		hops     string
+		wantHops int
+		wantErr  bool
+	}{
+		{"default", "", 0, false},
+		{"behind traefik", "1", 1, false},
+		{"negative", "-1", 0, true},
+		{"not a number", "yes", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXY_HOPS", tt.hops)
+			rl, err := newRateLimiterFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newRateLimiterFromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && rl.trustedHops != tt.wantHops {
+				t.Errorf("trustedHops = %d, want %d", rl.trustedHops, tt.wantHops)
+			}
+		})
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	rl := &rateLimiter{
+		defaultQuota: Quota{RPS: 0.5, Burst: 2},
+		byCaller:     map[string]ClientQuota{},
+		byIP:         map[string]ClientQuota{},
+		buckets:      map[string]*tokenBucket{},
+	}
+	h := rl.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		code       int
+		remaining  string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", ""},
+		{http.StatusOK, "0", ""},
+		{http.StatusTooManyRequests, "0", "2"},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/deliveries", nil))
+		if w.Code != tt.code {
+			t.Errorf("request %d: code = %d, want %d", i, w.Code, tt.code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: RateLimit-Remaining = %q, want %q", i, got, tt.remaining)
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("request %d: Retry-After = %q, want %q", i, got, tt.retryAfter)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// crew-service/events.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deduper = events.NewDeduper(time.Hour)
+
+	eventsConsumed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_crew_events_consumed_total",
+			Help: "The total number of delivery events consumed, by type and result (applied, duplicate, rejected, error)",
+		},
+		[]string{"type", "result"},
+	)
+)
+
+// consumeEvents returns the crew member to base once their flight is back,
+// and records how it went.
+func consumeEvents(b events.Broker) error {
+	return b.Subscribe(events.DeliveriesSubject, "crew-service", handleEvent)
+}
+
+func handleEvent(data []byte) error {
+	var ev events.Event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		eventsConsumed.WithLabelValues("unknown", "error").Inc()
+		return fmt.Errorf("invalid delivery event: %w", err)
+	}
+	if ev.Type != events.Returned {
+		return nil
+	}
+	// Dedupe by event ID rather than relying on release being idempotent:
+	// a late redelivery must not free a crew member that has been reserved
+	// again since.
+	if !deduper.FirstTime(ev.ID) {
+		eventsConsumed.WithLabelValues(ev.Type, "duplicate").Inc()
+		return nil
+	}
+
+	if !releaseCrew(CrewReturn{Name: ev.Crew, Delivered: ev.Delivered, Failed: ev.Failed, FlightSeconds: ev.FlightSeconds}) {
+		slog.Warn("Delivery event names an unknown crew member", "type", ev.Type, "name", ev.Crew)
+		eventsConsumed.WithLabelValues(ev.Type, "rejected").Inc()
+		return nil
+	}
+	slog.Info("Returned crew member to base", "name", ev.Crew, "flight_id", ev.FlightID)
+	eventsConsumed.WithLabelValues(ev.Type, "applied").Inc()
+	return nil
+}
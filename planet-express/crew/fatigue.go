@@ -0,0 +1,128 @@
+// crew-service/fatigue.go
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/env"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// fatigueWeight is how much a crew member's risk grows at the end of a
+	// full duty period: 1 doubles it.
+	fatigueWeight = 1.0
+	// experienceWeight is how far experience can bring risk down: 0.5
+	// halves it for the most seasoned crew.
+	experienceWeight = 0.5
+	// experienceHalfway is the number of completed deliveries that earns
+	// half the experience discount.
+	experienceHalfway = 20
+)
+
+var (
+	// restPeriod is how long a crew member must rest after a long flight or
+	// a full duty period. Resting that long also clears their fatigue.
+	restPeriod = env.Duration("CREW_REST_PERIOD", 30*time.Second)
+	// longFlight is the flight time that sends a crew member straight to rest.
+	longFlight = env.Duration("CREW_LONG_FLIGHT", 15*time.Second)
+	// maxDuty is how much flying a crew member can do between rests.
+	maxDuty = env.Duration("CREW_MAX_DUTY", time.Minute)
+
+	crewDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_crew_deliveries_total",
+			Help: "The total number of deliveries crew members have come back from, by name and outcome (delivered, failed)",
+		},
+		[]string{"name", "outcome"},
+	)
+
+	crewFlightSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_crew_flight_seconds_total",
+			Help: "The total time crew members have spent flying, by name",
+		},
+		[]string{"name"},
+	)
+)
+
+// CrewStats is a crew member's record. Durations are in simulated time.
+type CrewStats struct {
+	Delivered  int           // completed deliveries
+	Failed     int           // failed deliveries
+	Flown      time.Duration // in total
+	Duty       time.Duration // since they last rested
+	LastReturn time.Time
+	RestUntil  time.Time
+}
+
+// fatigue is how far through a duty period the crew member is, from 0 to 1.
+// It wears off completely after a full rest.
+func (s *CrewStats) fatigue(now time.Time) float64 {
+	if s.Duty == 0 || now.Sub(s.LastReturn) >= restPeriod {
+		return 0
+	}
+	return min(float64(s.Duty)/float64(maxDuty), 1)
+}
+
+// experience grows with completed deliveries, from 0 towards 1.
+func (s *CrewStats) experience() float64 {
+	return float64(s.Delivered) / float64(s.Delivered+experienceHalfway)
+}
+
+func (s *CrewStats) resting(now time.Time) bool {
+	return now.Before(s.RestUntil)
+}
+
+// effectiveRisk is the chance the crew member fails a delivery right now:
+// their base risk, raised by fatigue and lowered by experience.
+func effectiveRisk(c *CrewMember, now time.Time) float64 {
+	risk := c.Risk * (1 + fatigueWeight*c.Stats.fatigue(now)) * (1 - experienceWeight*c.Stats.experience())
+	return min(max(risk, 0), 1)
+}
+
+// recordFlight adds a finished flight to c's record and sends them to rest
+// if it was a long one or their duty period is up. c.Lock must be held.
+func recordFlight(c *CrewMember, delivered, failed int, flown time.Duration, now time.Time) {
+	s := &c.Stats
+	if now.Sub(s.LastReturn) >= restPeriod+flown {
+		// They were rested before this flight took off.
+		s.Duty = 0
+	}
+	s.Delivered += delivered
+	s.Failed += failed
+	s.Flown += flown
+	s.Duty += flown
+	s.LastReturn = now
+	crewDeliveries.WithLabelValues(c.Name, "delivered").Add(float64(delivered))
+	crewDeliveries.WithLabelValues(c.Name, "failed").Add(float64(failed))
+	crewFlightSeconds.WithLabelValues(c.Name).Add(flown.Seconds())
+
+	if flown >= longFlight || s.Duty >= maxDuty {
+		s.RestUntil = now.Add(restPeriod)
+		slog.Info("Crew member sent to rest", "name", c.Name, "flight", flown, "duty", s.Duty, "until", s.RestUntil)
+	}
+}
+
+// riskCollectors report each crew member's effective risk as it stands when
+// scraped, since fatigue wears off without anything happening.
+func riskCollectors() []prometheus.Collector {
+	var collectors []prometheus.Collector
+	for i := range crew {
+		c := &crew[i]
+		collectors = append(collectors, prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "planet_express_crew_effective_risk",
+				Help:        "The chance a crew member fails their next delivery, after fatigue and experience",
+				ConstLabels: prometheus.Labels{"name": c.Name},
+			},
+			func() float64 {
+				c.Lock.Lock()
+				defer c.Lock.Unlock()
+				return effectiveRisk(c, clock.Now())
+			},
+		))
+	}
+	return collectors
+}
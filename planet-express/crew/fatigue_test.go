@@ -0,0 +1,115 @@
+// crew-service/fatigue_test.go
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var start = time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestCrewStatsFatigue(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats CrewStats
+		now   time.Time
+		want  float64
+	}{
+		{"never flown", CrewStats{}, start, 0},
+		{"half a duty period", CrewStats{Duty: maxDuty / 2, LastReturn: start}, start, 0.5},
+		{"past a full duty period", CrewStats{Duty: 2 * maxDuty, LastReturn: start}, start, 1},
+		{"still resting", CrewStats{Duty: maxDuty / 2, LastReturn: start}, start.Add(restPeriod - time.Second), 0.5},
+		{"rested", CrewStats{Duty: maxDuty / 2, LastReturn: start}, start.Add(restPeriod), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stats.fatigue(tt.now); got != tt.want {
+				t.Errorf("fatigue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveRisk(t *testing.T) {
+	tests := []struct {
+		name  string
+		risk  float64
+		stats CrewStats
+		want  float64
+	}{
+		{"fresh and green", 0.2, CrewStats{}, 0.2},
+		{"fully fatigued", 0.2, CrewStats{Duty: maxDuty, LastReturn: start}, 0.4},
+		{"seasoned", 0.2, CrewStats{Delivered: experienceHalfway}, 0.15},
+		{"fatigued and seasoned", 0.2, CrewStats{Delivered: experienceHalfway, Duty: maxDuty, LastReturn: start}, 0.3},
+		{"capped at certain failure", 0.8, CrewStats{Duty: maxDuty, LastReturn: start}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CrewMember{Name: "Fry", Risk: tt.risk, Stats: tt.stats}
+			if got := effectiveRisk(c, start); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("effectiveRisk() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordFlight(t *testing.T) {
+	tests := []struct {
+		name      string
+		stats     CrewStats
+		delivered int
+		failed    int
+		flown     time.Duration
+		wantStats CrewStats
+	}{
+		{
+			"short delivered flight",
+			CrewStats{},
+			1, 0, 5 * time.Second,
+			CrewStats{Delivered: 1, Flown: 5 * time.Second, Duty: 5 * time.Second, LastReturn: start},
+		},
+		{
+			"failed delivery adds to duty",
+			CrewStats{Delivered: 1, Flown: 5 * time.Second, Duty: 5 * time.Second, LastReturn: start.Add(-10 * time.Second)},
+			0, 1, 5 * time.Second,
+			CrewStats{Delivered: 1, Failed: 1, Flown: 10 * time.Second, Duty: 10 * time.Second, LastReturn: start},
+		},
+		{
+			"several drops on one flight",
+			CrewStats{},
+			3, 1, 10 * time.Second,
+			CrewStats{Delivered: 3, Failed: 1, Flown: 10 * time.Second, Duty: 10 * time.Second, LastReturn: start},
+		},
+		{
+			"rested before take-off",
+			CrewStats{Flown: 50 * time.Second, Duty: 50 * time.Second, LastReturn: start.Add(-restPeriod - 5*time.Second)},
+			1, 0, 5 * time.Second,
+			CrewStats{Delivered: 1, Flown: 55 * time.Second, Duty: 5 * time.Second, LastReturn: start},
+		},
+		{
+			"long flight",
+			CrewStats{},
+			1, 0, longFlight,
+			CrewStats{Delivered: 1, Flown: longFlight, Duty: longFlight, LastReturn: start, RestUntil: start.Add(restPeriod)},
+		},
+		{
+			"duty period up",
+			CrewStats{Duty: maxDuty - time.Second, Flown: maxDuty - time.Second, LastReturn: start.Add(-2 * time.Second)},
+			1, 0, time.Second,
+			CrewStats{Delivered: 1, Flown: maxDuty, Duty: maxDuty, LastReturn: start, RestUntil: start.Add(restPeriod)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CrewMember{Name: "Fry", Stats: tt.stats}
+			recordFlight(c, tt.delivered, tt.failed, tt.flown, start)
+			if c.Stats != tt.wantStats {
+				t.Errorf("Stats = %+v, want %+v", c.Stats, tt.wantStats)
+			}
+			if got, want := c.Stats.resting(start), !tt.wantStats.RestUntil.IsZero(); got != want {
+				t.Errorf("resting() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -3,22 +3,61 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/gingercookie/planet-express/internal/health"
+	"github.com/gingercookie/planet-express/internal/sim"
+	"github.com/gingercookie/planet-express/internal/tlsconfig"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// CrewMember's Risk is their base risk, before fatigue and experience.
+// Qualifications are the hazard classes they may carry.
 type CrewMember struct {
-	Name      string     `json:"name"`
-	Role      string     `json:"role"`
-	Available bool       `json:"available"`
-	Risk      float64    `json:"risk"`
-	Lock      sync.Mutex `json:"-"`
+	Name           string     `json:"name"`
+	Role           string     `json:"role"`
+	Available      bool       `json:"available"`
+	Risk           float64    `json:"risk"`
+	Qualifications []string   `json:"qualifications,omitempty"`
+	Stats          CrewStats  `json:"-"`
+	Lock           sync.Mutex `json:"-"`
+}
+
+// CrewStatus is the read-only view of a crew member. Risk is their effective
+// risk.
+type CrewStatus struct {
+	Name           string     `json:"name"`
+	Role           string     `json:"role"`
+	Available      bool       `json:"available"`
+	Risk           float64    `json:"risk"`
+	BaseRisk       float64    `json:"base_risk"`
+	Qualifications []string   `json:"qualifications,omitempty"`
+	Delivered      int        `json:"delivered"`
+	Failed         int        `json:"failed"`
+	HoursFlown     float64    `json:"hours_flown"`
+	Fatigue        float64    `json:"fatigue"`
+	RestingFor     float64    `json:"resting_seconds"` // since they last came back
+	RestUntil      *time.Time `json:"rest_until,omitempty"`
+}
+
+// CrewReturn is the body of POST /crew/return. The other fields are set when
+// the crew member is back from a flight, and go on their record.
+type CrewReturn struct {
+	Name          string  `json:"name"`
+	Delivered     int     `json:"delivered,omitempty"`
+	Failed        int     `json:"failed,omitempty"`
+	FlightSeconds float64 `json:"flight_seconds,omitempty"`
 }
 
 type CrewResponse struct {
@@ -27,10 +66,15 @@ type CrewResponse struct {
 }
 
 var (
+	// clock and rng drive everything simulated. main replaces them from
+	// the SIM_* variables at startup.
+	clock sim.Clock = sim.RealClock{}
+	rng             = sim.NewRand(rand.Uint64())
+
 	crew = []CrewMember{
-		{Name: "Fry", Role: "Delivery Boy", Available: true, Risk: 0.25},
-		{Name: "Leela", Role: "Captain", Available: true, Risk: 0.05},
-		{Name: "Bender", Role: "Bending Unit", Available: true, Risk: 0.40},
+		{Name: "Fry", Role: "Delivery Boy", Available: true, Risk: 0.25, Qualifications: []string{"biohazard"}},
+		{Name: "Leela", Role: "Captain", Available: true, Risk: 0.05, Qualifications: []string{"biohazard", "explosive", "exotic", "flammable"}},
+		{Name: "Bender", Role: "Bending Unit", Available: true, Risk: 0.40, Qualifications: []string{"explosive", "flammable"}},
 	}
 
 	requestsReceived = prometheus.NewCounterVec(
@@ -50,18 +94,52 @@ var (
 	)
 )
 
+// qualifiedFor reports whether c may carry every hazard class in hazards.
+func (c *CrewMember) qualifiedFor(hazards []string) bool {
+	for _, h := range hazards {
+		if !slices.Contains(c.Qualifications, h) {
+			return false
+		}
+	}
+	return true
+}
+
+// reserveCrew reserves the first free crew member who isn't resting and is
+// qualified for every hazard class in ?hazard= (comma-separated), if given.
 func reserveCrew(w http.ResponseWriter, r *http.Request) {
 	requestsReceived.WithLabelValues(r.Method).Inc()
 	slog.Info("Received request to reserve a crew member")
+
+	var hazards []string
+	if val := r.URL.Query().Get("hazard"); val != "" {
+		hazards = strings.Split(val, ",")
+	}
+	qualified := 0
+	for i := range crew {
+		// Qualifications never change, so no need to lock.
+		if crew[i].qualifiedFor(hazards) {
+			qualified++
+		}
+	}
+	if qualified == 0 {
+		slog.Warn("No crew member is qualified for the cargo", "hazards", hazards)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusUnprocessableEntity)).Inc()
+		http.Error(w, fmt.Sprintf("No crew member is qualified to carry %s cargo", strings.Join(hazards, " and ")),
+			http.StatusUnprocessableEntity)
+		return
+	}
+
 	found := false
+	now := clock.Now()
 	for i := range crew {
 		if crew[i].Lock.TryLock() {
-			if crew[i].Available {
+			if crew[i].Available && !crew[i].Stats.resting(now) && crew[i].qualifiedFor(hazards) {
 				found = true
-				slog.Info("Crew member is available", "name", crew[i].Name, "risk", crew[i].Risk)
+				risk := effectiveRisk(&crew[i], now)
+				slog.Info("Crew member is available", "name", crew[i].Name, "risk", risk)
 				crew[i].Available = false
 				slog.Info("Crew member has been reserved", "name", crew[i].Name)
-				json.NewEncoder(w).Encode(CrewResponse{Name: crew[i].Name, Risk: crew[i].Risk})
+				json.NewEncoder(w).Encode(CrewResponse{Name: crew[i].Name, Risk: risk})
 			}
 			// Need to unlock the mutex before we return
 			crew[i].Lock.Unlock()
@@ -72,6 +150,13 @@ func reserveCrew(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if len(hazards) > 0 {
+		slog.Warn("No qualified crew is available", "hazards", hazards)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+		http.Error(w, fmt.Sprintf("No crew qualified to carry %s cargo available", strings.Join(hazards, " and ")),
+			http.StatusServiceUnavailable)
+		return
+	}
 	slog.Warn("No crew is available")
 	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
 	http.Error(w, "No crew available", http.StatusServiceUnavailable)
@@ -81,28 +166,74 @@ func returnCrew(w http.ResponseWriter, r *http.Request) {
 	requestsReceived.WithLabelValues(r.Method).Inc()
 	slog.Info("Received request to return a crew member")
 
-	var c CrewMember
+	var c CrewReturn
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
 		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
 		http.Error(w, "Failed to unmarshal data into crew member", http.StatusServiceUnavailable)
 		return
 	}
+	if c.Delivered < 0 || c.Failed < 0 || c.FlightSeconds < 0 {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+		http.Error(w, "Delivery counts and flight time can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	if releaseCrew(c) {
+		slog.Info("Crew member returned successfully", "name", c.Name)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
+	http.Error(w, "Crew member not found", http.StatusNotFound)
+}
+
+// releaseCrew makes the named crew member available again, recording their
+// flight if there was one. It reports false if there is no such crew member.
+func releaseCrew(ret CrewReturn) bool {
 	for i := range crew {
-		if crew[i].Name == c.Name {
+		if crew[i].Name == ret.Name {
 			crew[i].Lock.Lock()
 			crew[i].Available = true
+			if ret.FlightSeconds > 0 {
+				flown := time.Duration(ret.FlightSeconds * float64(time.Second))
+				recordFlight(&crew[i], ret.Delivered, ret.Failed, flown, clock.Now())
+			}
 			crew[i].Lock.Unlock()
+			return true
+		}
+	}
+	return false
+}
 
-			slog.Info("Crew member returned successfully", "name", c.Name)
-			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
-			w.WriteHeader(http.StatusOK)
-			return
+func listCrew(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+	slog.Debug("Received request to list crew")
+
+	list := make([]CrewStatus, 0, len(crew))
+	now := clock.Now()
+	for i := range crew {
+		crew[i].Lock.Lock()
+		c, s := &crew[i], crew[i].Stats
+		status := CrewStatus{
+			Name: c.Name, Role: c.Role, Available: c.Available,
+			Risk: effectiveRisk(c, now), BaseRisk: c.Risk, Qualifications: c.Qualifications,
+			Delivered: s.Delivered, Failed: s.Failed, HoursFlown: s.Flown.Hours(), Fatigue: s.fatigue(now),
 		}
+		if c.Available && !s.LastReturn.IsZero() {
+			status.RestingFor = now.Sub(s.LastReturn).Seconds()
+		}
+		if s.resting(now) {
+			status.RestUntil = &s.RestUntil
+		}
+		crew[i].Lock.Unlock()
+		list = append(list, status)
 	}
 
-	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
-	http.Error(w, "Crew member not found", http.StatusNotFound)
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
 }
 
 func main() {
@@ -116,15 +247,49 @@ func main() {
 	}
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
 
+	var err error
+	if clock, rng, err = sim.FromEnv(); err != nil {
+		slog.Error("Invalid simulation settings", "err", err)
+		os.Exit(1)
+	}
+
 	prometheus.MustRegister(requestsReceived)
 	prometheus.MustRegister(requestsProcessed)
+	prometheus.MustRegister(eventsConsumed)
+	prometheus.MustRegister(crewDeliveries)
+	prometheus.MustRegister(crewFlightSeconds)
+	prometheus.MustRegister(riskCollectors()...)
+
+	certs, err := tlsconfig.FromEnv()
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "err", err)
+		os.Exit(1)
+	}
+
+	broker, err := events.NewBrokerFromEnv("crew-service")
+	if err != nil {
+		slog.Error("Unable to set up event broker", "err", err)
+		os.Exit(1)
+	}
+	if _, ok := broker.(*events.MemoryBroker); ok {
+		slog.Info("No event broker configured; delivery-service will return crew over HTTP")
+	} else if err := consumeEvents(broker); err != nil {
+		slog.Error("Unable to subscribe to delivery events", "err", err)
+		os.Exit(1)
+	}
 
 	crewMux := http.NewServeMux()
+	crewMux.HandleFunc("GET /crew", listCrew)
 	crewMux.HandleFunc("/crew/reserve", reserveCrew)
 	crewMux.HandleFunc("/crew/return", returnCrew)
+	crewMux.HandleFunc("/healthz", health.Healthz)
+	crewMux.HandleFunc("/readyz", health.Ready)
 
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
+	// Probes can't present client certificates, so serve them here as well.
+	metricsMux.HandleFunc("/healthz", health.Healthz)
+	metricsMux.HandleFunc("/readyz", health.Ready)
 
 	go func() {
 		slog.Info("Prometheus metrics endpoint running", "addr", ":2112")
@@ -134,8 +299,8 @@ func main() {
 		}
 	}()
 
-	slog.Info("CrewService running", "addr", ":8080")
-	if err := http.ListenAndServe(":8080", crewMux); err != nil {
+	slog.Info("CrewService running", "addr", ":8080", "mtls", certs != nil)
+	if err := tlsconfig.ListenAndServe(":8080", crewMux, certs); err != nil {
 		slog.Error("server error", "err", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,65 @@
+// crew-service/main_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCrew replaces crew for the rest of t.
+func useCrew(t *testing.T, members []CrewMember) {
+	t.Helper()
+	prev := crew
+	crew = members
+	t.Cleanup(func() { crew = prev })
+}
+
+func TestReserveCrew(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		crew     []CrewMember
+		query    string
+		wantCode int
+		wantBody string
+	}{
+		{
+			"first free",
+			[]CrewMember{{Name: "Fry", Available: false}, {Name: "Leela", Available: true}},
+			"", http.StatusOK, `"name":"Leela"`,
+		},
+		{
+			"skips resting crew",
+			[]CrewMember{{Name: "Fry", Available: true, Stats: CrewStats{RestUntil: later}}, {Name: "Leela", Available: true}},
+			"", http.StatusOK, `"name":"Leela"`,
+		},
+		{
+			"qualified for the cargo",
+			[]CrewMember{{Name: "Fry", Available: true, Qualifications: []string{"biohazard"}}, {Name: "Bender", Available: true, Qualifications: []string{"explosive", "flammable"}}},
+			"?hazard=explosive,flammable", http.StatusOK, `"name":"Bender"`,
+		},
+		{
+			"qualified crew busy",
+			[]CrewMember{{Name: "Fry", Available: true}, {Name: "Bender", Available: false, Qualifications: []string{"explosive"}}},
+			"?hazard=explosive", http.StatusServiceUnavailable, "",
+		},
+		{
+			"nobody qualified",
+			[]CrewMember{{Name: "Fry", Available: true, Qualifications: []string{"biohazard"}}},
+			"?hazard=exotic", http.StatusUnprocessableEntity, "qualified to carry exotic cargo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCrew(t, tt.crew)
+			w := httptest.NewRecorder()
+			reserveCrew(w, httptest.NewRequest(http.MethodGet, "/crew/reserve"+tt.query, nil))
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("reserve%s = %d %q, want %d containing %q", tt.query, w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+// delivery-service/batch.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+)
+
+// batches groups delivery requests onto flights. It is set up in main.
+var batches *batcher
+
+// batcher puts deliveries headed the same way on one flight. A batch opens
+// with the first request and flies once it is full or its window closes.
+// Later requests join it if their address is within radius light-years of
+// the batch's first one, their cargo has the same hazard class and it still
+// fits under the batch's weight and volume limits. A request too big for
+// those limits gets a flight of its own.
+type batcher struct {
+	window    time.Duration // 0 sends every request on a flight of its own straight away
+	capacity  int           // packages
+	maxWeight float64       // kg
+	maxVolume float64       // m³
+	radius    float64
+
+	mu   sync.Mutex
+	open []*batch
+}
+
+type batch struct {
+	near           float64 // distance from HQ of the first address
+	hazard         string
+	weight, volume float64
+	items          []batchItem
+	timer          *time.Timer
+}
+
+// fits reports whether req can join bt without going over b's limits.
+func (b *batcher) fits(bt *batch, req DeliveryRequest) bool {
+	return len(bt.items) < b.capacity && bt.hazard == req.Hazard &&
+		bt.weight+req.WeightKG <= b.maxWeight && bt.volume+req.VolumeM3 <= b.maxVolume &&
+		math.Abs(bt.near-calcDistance(req.Address)) <= b.radius
+}
+
+// batchItem is a delivery request waiting for its flight, with its package
+// already created as pending. Its result is sent on once the flight has
+// left, or the request can't go.
+type batchItem struct {
+	req    DeliveryRequest
+	pkg    Package
+	result chan dispatchResult
+}
+
+type dispatchResult struct {
+	ticket DeliveryTicket
+	code   int
+	err    error
+}
+
+// maxBatchWindow keeps the wait for a batch well inside the api gateway's
+// 10s route timeout, which also has to cover reserving crew and a ship.
+// Requests are answered once their flight leaves, so a longer window would
+// time out at the gateway even though the package flies.
+const maxBatchWindow = 5 * time.Second
+
+// newBatcherFromEnv reads BATCH_WINDOW (default 0, no batching, at most
+// maxBatchWindow), BATCH_CAPACITY (packages per flight, default 4), BATCH_MAX_WEIGHT and
+// BATCH_MAX_VOLUME (default 200 kg and 2 m³, the smallest ship's hold) and
+// BATCH_RADIUS (default 10 light-years).
+func newBatcherFromEnv() *batcher {
+	b := &batcher{capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}
+	if val, err := time.ParseDuration(os.Getenv("BATCH_WINDOW")); err == nil && val > 0 {
+		b.window = val
+	}
+	if b.window > maxBatchWindow {
+		slog.Warn("BATCH_WINDOW is longer than requests can wait, capping it", "batch_window", b.window, "max", maxBatchWindow)
+		b.window = maxBatchWindow
+	}
+	if val, err := strconv.Atoi(os.Getenv("BATCH_CAPACITY")); err == nil && val > 0 {
+		b.capacity = val
+	}
+	if val, err := strconv.ParseFloat(os.Getenv("BATCH_MAX_WEIGHT"), 64); err == nil && val > 0 {
+		b.maxWeight = val
+	}
+	if val, err := strconv.ParseFloat(os.Getenv("BATCH_MAX_VOLUME"), 64); err == nil && val > 0 {
+		b.maxVolume = val
+	}
+	if val, err := strconv.ParseFloat(os.Getenv("BATCH_RADIUS"), 64); err == nil && val >= 0 {
+		b.radius = val
+	}
+	return b
+}
+
+// submit creates req's package, to be charged charge, puts it on a flight
+// and waits for the flight to leave. The package can be cancelled while it
+// waits. Express deliveries get a flight of their own straight away.
+func (b *batcher) submit(req DeliveryRequest, charge float64, caller string) dispatchResult {
+	slog.Info("Dispatching request to create new package")
+	pkg, statusCode, err := createPackage(Package{
+		Recipient: req.Recipient,
+		Address:   req.Address,
+		Contents:  req.Contents,
+		WeightKG:  req.WeightKG,
+		VolumeM3:  req.VolumeM3,
+		Hazard:    req.Hazard,
+		Priority:  req.Priority,
+		QuoteID:   req.QuoteID,
+		Charge:    charge,
+	}, caller)
+	if err != nil {
+		return dispatchResult{code: statusCode, err: err}
+	}
+
+	item := batchItem{req: req, pkg: pkg, result: make(chan dispatchResult, 1)}
+	if b.window == 0 || b.capacity == 1 || req.Priority == priorityExpress {
+		dispatch([]batchItem{item})
+		return <-item.result
+	}
+
+	b.mu.Lock()
+	var bt *batch
+	for _, open := range b.open {
+		if b.fits(open, req) {
+			bt = open
+			break
+		}
+	}
+	if bt == nil {
+		bt = &batch{near: calcDistance(req.Address), hazard: req.Hazard}
+		bt.timer = time.AfterFunc(b.window, func() { b.close(bt) })
+		b.open = append(b.open, bt)
+	}
+	bt.items = append(bt.items, item)
+	bt.weight += req.WeightKG
+	bt.volume += req.VolumeM3
+	full := len(bt.items) >= b.capacity || bt.weight >= b.maxWeight || bt.volume >= b.maxVolume
+	b.mu.Unlock()
+
+	if full {
+		b.close(bt)
+	}
+	return <-item.result
+}
+
+// queued lists the packages waiting in open batches.
+func (b *batcher) queued() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for _, bt := range b.open {
+		for _, it := range bt.items {
+			ids = append(ids, it.pkg.ID)
+		}
+	}
+	return ids
+}
+
+// cancel takes the package with id out of the batch it is waiting in and
+// cancels it. It reports false if the package isn't waiting in a batch.
+func (b *batcher) cancel(id string) bool {
+	b.mu.Lock()
+	var item batchItem
+	found := false
+	for i, bt := range b.open {
+		j := slices.IndexFunc(bt.items, func(it batchItem) bool { return it.pkg.ID == id })
+		if j < 0 {
+			continue
+		}
+		item, found = bt.items[j], true
+		bt.items = slices.Delete(bt.items, j, j+1)
+		bt.weight -= item.req.WeightKG
+		bt.volume -= item.req.VolumeM3
+		if len(bt.items) == 0 {
+			bt.timer.Stop()
+			b.open = slices.Delete(b.open, i, i+1)
+		}
+		break
+	}
+	b.mu.Unlock()
+	if !found {
+		return false
+	}
+
+	slog.Info("Delivery cancelled before its flight left", "package_id", id)
+	settle(events.Event{Type: events.Cancelled, PackageID: id}, "cancelled")
+	item.result <- dispatchResult{code: http.StatusConflict, err: errors.New("Delivery was cancelled before its flight left")}
+	return true
+}
+
+// settle records ev, which settles a package that hasn't been dispatched.
+// If the outbox can't take it, nothing downstream will hear about the
+// package, so it is set to status directly.
+func settle(ev events.Event, status string) {
+	err := outbox.add(ev)
+	if err == nil {
+		return
+	}
+	slog.Error("Failed to record event", "type", ev.Type, "package_id", ev.PackageID, "err", err)
+	if _, err := updatePackageStatus(PackageStatusUpdate{ID: ev.PackageID, Status: status, Incident: ev.Incident}); err != nil {
+		slog.Error("Failed to update package status", "package_id", ev.PackageID, "status", status, "err", err)
+	}
+}
+
+// close stops bt taking requests and dispatches it, unless that has already
+// happened.
+func (b *batcher) close(bt *batch) {
+	b.mu.Lock()
+	i := slices.Index(b.open, bt)
+	if i < 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.open = slices.Delete(b.open, i, i+1)
+	bt.timer.Stop()
+	b.mu.Unlock()
+	dispatch(bt.items)
+}
+
+// dispatch reserves a crew member qualified for the cargo, and a ship with
+// the range to reach every address and come back and the hold to carry it
+// all, and sends the flight off. Each request hears back once its package
+// is in the air, or why it isn't; packages that can't go fail.
+func dispatch(items []batchItem) {
+	fail := func(items []batchItem, code int, err error) {
+		for _, it := range items {
+			settle(events.Event{Type: events.Failed, PackageID: it.pkg.ID, Reason: err.Error(), Incident: dispatchIncident(err)}, "failed")
+			it.result <- dispatchResult{code: code, err: err}
+		}
+	}
+	addresses := make([]string, 0, len(items))
+	var hazards []string
+	var weight, volume float64
+	for _, it := range items {
+		addresses = append(addresses, it.req.Address)
+		if it.req.Hazard != "" && !slices.Contains(hazards, it.req.Hazard) {
+			hazards = append(hazards, it.req.Hazard)
+		}
+		weight += it.req.WeightKG
+		volume += it.req.VolumeM3
+	}
+
+	slog.Info("Dispatching request for available crew", "packages", len(items), "hazards", hazards)
+	crew, statusCode, err := requestAvailableCrew(hazards)
+	if err != nil {
+		fail(items, statusCode, err)
+		return
+	}
+	slog.Debug("Got crew member", "name", crew.Name)
+
+	slog.Info("Dispatching request to reserve ship")
+	ship, statusCode, err := reserveShip(routeDistance(addresses), weight, volume)
+	if err != nil {
+		// Most likely no ship has the range or the hold; don't keep the
+		// crew waiting.
+		if err := returnCrew(CrewReturn{Name: crew.Name}); err != nil {
+			slog.Error("Failed to return crew member to base", "name", crew.Name, "err", err)
+		}
+		fail(items, statusCode, err)
+		return
+	}
+
+	slog.Info("Got both crew member and ship")
+	if (crew == CrewMember{}) || (ship == ShipInfo{}) {
+		// Release whichever of the two did come back.
+		if crew.Name != "" {
+			if err := returnCrew(CrewReturn{Name: crew.Name}); err != nil {
+				slog.Error("Failed to return crew member to base", "name", crew.Name, "err", err)
+			}
+		}
+		if ship.Name != "" {
+			if err := returnShip(ShipReturn{Name: ship.Name}); err != nil {
+				slog.Error("Failed to return ship", "name", ship.Name, "err", err)
+			}
+		}
+		fail(items, http.StatusServiceUnavailable, errors.New("Unable to get ship or crew"))
+		return
+	}
+
+	// Announce the flight before the ship leaves. Package-service records
+	// who is carrying each package and when it should arrive, barring
+	// anything happening on the way.
+	flightID := "FL-" + rand.Text()[:12]
+	now := clock.Now()
+	arrivals := schedule(addresses, ship)
+
+	f := Flight{ID: flightID, Crew: crew.Name, Ship: ship.Name, DispatchedAt: now}
+	var tickets []dispatchResult
+	var results []chan dispatchResult
+	for i, it := range items {
+		pkg := it.pkg
+		eta := now.Add(arrivals[i])
+		err := outbox.add(events.Event{Type: events.Dispatched, PackageID: pkg.ID, FlightID: flightID, Crew: crew.Name, Ship: ship.Name, ETA: &eta})
+		if err != nil {
+			slog.Error("Failed to record dispatch event", "package_id", pkg.ID, "err", err)
+			// Nothing downstream will hear about this package, so undo it
+			// directly.
+			update := PackageStatusUpdate{ID: pkg.ID, Status: "failed", Incident: dispatchIncident(errors.New("Unable to dispatch delivery"))}
+			if _, err := updatePackageStatus(update); err != nil {
+				slog.Error("Failed to update package status to failed", "package_id", pkg.ID, "err", err)
+			}
+			it.result <- dispatchResult{code: http.StatusServiceUnavailable, err: errors.New("Unable to dispatch delivery")}
+			continue
+		}
+		pkg.Status, pkg.Crew, pkg.Ship, pkg.FlightID = "in-transit", crew.Name, ship.Name, flightID
+		pkg.DispatchedAt, pkg.ETA = &now, &eta
+		f.PackageIDs = append(f.PackageIDs, pkg.ID)
+		f.packages = append(f.packages, pkg)
+		tickets = append(tickets, dispatchResult{ticket: DeliveryTicket{Crew: crew, Ship: ship, Package: pkg}, code: http.StatusOK})
+		results = append(results, it.result)
+	}
+	if len(f.PackageIDs) == 0 {
+		if err := returnCrew(CrewReturn{Name: crew.Name}); err != nil {
+			slog.Error("Failed to return crew member to base", "name", crew.Name, "err", err)
+		}
+		if err := returnShip(ShipReturn{Name: ship.Name}); err != nil {
+			slog.Error("Failed to return ship", "name", ship.Name, "err", err)
+		}
+		return
+	}
+
+	addresses = addresses[:0]
+	classes := make([]string, 0, len(tickets))
+	for _, t := range tickets {
+		addresses = append(addresses, t.ticket.Package.Address)
+		classes = append(classes, t.ticket.Package.Hazard)
+	}
+	plan := planFlight(rng, addresses, classes, crew, ship)
+	f.Legs = plan.Legs
+	ctx, recall := context.WithCancel(context.Background())
+	flights.add(f, plan, recall)
+	slog.Info("Flight dispatched", "flight_id", f.ID, "packages", len(f.PackageIDs), "crew", crew.Name, "ship", ship.Name)
+	go func() {
+		defer recall()
+		fly(ctx, f, plan, crew, ship)
+	}()
+
+	for i, t := range tickets {
+		results[i] <- t
+	}
+}
@@ -0,0 +1,162 @@
+// delivery-service/batch_test.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useServices points the service URLs at a fake crew-, ship- and
+// package-service for the rest of t, with a crew member free unless noCrew
+// and a ship fast enough that flights land almost at once. It waits for
+// every flight to land before t finishes.
+func useServices(t *testing.T, noCrew bool) {
+	t.Helper()
+	var mu sync.Mutex
+	created := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/crew/reserve":
+			if noCrew {
+				http.Error(w, "No crew available", http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(CrewMember{Name: "Leela"})
+		case "/ship/reserve":
+			json.NewEncoder(w).Encode(ShipInfo{Name: "Nimbus", Speed: 1e6})
+		case "/packages":
+			var pkg Package
+			json.NewDecoder(r.Body).Decode(&pkg)
+			mu.Lock()
+			created++
+			pkg.ID = fmt.Sprintf("P%d", created)
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(pkg)
+		case "/crew/return", "/ship/return":
+		case "/packages/update":
+			var update PackageStatusUpdate
+			json.NewDecoder(r.Body).Decode(&update)
+			json.NewEncoder(w).Encode(Package{ID: update.ID, Status: update.Status})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	prevCrew, prevShip, prevPackage := crewServiceURL, shipServiceURL, packageServiceURL
+	prevOutbox, prevFlights := outbox, flights
+	crewServiceURL, shipServiceURL, packageServiceURL = srv.URL, srv.URL, srv.URL
+	outbox, flights = newTestOutbox("", nil), &flightRegistry{flights: make(map[string]Flight)}
+	t.Cleanup(func() {
+		for len(flights.list()) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		srv.Close()
+		crewServiceURL, shipServiceURL, packageServiceURL = prevCrew, prevShip, prevPackage
+		outbox, flights = prevOutbox, prevFlights
+	})
+}
+
+func TestNewBatcherFromEnv(t *testing.T) {
+	tests := []struct {
+		name                                  string
+		window, capacity, weight, volume, rad string
+		want                                  *batcher
+	}{
+		{"defaults", "", "", "", "", "", &batcher{capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}},
+		{"set", "2s", "8", "800", "8", "0", &batcher{window: 2 * time.Second, capacity: 8, maxWeight: 800, maxVolume: 8, radius: 0}},
+		{"window capped", "1m", "", "", "", "", &batcher{window: maxBatchWindow, capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}},
+		{"invalid", "soon", "0", "-1", "0", "-1", &batcher{capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BATCH_WINDOW", tt.window)
+			t.Setenv("BATCH_CAPACITY", tt.capacity)
+			t.Setenv("BATCH_MAX_WEIGHT", tt.weight)
+			t.Setenv("BATCH_MAX_VOLUME", tt.volume)
+			t.Setenv("BATCH_RADIUS", tt.rad)
+			b := newBatcherFromEnv()
+			if b.window != tt.want.window || b.capacity != tt.want.capacity || b.maxWeight != tt.want.maxWeight ||
+				b.maxVolume != tt.want.maxVolume || b.radius != tt.want.radius {
+				t.Errorf("got window %s, capacity %d, max %v kg %v m³, radius %v, want %s, %d, %v kg %v m³, %v",
+					b.window, b.capacity, b.maxWeight, b.maxVolume, b.radius,
+					tt.want.window, tt.want.capacity, tt.want.maxWeight, tt.want.maxVolume, tt.want.radius)
+			}
+		})
+	}
+}
+
+func TestBatcherSubmit(t *testing.T) {
+	parcel := func(address string) DeliveryRequest {
+		return DeliveryRequest{Recipient: "Hermes", Address: address, Contents: "Paperwork", WeightKG: 1, VolumeM3: 0.01}
+	}
+	marsVegas, neptune := parcel("Mars Vegas"), parcel("Neptune")
+	explosives := parcel("Mars Vegas")
+	explosives.Contents, explosives.Hazard = "Explosives", "explosive"
+	crate := parcel("Mars Vegas")
+	crate.WeightKG = 150
+	tests := []struct {
+		name     string
+		batcher  *batcher
+		reqs     []DeliveryRequest
+		noCrew   bool
+		want     []int // packages on each flight, smallest first
+		wantCode int
+	}{
+		{"no batching", &batcher{capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}, []DeliveryRequest{marsVegas, marsVegas, marsVegas}, false, []int{1, 1, 1}, http.StatusOK},
+		{"window closes", &batcher{window: 50 * time.Millisecond, capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}, []DeliveryRequest{marsVegas, marsVegas, marsVegas}, false, []int{3}, http.StatusOK},
+		{"full flights leave early", &batcher{window: time.Hour, capacity: 2, maxWeight: 200, maxVolume: 2, radius: 10}, []DeliveryRequest{marsVegas, marsVegas, marsVegas, marsVegas}, false, []int{2, 2}, http.StatusOK},
+		{"too far apart", &batcher{window: 50 * time.Millisecond, capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}, []DeliveryRequest{marsVegas, neptune, marsVegas}, false, []int{1, 2}, http.StatusOK},
+		{"hazards fly alone", &batcher{window: 50 * time.Millisecond, capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}, []DeliveryRequest{marsVegas, explosives, marsVegas}, false, []int{1, 2}, http.StatusOK},
+		{"too heavy to share", &batcher{window: 50 * time.Millisecond, capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}, []DeliveryRequest{crate, crate}, false, []int{1, 1}, http.StatusOK},
+		{"no crew", &batcher{window: 50 * time.Millisecond, capacity: 4, maxWeight: 200, maxVolume: 2, radius: 10}, []DeliveryRequest{marsVegas, marsVegas}, true, nil, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServices(t, tt.noCrew)
+			b := tt.batcher
+
+			results := make([]dispatchResult, len(tt.reqs))
+			var wg sync.WaitGroup
+			for i, req := range tt.reqs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					results[i] = b.submit(req, 0, "hermes")
+				}()
+			}
+			wg.Wait()
+
+			perFlight := make(map[string]int)
+			for i, res := range results {
+				if res.code != tt.wantCode {
+					t.Fatalf("request %d: code %d (%v), want %d", i, res.code, res.err, tt.wantCode)
+				}
+				if res.err != nil {
+					continue
+				}
+				pkg := res.ticket.Package
+				if pkg.Address != tt.reqs[i].Address || pkg.Status != "in-transit" || pkg.ETA == nil {
+					t.Errorf("request %d: got package %+v", i, pkg)
+				}
+				perFlight[pkg.FlightID]++
+			}
+			got := slices.Sorted(func(yield func(int) bool) {
+				for _, n := range perFlight {
+					if !yield(n) {
+						return
+					}
+				}
+			})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("packages per flight = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
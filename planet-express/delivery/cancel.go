@@ -0,0 +1,107 @@
+// delivery-service/cancel.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// CancelResult is the response to POST /deliveries/{id}/cancel. Status is
+// "cancelled" for a package that never left, or "recalled" for one on its
+// way back to HQ; package-service marks it returned once the ship lands.
+type CancelResult struct {
+	PackageID string `json:"package_id"`
+	Status    string `json:"status"`
+	FlightID  string `json:"flight_id,omitempty"`
+}
+
+// getPackage looks a package up in package-service.
+func getPackage(id string) (Package, int, error) {
+	resp, err := httpClient.Get(fmt.Sprintf("%s/packages/get?id=%s", packageServiceURL, url.QueryEscape(id)))
+	if err != nil {
+		return Package{}, http.StatusServiceUnavailable, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Package{}, resp.StatusCode, fmt.Errorf("error reading response body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Package{}, resp.StatusCode, fmt.Errorf("package lookup failed: %s", bodyBytes)
+	}
+
+	var pkg Package
+	if err := json.Unmarshal(bodyBytes, &pkg); err != nil {
+		return Package{}, http.StatusInternalServerError, err
+	}
+	return pkg, http.StatusOK, nil
+}
+
+// handleCancel serves POST /deliveries/{id}/cancel. A package still waiting
+// for its flight is cancelled. One in the air is recalled: it is skipped on
+// the way, and once nothing left on board is still to be dropped off the
+// ship turns straight back to HQ, where crew and ship are returned as
+// usual. Customers can only cancel their own packages.
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+	fail := func(code int, msg string) {
+		http.Error(w, msg, code)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(code)).Inc()
+	}
+
+	id := r.PathValue("id")
+	caller := r.Header.Get(callerHeader)
+	slog.Info("Got request to cancel delivery", "package_id", id, "caller", caller)
+
+	pkg, code, err := getPackage(id)
+	switch {
+	case code == http.StatusNotFound:
+		fail(http.StatusNotFound, "Package not found")
+		return
+	case err != nil:
+		slog.Error("Failed to look up package", "package_id", id, "err", err)
+		fail(code, err.Error())
+		return
+	case r.Header.Get(roleHeader) == "customer" && pkg.CreatedBy != caller:
+		fail(http.StatusForbidden, "Customers can only cancel their own deliveries")
+		return
+	}
+	switch pkg.Status {
+	case "delivered", "failed", "returned", "cancelled":
+		fail(http.StatusConflict, fmt.Sprintf("Package is already %s", pkg.Status))
+		return
+	}
+
+	result := CancelResult{PackageID: id, Status: "cancelled"}
+	code = http.StatusOK
+	if !batches.cancel(id) {
+		f, found, err := flights.recall(id)
+		switch {
+		case errors.Is(err, errDropped):
+			fail(http.StatusConflict, err.Error())
+			return
+		case !found && pkg.Status == "pending":
+			// Its flight is being put together right now.
+			fail(http.StatusConflict, "Package is being dispatched; try again shortly")
+			return
+		case !found:
+			fail(http.StatusConflict, "Package's flight isn't run by this delivery-service")
+			return
+		}
+		slog.Info("Package recalled", "package_id", id, "flight_id", f.ID, "flight_recalled", len(f.Recalled))
+		result.Status, result.FlightID = "recalled", f.ID
+		code = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(result)
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(code)).Inc()
+}
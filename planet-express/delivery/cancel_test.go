@@ -0,0 +1,99 @@
+// delivery-service/cancel_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+)
+
+func TestHandleCancel(t *testing.T) {
+	pkgs := map[string]Package{
+		"P1": {ID: "P1", Status: "pending", CreatedBy: "hermes"},   // waiting in a batch
+		"P2": {ID: "P2", Status: "in-transit", CreatedBy: "amy"},   // aboard FL-1, for Mars Vegas
+		"P3": {ID: "P3", Status: "in-transit", CreatedBy: "amy"},   // aboard FL-1, for Neptune
+		"P4": {ID: "P4", Status: "pending", CreatedBy: "hermes"},   // being dispatched
+		"P5": {ID: "P5", Status: "in-transit", CreatedBy: "amy"},   // on another replica's flight
+		"P6": {ID: "P6", Status: "delivered", CreatedBy: "hermes"}, // already settled
+	}
+	tests := []struct {
+		name       string
+		id         string
+		role       string
+		dropped    bool // FL-1 has already reached Mars Vegas
+		wantCode   int
+		wantStatus string // of the CancelResult, or part of the error
+	}{
+		{"waiting for its flight", "P1", "dispatcher", false, http.StatusOK, "cancelled"},
+		{"own package", "P1", "customer", false, http.StatusOK, "cancelled"},
+		{"someone else's package", "P2", "customer", false, http.StatusForbidden, "their own"},
+		{"in the air", "P2", "dispatcher", false, http.StatusAccepted, "recalled"},
+		{"already dropped off", "P2", "dispatcher", true, http.StatusConflict, "Too late"},
+		{"later drop still recallable", "P3", "dispatcher", true, http.StatusAccepted, "recalled"},
+		{"being dispatched", "P4", "dispatcher", false, http.StatusConflict, "try again"},
+		{"another replica's flight", "P5", "dispatcher", false, http.StatusConflict, "isn't run by this"},
+		{"already settled", "P6", "dispatcher", false, http.StatusConflict, "already delivered"},
+		{"unknown package", "P9", "dispatcher", false, http.StatusNotFound, "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pkg, ok := pkgs[r.URL.Query().Get("id")]
+				if r.URL.Path != "/packages/get" || !ok {
+					http.NotFound(w, r)
+					return
+				}
+				json.NewEncoder(w).Encode(pkg)
+			}))
+			defer srv.Close()
+
+			prevPackage, prevOutbox, prevFlights, prevBatches := packageServiceURL, outbox, flights, batches
+			packageServiceURL, outbox = srv.URL, newTestOutbox("", nil)
+			flights, batches = &flightRegistry{flights: make(map[string]Flight)}, &batcher{}
+			t.Cleanup(func() {
+				packageServiceURL, outbox, flights, batches = prevPackage, prevOutbox, prevFlights, prevBatches
+			})
+
+			queued := batchItem{pkg: pkgs["P1"], result: make(chan dispatchResult, 1)}
+			batches.open = []*batch{{items: []batchItem{queued}, timer: time.AfterFunc(time.Hour, func() {})}}
+			f, plan := testFlight()
+			f.PackageIDs = []string{"P2", "P3"}
+			flights.add(f, plan, func() {})
+			if tt.dropped {
+				flights.drop(f.ID, 0)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/deliveries/"+tt.id+"/cancel", nil)
+			req.SetPathValue("id", tt.id)
+			req.Header.Set(callerHeader, "hermes")
+			req.Header.Set(roleHeader, tt.role)
+			w := httptest.NewRecorder()
+			handleCancel(w, req)
+
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantStatus) {
+				t.Fatalf("cancel %s = %d %q, want %d containing %q", tt.id, w.Code, w.Body.String(), tt.wantCode, tt.wantStatus)
+			}
+			switch tt.wantStatus {
+			case "cancelled":
+				if res := <-queued.result; res.code != http.StatusConflict {
+					t.Errorf("waiting request got %d, want %d", res.code, http.StatusConflict)
+				}
+				if evs := outbox.pending(); len(evs) != 1 || evs[0].Type != events.Cancelled || evs[0].PackageID != tt.id {
+					t.Errorf("outbox = %+v, want a single %s for %s", evs, events.Cancelled, tt.id)
+				}
+				if len(batches.queued()) != 0 {
+					t.Errorf("still queued: %v", batches.queued())
+				}
+			case "recalled":
+				if got := flights.recalledPackages(f.ID); len(got) != 1 || got[0] != tt.id {
+					t.Errorf("recalled = %v, want [%s]", got, tt.id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// delivery-service/cargo.go
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+const (
+	// Packages that don't say what they weigh or how much room they take
+	// are assumed to be small parcels.
+	defaultWeightKG = 1
+	defaultVolumeM3 = 0.01
+)
+
+var (
+	// hazardMultipliers scale the risk of a delivery carrying each hazard
+	// class. Only crew qualified for a class may carry it.
+	hazardMultipliers = map[string]float64{
+		"flammable": 1.5,
+		"biohazard": 1.5,
+		"explosive": 2,
+		"exotic":    2.5,
+	}
+
+	// hazardousContents are the contents known to need a hazard class.
+	hazardousContents = map[string]string{
+		"Explosives":  "explosive",
+		"Dark matter": "exotic",
+		"Robot oil":   "flammable",
+		"Mutant fish": "biohazard",
+	}
+)
+
+// validateCargo fills in req's defaults and hazard class, and explains what
+// is wrong with it if it can't be shipped as declared.
+func validateCargo(req *DeliveryRequest) error {
+	switch {
+	case req.WeightKG < 0:
+		return fmt.Errorf("weight_kg must not be negative, got %g", req.WeightKG)
+	case req.VolumeM3 < 0:
+		return fmt.Errorf("volume_m3 must not be negative, got %g", req.VolumeM3)
+	}
+	if req.WeightKG == 0 {
+		req.WeightKG = defaultWeightKG
+	}
+	if req.VolumeM3 == 0 {
+		req.VolumeM3 = defaultVolumeM3
+	}
+
+	req.Hazard = strings.ToLower(req.Hazard)
+	if req.Hazard == "none" {
+		req.Hazard = ""
+	}
+	if _, ok := hazardMultipliers[req.Hazard]; req.Hazard != "" && !ok {
+		return fmt.Errorf("Unknown hazard_class %q; use one of %s, or leave it out",
+			req.Hazard, strings.Join(slices.Sorted(maps.Keys(hazardMultipliers)), ", "))
+	}
+	for contents, class := range hazardousContents {
+		if !strings.EqualFold(req.Contents, contents) {
+			continue
+		}
+		if req.Hazard != "" && req.Hazard != class {
+			return fmt.Errorf("%s must be shipped as hazard_class %q, not %q", contents, class, req.Hazard)
+		}
+		req.Hazard = class
+	}
+	return nil
+}
+
+// hazardMultiplier is how much riskier carrying hazard makes a delivery.
+func hazardMultiplier(hazard string) float64 {
+	if m, ok := hazardMultipliers[hazard]; ok {
+		return m
+	}
+	return 1
+}
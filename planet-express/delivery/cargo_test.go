@@ -0,0 +1,81 @@
+// delivery-service/cargo_test.go
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCargo(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     DeliveryRequest
+		want    DeliveryRequest
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			req:  DeliveryRequest{Contents: "Slurm"},
+			want: DeliveryRequest{Contents: "Slurm", WeightKG: defaultWeightKG, VolumeM3: defaultVolumeM3},
+		},
+		{
+			name: "declared as given",
+			req:  DeliveryRequest{Contents: "Slurm", WeightKG: 12, VolumeM3: 0.5, Hazard: "Flammable"},
+			want: DeliveryRequest{Contents: "Slurm", WeightKG: 12, VolumeM3: 0.5, Hazard: "flammable"},
+		},
+		{
+			name: "none means no hazard",
+			req:  DeliveryRequest{Contents: "Slurm", WeightKG: 1, VolumeM3: 1, Hazard: "NONE"},
+			want: DeliveryRequest{Contents: "Slurm", WeightKG: 1, VolumeM3: 1},
+		},
+		{
+			name: "hazard worked out from contents",
+			req:  DeliveryRequest{Contents: "dark matter", WeightKG: 1, VolumeM3: 1},
+			want: DeliveryRequest{Contents: "dark matter", WeightKG: 1, VolumeM3: 1, Hazard: "exotic"},
+		},
+		{
+			name: "hazard matching contents",
+			req:  DeliveryRequest{Contents: "Explosives", WeightKG: 1, VolumeM3: 1, Hazard: "explosive"},
+			want: DeliveryRequest{Contents: "Explosives", WeightKG: 1, VolumeM3: 1, Hazard: "explosive"},
+		},
+		{name: "negative weight", req: DeliveryRequest{WeightKG: -1}, wantErr: "weight_kg"},
+		{name: "negative volume", req: DeliveryRequest{VolumeM3: -0.1}, wantErr: "volume_m3"},
+		{name: "unknown hazard", req: DeliveryRequest{Hazard: "radioactive"}, wantErr: "Unknown hazard_class"},
+		{name: "hazard contradicting contents", req: DeliveryRequest{Contents: "Mutant fish", Hazard: "explosive"}, wantErr: `"biohazard", not "explosive"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			err := validateCargo(&req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateCargo() error = %v, want it to mention %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateCargo() error = %v", err)
+			}
+			if req != tt.want {
+				t.Errorf("validateCargo() = %+v, want %+v", req, tt.want)
+			}
+		})
+	}
+}
+
+func TestHazardMultiplier(t *testing.T) {
+	tests := []struct {
+		hazard string
+		want   float64
+	}{
+		{"", 1},
+		{"flammable", 1.5},
+		{"exotic", 2.5},
+		{"radioactive", 1},
+	}
+	for _, tt := range tests {
+		if got := hazardMultiplier(tt.hazard); got != tt.want {
+			t.Errorf("hazardMultiplier(%q) = %v, want %v", tt.hazard, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// delivery-service/events.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// broker carries delivery events to package, crew and ship services.
+	// Events reach it through the outbox.
+	broker events.Broker
+	outbox *eventOutbox
+
+	eventsPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_delivery_events_published_total",
+			Help: "The total number of delivery events published, by type and result (ok, error)",
+		},
+		[]string{"type", "result"},
+	)
+)
+
+// bridgeConsumer is the consumer name bridgeEvents subscribes under.
+const bridgeConsumer = "http-bridge"
+
+// eventConsumers returns the consumers every event must reach: the bridge
+// for the in-process broker, otherwise those named in EVENT_CONSUMERS
+// (comma-separated), package, crew and ship services by default.
+func eventConsumers(b events.Broker) []string {
+	if _, ok := b.(*events.MemoryBroker); ok {
+		return []string{bridgeConsumer}
+	}
+	var consumers []string
+	for _, c := range strings.Split(os.Getenv("EVENT_CONSUMERS"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			consumers = append(consumers, c)
+		}
+	}
+	if len(consumers) == 0 {
+		return []string{"package-service", "crew-service", "ship-service"}
+	}
+	return consumers
+}
+
+// publishEvent hands ev to the broker for each of consumers and returns
+// those that acknowledged it. It is the outbox's delivery function.
+func publishEvent(ev events.Event, consumers []string) ([]string, error) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	acked, err := broker.Publish(events.DeliveriesSubject, data, consumers)
+	if err != nil {
+		eventsPublished.WithLabelValues(ev.Type, "error").Inc()
+		return acked, err
+	}
+	eventsPublished.WithLabelValues(ev.Type, "ok").Inc()
+	slog.Debug("Published event", "type", ev.Type, "id", ev.ID, "package_id", ev.PackageID, "consumers", consumers)
+	return acked, nil
+}
+
+// bridgeEvents applies delivery events to package, crew and ship services
+// over HTTP. It stands in for those services' own consumers when the
+// in-process broker is used, since they can't subscribe to it.
+//
+// A failed step fails the publish, so the outbox retries the event. Steps
+// that already succeeded are skipped on retry, since returning a crew member
+// twice could free them from a later delivery. That is only remembered until
+// the process restarts.
+func bridgeEvents(b events.Broker) error {
+	done := events.NewDeduper(time.Hour)
+	step := func(ev events.Event, name string, apply func() error) error {
+		key := ev.ID + "/" + name
+		if !done.FirstTime(key) {
+			return nil
+		}
+		if err := apply(); err != nil {
+			done.Forget(key)
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+
+	return b.Subscribe(events.DeliveriesSubject, bridgeConsumer, func(data []byte) error {
+		var ev events.Event
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return fmt.Errorf("invalid delivery event: %w", err)
+		}
+
+		switch ev.Type {
+		case events.Dispatched:
+			return step(ev, "package", func() error {
+				_, err := updatePackageStatus(PackageStatusUpdate{
+					ID:       ev.PackageID,
+					Status:   "in-transit",
+					Crew:     ev.Crew,
+					Ship:     ev.Ship,
+					FlightID: ev.FlightID,
+					ETA:      ev.ETA,
+				})
+				return err
+			})
+		case events.Completed, events.Failed, events.Cancelled, events.Recalled:
+			status := map[string]string{
+				events.Completed: "delivered",
+				events.Failed:    "failed",
+				events.Cancelled: "cancelled",
+				events.Recalled:  "returned",
+			}[ev.Type]
+			return step(ev, "package", func() error {
+				_, err := updatePackageStatus(PackageStatusUpdate{ID: ev.PackageID, Status: status, Proof: ev.Proof, Incident: ev.Incident})
+				return err
+			})
+		case events.Returned:
+			return errors.Join(
+				step(ev, "crew", func() error {
+					return returnCrew(CrewReturn{Name: ev.Crew, Delivered: ev.Delivered, Failed: ev.Failed, FlightSeconds: ev.FlightSeconds})
+				}),
+				step(ev, "ship", func() error { return returnShip(ShipReturn{Name: ev.Ship, Distance: ev.Distance}) }),
+			)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,241 @@
+// delivery-service/flightplan.go
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/sim"
+)
+
+const (
+	// hq is where every flight starts and ends.
+	hq = "Planet Express HQ"
+	// localHop is the distance between two stops the same distance from HQ.
+	localHop = 2
+)
+
+var (
+	// waypoints ships stop at on the way to far-off destinations, in order.
+	waypoints = map[string][]string{
+		"Doop Headquarters": {"Luna Park"},
+		"Neptune":           {"Mars Vegas"},
+		"Robonia":           {"Mars Vegas"},
+		"Omicron Persei 8":  {"Mars Vegas", "Neptune"},
+	}
+
+	// enRouteEvents can happen on any leg, each independently with its own
+	// chance. Delays are a share of the leg's flight time; risk is added to
+	// the crew's chance of failing the delivery, so only matters on the way
+	// out.
+	enRouteEvents = []enRouteEvent{
+		{
+			Name: "space_pirates", Chance: 0.05, Delay: 0.5, Risk: 0.2,
+			Reason: "Space pirates boarded the ship en route and made off with the package.",
+		},
+		{
+			Name: "engine_trouble", Chance: 0.08, Delay: 1, Risk: 0.05,
+			Reason: "Engine trouble left the ship drifting and the package spoiled before help arrived.",
+		},
+		{
+			Name: "asteroid_field", Chance: 0.1, Delay: 0.2, Risk: 0.1,
+			Reason: "The ship took a shortcut through an asteroid field and the cargo hold was breached.",
+		},
+		{Name: "refuelling_stop", Chance: 0.15, Delay: 0.25},
+	}
+)
+
+type enRouteEvent struct {
+	Name   string
+	Chance float64
+	Delay  float64
+	Risk   float64
+	Reason string // given when the delivery fails and this event is to blame
+}
+
+// Leg is one hop of a flight, with the en-route events rolled for it.
+type Leg struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Distance float64       `json:"distance_ly"`
+	Duration time.Duration `json:"duration"`
+	Events   []string      `json:"events,omitempty"`
+}
+
+// Drop is one package's delivery on a flight. Cause is "crew" or the name
+// of the en-route event to blame when it fails.
+type Drop struct {
+	Address string
+	Leg     int // index of the leg that reaches Address
+	Failed  bool
+	Reason  string
+	Cause   string
+	Events  []string // en-route events on the way to Address
+}
+
+// FlightPlan is a flight worked out in advance: every leg there and back,
+// and whether each package makes it. Real flights fly it leg by leg on the
+// clock; simulations just add it up.
+type FlightPlan struct {
+	Legs  []Leg
+	Drops []Drop // in the order the addresses were given
+}
+
+// route is the way from HQ to every address and back, by way of their
+// waypoints, visiting stops in order of distance from HQ. Legs carry no
+// events yet.
+func route(addresses []string) []Leg {
+	seen := map[string]bool{hq: true}
+	var stops []string
+	for _, address := range addresses {
+		for _, stop := range append(waypoints[address], address) {
+			if !seen[stop] {
+				seen[stop] = true
+				stops = append(stops, stop)
+			}
+		}
+	}
+	slices.SortStableFunc(stops, func(a, b string) int { return cmp.Compare(fromHQ(a), fromHQ(b)) })
+	stops = append(append([]string{hq}, stops...), hq)
+
+	legs := make([]Leg, 0, len(stops)-1)
+	for i := 1; i < len(stops); i++ {
+		from, to := stops[i-1], stops[i]
+		// Everything lies on one line out from HQ, which keeps the way out
+		// as long as a direct flight to the furthest stop. Stops the same
+		// distance out are a short hop apart.
+		distance := math.Abs(fromHQ(to) - fromHQ(from))
+		if distance == 0 {
+			distance = localHop
+		}
+		legs = append(legs, Leg{From: from, To: to, Distance: distance})
+	}
+	return legs
+}
+
+// routeDistance is how far a round trip to every address is.
+func routeDistance(addresses []string) float64 {
+	var d float64
+	for _, leg := range route(addresses) {
+		d += leg.Distance
+	}
+	return d
+}
+
+// schedule is when ship reaches each address, in order, if nothing happens
+// on the way.
+func schedule(addresses []string, ship ShipInfo) []time.Duration {
+	legs := route(addresses)
+	arrivals := make([]time.Duration, len(addresses))
+	for i, address := range addresses {
+		var d float64
+		for _, leg := range legs {
+			d += leg.Distance
+			if leg.To == address {
+				break
+			}
+		}
+		arrivals[i] = time.Duration(float64(time.Second) * d / ship.Speed)
+	}
+	return arrivals
+}
+
+// planFlight routes ship to every address and back again, rolling en-route
+// events for each leg and then each delivery's outcome. Events on the way
+// to an address add to the risk of every delivery from there on, and the
+// whole risk is scaled up for hazardous cargo. hazards gives each package's
+// hazard class, if any.
+func planFlight(r *sim.Rand, addresses, hazards []string, crew CrewMember, ship ShipInfo) FlightPlan {
+	plan := FlightPlan{Legs: route(addresses)}
+	var blame []enRouteEvent // by the end of each leg, for the way out
+	var blameAt []int
+	for i := range plan.Legs {
+		leg := &plan.Legs[i]
+		base := float64(time.Second) * leg.Distance / ship.Speed
+		leg.Duration = time.Duration(base)
+		for _, ev := range enRouteEvents {
+			if r.Float64() >= ev.Chance {
+				continue
+			}
+			leg.Events = append(leg.Events, ev.Name)
+			leg.Duration += time.Duration(base * ev.Delay)
+			if leg.To != hq {
+				blame = append(blame, ev)
+				blameAt = append(blameAt, i)
+			}
+		}
+	}
+
+	for k, address := range addresses {
+		drop := Drop{Address: address}
+		for i, leg := range plan.Legs {
+			if leg.To == address {
+				drop.Leg = i
+				break
+			}
+		}
+		for _, leg := range plan.Legs[:drop.Leg+1] {
+			drop.Events = append(drop.Events, leg.Events...)
+		}
+		risk := crew.Risk
+		var causes []enRouteEvent
+		for j, ev := range blame {
+			if blameAt[j] <= drop.Leg {
+				risk += ev.Risk
+				causes = append(causes, ev)
+			}
+		}
+		scale := 1.0
+		if k < len(hazards) {
+			scale = hazardMultiplier(hazards[k])
+		}
+		drop.Failed, drop.Reason, drop.Cause = rollOutcome(r, crew, risk, scale, causes)
+		plan.Drops = append(plan.Drops, drop)
+	}
+	return plan
+}
+
+// rollOutcome decides whether a delivery with the given total risk, scaled
+// by scale, fails, and pins the failure on whichever of crew or causes the
+// roll landed in. It returns the reason and the name of the cause.
+func rollOutcome(r *sim.Rand, crew CrewMember, risk, scale float64, causes []enRouteEvent) (bool, string, string) {
+	risk *= scale
+	roll := r.Float64() * max(risk, 1)
+	if roll >= risk {
+		return false, "", ""
+	}
+	roll -= crew.Risk * scale
+	for _, ev := range causes {
+		if roll < 0 {
+			break
+		}
+		if roll < ev.Risk*scale {
+			return true, ev.Reason, ev.Name
+		}
+		roll -= ev.Risk * scale
+	}
+	return true, deliveryFailureReason(r, crew.Name), "crew"
+}
+
+func fromHQ(place string) float64 {
+	if place == hq {
+		return 0
+	}
+	return calcDistance(place)
+}
+
+// arrival is how long the flight takes to reach the end of leg.
+func (p FlightPlan) arrival(leg int) time.Duration {
+	var d time.Duration
+	for _, l := range p.Legs[:leg+1] {
+		d += l.Duration
+	}
+	return d
+}
+
+// total is how long crew and ship are away from HQ.
+func (p FlightPlan) total() time.Duration {
+	return p.arrival(len(p.Legs) - 1)
+}
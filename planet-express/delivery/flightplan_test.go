@@ -0,0 +1,141 @@
+// delivery-service/flightplan_test.go
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/sim"
+)
+
+// withEnRouteEvents replaces enRouteEvents for the rest of t.
+func withEnRouteEvents(t *testing.T, evs []enRouteEvent) {
+	t.Helper()
+	prev := enRouteEvents
+	enRouteEvents = evs
+	t.Cleanup(func() { enRouteEvents = prev })
+}
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		wantStops string
+		wantLY    float64
+	}{
+		{"direct", []string{"Mars Vegas"}, "HQ > Mars Vegas > HQ", 50},
+		{"by waypoints", []string{"Omicron Persei 8"}, "HQ > Mars Vegas > Neptune > Omicron Persei 8 > HQ", 200},
+		{"nearest first", []string{"Neptune", "Luna Park"}, "HQ > Luna Park > Mars Vegas > Neptune > HQ", 100},
+		{"waypoint also an address", []string{"Neptune", "Mars Vegas"}, "HQ > Mars Vegas > Neptune > HQ", 100},
+		{"same distance out", []string{"Sewer City", "New New York"}, "HQ > Sewer City > New New York > HQ", 22},
+		{"unknown address", []string{"Nowhere"}, "HQ > Nowhere > HQ", 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			legs := route(tt.addresses)
+			stops := []string{legs[0].From}
+			for _, leg := range legs {
+				stops = append(stops, leg.To)
+			}
+			got := strings.ReplaceAll(strings.Join(stops, " > "), hq, "HQ")
+			if got != tt.wantStops {
+				t.Errorf("route(%v) = %s, want %s", tt.addresses, got, tt.wantStops)
+			}
+			if d := routeDistance(tt.addresses); d != tt.wantLY {
+				t.Errorf("routeDistance(%v) = %v, want %v", tt.addresses, d, tt.wantLY)
+			}
+		})
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	tests := []struct {
+		addresses []string
+		speed     float64
+		want      []time.Duration
+	}{
+		{[]string{"Mars Vegas"}, 10, []time.Duration{2500 * time.Millisecond}},
+		{[]string{"Neptune", "Mars Vegas"}, 10, []time.Duration{5 * time.Second, 2500 * time.Millisecond}},
+		{[]string{"Omicron Persei 8"}, 20, []time.Duration{5 * time.Second}},
+	}
+	for _, tt := range tests {
+		if got := schedule(tt.addresses, ShipInfo{Speed: tt.speed}); !slices.Equal(got, tt.want) {
+			t.Errorf("schedule(%v, speed %v) = %v, want %v", tt.addresses, tt.speed, got, tt.want)
+		}
+	}
+}
+
+func TestRollOutcome(t *testing.T) {
+	pirates := enRouteEvent{Name: "space_pirates", Risk: 1, Reason: "Pirates"}
+	tests := []struct {
+		name       string
+		crewRisk   float64
+		risk       float64
+		scale      float64
+		causes     []enRouteEvent
+		wantFailed bool
+		wantCause  string
+	}{
+		{"no risk", 0, 0, 1, nil, false, ""},
+		{"certain crew failure", 1, 1, 1, nil, true, "crew"},
+		{"scaled up to certain", 0.5, 0.5, 2, nil, true, "crew"},
+		{"scaled down to nothing", 1, 1, 0, nil, false, ""},
+		{"blamed on the event", 0, 1, 1, []enRouteEvent{pirates}, true, "space_pirates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for seed := range uint64(50) {
+				failed, reason, cause := rollOutcome(sim.NewRand(seed), CrewMember{Name: "Fry", Risk: tt.crewRisk}, tt.risk, tt.scale, tt.causes)
+				if failed != tt.wantFailed || cause != tt.wantCause || (reason != "") != failed {
+					t.Fatalf("seed %d: rollOutcome() = %v, %q, %q, want %v, cause %q", seed, failed, reason, cause, tt.wantFailed, tt.wantCause)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanFlight(t *testing.T) {
+	ship := ShipInfo{Name: "Planet Express Ship", Speed: 10}
+	delay := enRouteEvent{Name: "engine_trouble", Chance: 1, Delay: 1, Risk: 1, Reason: "Engine trouble"}
+	tests := []struct {
+		name       string
+		events     []enRouteEvent
+		crewRisk   float64
+		hazards    []string
+		wantTotal  time.Duration
+		wantFailed bool
+		wantCause  string
+	}{
+		{"uneventful", nil, 0, nil, 10 * time.Second, false, ""},
+		{"crew always fail", nil, 1, nil, 10 * time.Second, true, "crew"},
+		{"hazardous cargo", nil, 0.5, []string{"explosive", "explosive"}, 10 * time.Second, true, "crew"},
+		{"every leg delayed", []enRouteEvent{delay}, 0, nil, 20 * time.Second, true, "engine_trouble"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEnRouteEvents(t, tt.events)
+			addresses := []string{"Neptune", "Mars Vegas"}
+			plan := planFlight(sim.NewRand(1), addresses, tt.hazards, CrewMember{Name: "Leela", Risk: tt.crewRisk}, ship)
+
+			if got := plan.total(); got != tt.wantTotal {
+				t.Errorf("total() = %s, want %s", got, tt.wantTotal)
+			}
+			if len(plan.Drops) != len(addresses) {
+				t.Fatalf("got %d drops, want %d", len(plan.Drops), len(addresses))
+			}
+			for i, drop := range plan.Drops {
+				if drop.Address != addresses[i] || plan.Legs[drop.Leg].To != drop.Address {
+					t.Errorf("drop %d is %s on leg %d to %s", i, drop.Address, drop.Leg, plan.Legs[drop.Leg].To)
+				}
+				if drop.Failed != tt.wantFailed || drop.Cause != tt.wantCause {
+					t.Errorf("drop %d failed = %v, cause %q, want %v, %q", i, drop.Failed, drop.Cause, tt.wantFailed, tt.wantCause)
+				}
+				if want := len(tt.events) * (drop.Leg + 1); len(drop.Events) != want {
+					t.Errorf("drop %d saw %d events, want %d", i, len(drop.Events), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// delivery-service/flights.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+)
+
+// Flight is a ship in the air with one or more packages on board.
+type Flight struct {
+	ID           string    `json:"id"`
+	PackageIDs   []string  `json:"package_ids"`
+	Crew         string    `json:"crew"`
+	Ship         string    `json:"ship"`
+	DispatchedAt time.Time `json:"dispatched_at"`
+	Legs         []Leg     `json:"legs"`
+	Leg          int       `json:"leg"`                // index of the leg being flown
+	Recalled     []string  `json:"recalled,omitempty"` // packages being brought back to HQ
+
+	packages []Package    // as in PackageIDs
+	cargo    []cargoState // of each package
+	drops    []int        // index of the leg reaching each package
+	recall   context.CancelFunc
+}
+
+type cargoState int
+
+const (
+	aboard cargoState = iota
+	dropped
+	recalled
+)
+
+var errDropped = errors.New("Too late to recall: the ship has already reached the package's address")
+
+// flightRegistry tracks the flights this process is running, from dispatch
+// until the ship is back at HQ.
+type flightRegistry struct {
+	mu      sync.Mutex
+	flights map[string]Flight // by flight ID
+}
+
+var flights = &flightRegistry{flights: make(map[string]Flight)}
+
+// add registers f, flying plan. Calling recall turns the ship back to HQ.
+func (fr *flightRegistry) add(f Flight, plan FlightPlan, recall context.CancelFunc) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	f.cargo = make([]cargoState, len(f.PackageIDs))
+	for _, d := range plan.Drops {
+		f.drops = append(f.drops, d.Leg)
+	}
+	f.recall = recall
+	fr.flights[f.ID] = f
+}
+
+// drop marks package i of flight id as dropped off. It reports false if
+// the package has been recalled instead. Once only recalled packages are
+// left on board, the rest of the flight is cut short.
+func (fr *flightRegistry) drop(id string, i int) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	f := fr.flights[id]
+	if f.cargo[i] == recalled {
+		return false
+	}
+	f.cargo[i] = dropped
+	if len(f.Recalled) > 0 && !slices.Contains(f.cargo, aboard) {
+		f.recall()
+	}
+	return true
+}
+
+// recall brings pkgID back to HQ instead of dropping it off, and cuts the
+// flight short once nothing left on board is still to be dropped off. found
+// is false if pkgID isn't on any flight; err is errDropped if it is too late.
+func (fr *flightRegistry) recall(pkgID string) (f Flight, found bool, err error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	for _, f := range fr.flights {
+		i := slices.Index(f.PackageIDs, pkgID)
+		if i < 0 {
+			continue
+		}
+		switch f.cargo[i] {
+		case dropped:
+			return f, true, errDropped
+		case aboard:
+			f.cargo[i] = recalled
+			f.Recalled = append(f.Recalled, pkgID)
+			fr.flights[f.ID] = f
+			if !slices.Contains(f.cargo, aboard) {
+				f.recall()
+			}
+		}
+		return f, true, nil
+	}
+	return Flight{}, false, nil
+}
+
+// recalledPackages lists the packages recalled from flight id.
+func (fr *flightRegistry) recalledPackages(id string) []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return slices.Clone(fr.flights[id].Recalled)
+}
+
+func (fr *flightRegistry) setLeg(id string, leg int) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if f, ok := fr.flights[id]; ok {
+		f.Leg = leg
+		fr.flights[id] = f
+	}
+}
+
+func (fr *flightRegistry) remove(id string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	delete(fr.flights, id)
+}
+
+func (fr *flightRegistry) list() []Flight {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	list := make([]Flight, 0, len(fr.flights))
+	for _, f := range fr.flights {
+		list = append(list, f)
+	}
+	return list
+}
+
+// fly flies f's plan leg by leg, recording each package's outcome as the
+// ship reaches its address and the ship's return once it is back at HQ.
+// Recalled packages are skipped and recorded as brought back once the ship
+// lands. Cancelling ctx turns the ship straight back to HQ from wherever it
+// is on the way out.
+//
+// Consumers of the events update packages and return the crew and ship to
+// base; the outbox keeps retrying until each is published.
+func fly(ctx context.Context, f Flight, plan FlightPlan, crew CrewMember, ship ShipInfo) {
+	var flown time.Duration
+	var distance float64
+	var delivered, failed int
+legs:
+	for i, leg := range plan.Legs {
+		flights.setLeg(f.ID, i)
+		slog.Info("Ship in-flight", "flight_id", f.ID, "from", leg.From, "to", leg.To,
+			"distance_ly", leg.Distance, "ship_speed", ship.Speed, "duration", leg.Duration)
+		for _, name := range leg.Events {
+			slog.Info("En-route event", "flight_id", f.ID, "event", name, "from", leg.From, "to", leg.To)
+		}
+		started := clock.Now()
+		select {
+		case <-clock.After(leg.Duration):
+		case <-ctx.Done():
+			if leg.To == hq {
+				// Already on the way home.
+				clock.Sleep(leg.Duration - clock.Since(started))
+				break
+			}
+			// Turn back from part way along the leg. Everything lies on a
+			// line out from HQ, so the way back is as far as the ship is
+			// from HQ.
+			share := min(float64(clock.Since(started))/float64(leg.Duration), 1)
+			out := fromHQ(leg.From) + share*(fromHQ(leg.To)-fromHQ(leg.From))
+			back := time.Duration(float64(time.Second) * out / ship.Speed)
+			slog.Info("Flight recalled, returning to base", "flight_id", f.ID, "from", leg.From, "to", leg.To,
+				"distance_ly", out, "duration", back)
+			clock.Sleep(back)
+			flown += time.Duration(share*float64(leg.Duration)) + back
+			distance += share*leg.Distance + out
+			break legs
+		}
+		flown += leg.Duration
+		distance += leg.Distance
+
+		for j, drop := range plan.Drops {
+			if drop.Leg != i || !flights.drop(f.ID, j) {
+				continue
+			}
+			pkgID, now := f.PackageIDs[j], clock.Now()
+			ev := events.Event{Type: events.Completed, PackageID: pkgID, FlightID: f.ID, Crew: crew.Name, Ship: ship.Name}
+			if drop.Failed {
+				ev.Type, ev.Reason, ev.Incident = events.Failed, drop.Reason, flightIncident(f, drop, now)
+				failed++
+				slog.Warn("Delivery failed", "package_id", pkgID, "flight_id", f.ID, "crew", crew.Name, "reason", ev.Reason)
+			} else {
+				ev.Proof = proofOfDelivery(rng, f, pkgID, f.packages[j].Recipient, drop.Address, now)
+				earn(f.packages[j])
+				delivered++
+				slog.Info("Package delivered", "package_id", pkgID, "flight_id", f.ID, "signed", ev.Proof.SignatureHash != "")
+			}
+			if err := outbox.add(ev); err != nil {
+				slog.Error("Failed to record delivery outcome", "package_id", pkgID, "type", ev.Type, "err", err)
+			}
+		}
+	}
+
+	// Back at HQ. crew-service also records how the flight went.
+	slog.Info("Ship returned to base", "flight_id", f.ID, "ship", ship.Name, "crew", crew.Name)
+	for _, pkgID := range flights.recalledPackages(f.ID) {
+		earn(f.packages[slices.Index(f.PackageIDs, pkgID)])
+		ev := events.Event{Type: events.Recalled, PackageID: pkgID, FlightID: f.ID, Crew: crew.Name, Ship: ship.Name}
+		if err := outbox.add(ev); err != nil {
+			slog.Error("Failed to record recalled package", "package_id", pkgID, "err", err)
+		}
+	}
+	ev := events.Event{Type: events.Returned, FlightID: f.ID, Crew: crew.Name, Ship: ship.Name,
+		Delivered: delivered, Failed: failed, FlightSeconds: flown.Seconds(), Distance: distance}
+	if err := outbox.add(ev); err != nil {
+		slog.Error("Failed to record flight return", "flight_id", f.ID, "err", err)
+	}
+	flights.remove(f.ID)
+
+	// package-service prunes finished packages after PACKAGE_RETENTION,
+	// so the final status stays visible to clients for a while.
+}
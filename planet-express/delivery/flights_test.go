@@ -0,0 +1,173 @@
+// delivery-service/flights_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+)
+
+// flightClock is a clock for flying tests: every leg lands at once, unless
+// ctx has been cancelled, in which case the ship is always mid-leg.
+type flightClock struct {
+	ctx context.Context
+	now time.Time
+}
+
+func (c *flightClock) Now() time.Time                { return c.now }
+func (c *flightClock) Sleep(time.Duration)           {}
+func (c *flightClock) Since(time.Time) time.Duration { return 0 }
+func (c *flightClock) After(time.Duration) <-chan time.Time {
+	if c.ctx.Err() != nil {
+		return nil
+	}
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// testFlight is a flight out to Mars Vegas and on to Neptune, with P1 for
+// Mars Vegas and P2 for Neptune.
+func testFlight() (Flight, FlightPlan) {
+	addresses := []string{"Mars Vegas", "Neptune"}
+	plan := FlightPlan{Legs: route(addresses)}
+	for i := range plan.Legs {
+		plan.Legs[i].Duration = time.Second
+	}
+	plan.Drops = []Drop{{Address: addresses[0], Leg: 0}, {Address: addresses[1], Leg: 1, Failed: true, Reason: "Lost", Cause: "crew"}}
+	f := Flight{ID: "FL-1", PackageIDs: []string{"P1", "P2"}, Crew: "Leela", Ship: "Nimbus", Legs: plan.Legs,
+		packages: []Package{{ID: "P1", Recipient: "Hermes"}, {ID: "P2", Recipient: "Amy"}}}
+	return f, plan
+}
+
+func TestFlightRegistry(t *testing.T) {
+	tests := []struct {
+		name          string
+		steps         []string // "drop N" or "recall ID"
+		want          []string
+		wantTurnsBack bool
+	}{
+		{"nothing recalled", []string{"drop 0", "drop 1"}, []string{"dropped", "dropped"}, false},
+		{"recall one of two", []string{"recall P2"}, []string{"recalled"}, false},
+		{"recall everything", []string{"recall P1", "recall P2"}, []string{"recalled", "recalled"}, true},
+		{"recalled package isn't dropped", []string{"recall P1", "drop 0"}, []string{"recalled", "skipped"}, false},
+		{"last drop turns the ship back", []string{"recall P2", "drop 0"}, []string{"recalled", "dropped"}, true},
+		{"last package aboard recalled", []string{"drop 0", "recall P2"}, []string{"dropped", "recalled"}, true},
+		{"too late", []string{"drop 0", "recall P1"}, []string{"dropped", "too late"}, false},
+		{"not on a flight", []string{"recall P9"}, []string{"not found"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := &flightRegistry{flights: make(map[string]Flight)}
+			f, plan := testFlight()
+			turnedBack := false
+			fr.add(f, plan, func() { turnedBack = true })
+
+			var got []string
+			for _, step := range tt.steps {
+				var op, arg string
+				fmt.Sscan(step, &op, &arg)
+				switch op {
+				case "drop":
+					var i int
+					fmt.Sscan(arg, &i)
+					got = append(got, map[bool]string{true: "dropped", false: "skipped"}[fr.drop(f.ID, i)])
+				case "recall":
+					_, found, err := fr.recall(arg)
+					switch {
+					case errors.Is(err, errDropped):
+						got = append(got, "too late")
+					case !found:
+						got = append(got, "not found")
+					default:
+						got = append(got, "recalled")
+					}
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("steps %v = %v, want %v", tt.steps, got, tt.want)
+			}
+			if turnedBack != tt.wantTurnsBack {
+				t.Errorf("turned back = %v, want %v", turnedBack, tt.wantTurnsBack)
+			}
+		})
+	}
+}
+
+func TestFly(t *testing.T) {
+	tests := []struct {
+		name         string
+		recall       []string
+		wantEvents   []string
+		wantDistance float64
+	}{
+		{
+			"every drop made",
+			nil,
+			[]string{"DeliveryCompleted P1", "DeliveryFailed P2", "FlightReturned delivered 1 failed 1"},
+			100,
+		},
+		{
+			"turned back after the last drop",
+			[]string{"P2"},
+			[]string{"DeliveryCompleted P1", "DeliveryRecalled P2", "FlightReturned delivered 1 failed 0"},
+			50,
+		},
+		{
+			"turned back before take-off",
+			[]string{"P1", "P2"},
+			[]string{"DeliveryRecalled P1", "DeliveryRecalled P2", "FlightReturned delivered 0 failed 0"},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, recall := context.WithCancel(context.Background())
+			defer recall()
+			prevClock, prevOutbox, prevFlights := clock, outbox, flights
+			clock, outbox, flights = &flightClock{ctx: ctx}, newTestOutbox("", nil), &flightRegistry{flights: make(map[string]Flight)}
+			t.Cleanup(func() { clock, outbox, flights = prevClock, prevOutbox, prevFlights })
+
+			f, plan := testFlight()
+			flights.add(f, plan, recall)
+			for _, id := range tt.recall {
+				if _, found, err := flights.recall(id); !found || err != nil {
+					t.Fatalf("recall(%s) = %v, %v", id, found, err)
+				}
+			}
+			fly(ctx, f, plan, CrewMember{Name: "Leela"}, ShipInfo{Name: "Nimbus", Speed: 10})
+
+			var got []string
+			var distance float64
+			for _, ev := range outbox.pending() {
+				if ev.Type == events.Returned {
+					got = append(got, fmt.Sprintf("%s delivered %d failed %d", ev.Type, ev.Delivered, ev.Failed))
+					distance = ev.Distance
+					continue
+				}
+				got = append(got, ev.Type+" "+ev.PackageID)
+				switch {
+				case ev.Type == events.Completed && (ev.Proof == nil || ev.Proof.Recipient != "Hermes" || ev.Proof.Address != "Mars Vegas"):
+					t.Errorf("%s for %s has proof %+v, want one signed over by Hermes at Mars Vegas", ev.Type, ev.PackageID, ev.Proof)
+				case ev.Type == events.Failed && (ev.Incident == nil || ev.Incident.Location != "Neptune" || ev.Incident.Cause != "crew"):
+					t.Errorf("%s for %s has incident %+v, want one at Neptune blamed on the crew", ev.Type, ev.PackageID, ev.Incident)
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", got, tt.wantEvents)
+			}
+			if distance != tt.wantDistance {
+				t.Errorf("distance flown = %v, want %v", distance, tt.wantDistance)
+			}
+			if len(flights.list()) != 0 {
+				t.Errorf("flight still registered after landing")
+			}
+		})
+	}
+}
@@ -4,17 +4,22 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"math/rand/v2"
-
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/gingercookie/planet-express/internal/health"
+	"github.com/gingercookie/planet-express/internal/sim"
+	"github.com/gingercookie/planet-express/internal/tlsconfig"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -24,6 +29,22 @@ type CrewMember struct {
 	Risk float64 `json:"risk"`
 }
 
+// ShipReturn tells ship-service a ship is back. Distance is only set when
+// it is back from a flight.
+type ShipReturn struct {
+	Name     string  `json:"name"`
+	Distance float64 `json:"distance_ly,omitempty"`
+}
+
+// CrewReturn tells crew-service a crew member is back. The other fields are
+// only set when they are back from a flight.
+type CrewReturn struct {
+	Name          string  `json:"name"`
+	Delivered     int     `json:"delivered,omitempty"`
+	Failed        int     `json:"failed,omitempty"`
+	FlightSeconds float64 `json:"flight_seconds,omitempty"`
+}
+
 type ShipInfo struct {
 	Name      string  `json:"name"`
 	Available bool    `json:"available"`
@@ -31,17 +52,57 @@ type ShipInfo struct {
 }
 
 type Package struct {
-	ID        string `json:"id"`
-	Recipient string `json:"recipient"`
-	Address   string `json:"address"`
-	Status    string `json:"status"`
-	Contents  string `json:"contents"`
+	ID           string     `json:"id"`
+	Recipient    string     `json:"recipient"`
+	Address      string     `json:"address"`
+	Status       string     `json:"status"`
+	Contents     string     `json:"contents"`
+	WeightKG     float64    `json:"weight_kg,omitempty"`
+	VolumeM3     float64    `json:"volume_m3,omitempty"`
+	Hazard       string     `json:"hazard_class,omitempty"`
+	Priority     string     `json:"priority,omitempty"`
+	QuoteID      string     `json:"quote_id,omitempty"`
+	Charge       float64    `json:"charge"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Version      int        `json:"version,omitempty"`
+	Crew         string     `json:"crew,omitempty"`
+	Ship         string     `json:"ship,omitempty"`
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	ETA          *time.Time `json:"eta,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	FlightID     string     `json:"flight_id,omitempty"`
 }
 
+// PackageStatusUpdate is the body package-service expects on /packages/update.
+// Crew, Ship, FlightID and ETA are only sent when marking a package
+// in-transit, Proof when marking it delivered and Incident when marking it
+// failed.
+type PackageStatusUpdate struct {
+	ID       string                  `json:"id"`
+	Status   string                  `json:"status"`
+	Crew     string                  `json:"crew,omitempty"`
+	Ship     string                  `json:"ship,omitempty"`
+	FlightID string                  `json:"flight_id,omitempty"`
+	ETA      *time.Time              `json:"eta,omitempty"`
+	Proof    *events.ProofOfDelivery `json:"proof,omitempty"`
+	Incident *events.IncidentReport  `json:"incident,omitempty"`
+}
+
+// DeliveryRequest is the body of POST /deliveries and POST /quotes. Weight
+// and volume default to a small parcel; the hazard class is worked out from
+// the contents when they are known to be hazardous. Priority defaults to
+// standard. A delivery is charged the price of QuoteID if set, or the
+// going rate otherwise.
 type DeliveryRequest struct {
-	Recipient string `json:"recipient"`
-	Address   string `json:"address"`
-	Contents  string `json:"contents"`
+	Recipient string  `json:"recipient"`
+	Address   string  `json:"address"`
+	Contents  string  `json:"contents"`
+	WeightKG  float64 `json:"weight_kg,omitempty"`
+	VolumeM3  float64 `json:"volume_m3,omitempty"`
+	Hazard    string  `json:"hazard_class,omitempty"`
+	Priority  string  `json:"priority,omitempty"`
+	QuoteID   string  `json:"quote_id,omitempty"`
 }
 
 type DeliveryTicket struct {
@@ -50,11 +111,26 @@ type DeliveryTicket struct {
 	Package Package    `json:"package"`
 }
 
+// Headers set by the api gateway identifying the authenticated caller.
+const (
+	callerHeader = "X-Planet-Express-Caller"
+	roleHeader   = "X-Planet-Express-Role"
+)
+
 var (
+	// clock and rng drive everything simulated. main replaces them from
+	// the SIM_* variables at startup.
+	clock sim.Clock = sim.RealClock{}
+	rng             = sim.NewRand(rand.Uint64())
+
 	crewServiceURL    = getEnv("CREW_SERVICE_URL", "http://crew-service")
 	shipServiceURL    = getEnv("SHIP_SERVICE_URL", "http://ship-service")
 	packageServiceURL = getEnv("PACKAGE_SERVICE_URL", "http://package-service")
 
+	// httpClient is shared by all calls to other services. main switches it
+	// to mutual TLS when certificates are configured.
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+
 	// distances from Planet Express HQ to known destinations, in light-years
 	distances = map[string]float64{
 		"New New York":        10,
@@ -126,17 +202,22 @@ func calcDistance(address string) float64 {
 	return 30 // default mid-range distance for unknown destinations
 }
 
-func deliveryFailureReason(crewName string) string {
+func deliveryFailureReason(r *sim.Rand, crewName string) string {
 	if reasons, ok := failureReasons[crewName]; ok {
-		return reasons[rand.IntN(len(reasons))]
+		return reasons[r.IntN(len(reasons))]
 	}
-	return genericFailureReasons[rand.IntN(len(genericFailureReasons))]
+	return genericFailureReasons[r.IntN(len(genericFailureReasons))]
 }
 
-func requestAvailableCrew() (CrewMember, int, error) {
+// requestAvailableCrew reserves a crew member qualified to carry every
+// hazard class in hazards.
+func requestAvailableCrew(hazards []string) (CrewMember, int, error) {
 	url := fmt.Sprintf("%s/crew/reserve", crewServiceURL)
+	if len(hazards) > 0 {
+		url += "?hazard=" + strings.Join(hazards, ",")
+	}
 	slog.Debug("Sending request to crew service", "url", url)
-	resp, err := http.Get(url)
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		return CrewMember{}, http.StatusServiceUnavailable, err
 	}
@@ -163,10 +244,12 @@ func requestAvailableCrew() (CrewMember, int, error) {
 	return crew, http.StatusOK, nil
 }
 
-func reserveShip() (ShipInfo, int, error) {
-	url := fmt.Sprintf("%s/ship/reserve", shipServiceURL)
+// reserveShip reserves a ship with the range to fly distance light-years
+// and the hold for weightKG and volumeM3 of cargo.
+func reserveShip(distance, weightKG, volumeM3 float64) (ShipInfo, int, error) {
+	url := fmt.Sprintf("%s/ship/reserve?distance=%g&weight=%g&volume=%g", shipServiceURL, distance, weightKG, volumeM3)
 	slog.Debug("Sending request to ship service", "url", url)
-	resp, err := http.Post(url, "application/json", nil)
+	resp, err := httpClient.Post(url, "application/json", nil)
 	if err != nil {
 		return ShipInfo{}, http.StatusServiceUnavailable, err
 	}
@@ -193,7 +276,7 @@ func reserveShip() (ShipInfo, int, error) {
 	return ship, resp.StatusCode, nil
 }
 
-func createPackage(pkg Package) (Package, int, error) {
+func createPackage(pkg Package, caller string) (Package, int, error) {
 	url := fmt.Sprintf("%s/packages", packageServiceURL)
 	slog.Debug("Sending request to package service", "url", url)
 
@@ -201,7 +284,13 @@ func createPackage(pkg Package) (Package, int, error) {
 	if err != nil {
 		return Package{}, http.StatusInternalServerError, fmt.Errorf("failed to marshal package: %w", err)
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	if err != nil {
+		return Package{}, http.StatusInternalServerError, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(callerHeader, caller)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return Package{}, http.StatusServiceUnavailable, err
 	}
@@ -227,6 +316,80 @@ func createPackage(pkg Package) (Package, int, error) {
 	return created, resp.StatusCode, nil
 }
 
+// updatePackageStatus applies update in package-service and returns the
+// package as stored afterwards.
+func updatePackageStatus(update PackageStatusUpdate) (Package, error) {
+	url := fmt.Sprintf("%s/packages/update", packageServiceURL)
+	slog.Debug("Sending request to package service", "url", url, "package_id", update.ID, "status", update.Status)
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return Package{}, fmt.Errorf("failed to marshal status update: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(data))
+	if err != nil {
+		return Package{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Package{}, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Package{}, fmt.Errorf("error reading response body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Package{}, fmt.Errorf("package status update failed (%d): %s", resp.StatusCode, bodyBytes)
+	}
+
+	var updated Package
+	if err := json.Unmarshal(bodyBytes, &updated); err != nil {
+		return Package{}, err
+	}
+	return updated, nil
+}
+
+func returnCrew(crew CrewReturn) error {
+	slog.Info("Returning crew member to base", "name", crew.Name)
+	data, err := json.Marshal(crew)
+	if err != nil {
+		return fmt.Errorf("failed to marshal crew member: %w", err)
+	}
+	resp, err := httpClient.Post(fmt.Sprintf("%s/crew/return", crewServiceURL), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("crew return failed (%d): %s", resp.StatusCode, bodyBytes)
+	}
+	slog.Info("Crew member returned to base", "name", crew.Name)
+	return nil
+}
+
+func returnShip(ship ShipReturn) error {
+	slog.Info("Returning ship to base", "name", ship.Name)
+	data, err := json.Marshal(ship)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ship: %w", err)
+	}
+	resp, err := httpClient.Post(fmt.Sprintf("%s/ship/return", shipServiceURL), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("ship return failed (%d): %s", resp.StatusCode, bodyBytes)
+	}
+	slog.Info("Ship returned to base", "name", ship.Name)
+	return nil
+}
+
 func handleDelivery(w http.ResponseWriter, r *http.Request) {
 	requestsReceived.WithLabelValues(r.Method).Inc()
 
@@ -236,128 +399,49 @@ func handleDelivery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slog.Debug("Got request for new delivery")
+	caller := r.Header.Get(callerHeader)
+	slog.Debug("Got request for new delivery", "caller", caller, "role", r.Header.Get(roleHeader))
 	var req DeliveryRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
 		return
 	}
-
-	slog.Info("Dispatching request for available crew")
-	crew, statusCode, err := requestAvailableCrew()
-	if err != nil {
-		http.Error(w, err.Error(), statusCode)
-		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(statusCode)).Inc()
-		return
-	}
-	slog.Debug("Got crew member", "name", crew.Name)
-
-	slog.Info("Dispatching request to reserve ship")
-	ship, statusCode, err := reserveShip()
-	if err != nil {
-		http.Error(w, err.Error(), statusCode)
-		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(statusCode)).Inc()
-		return
-	}
-
-	slog.Info("Got both crew member and ship")
-	if (crew == CrewMember{}) || (ship == ShipInfo{}) {
-		http.Error(w, "Unable to get ship or crew", http.StatusServiceUnavailable)
-		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
-		return
-	}
-
-	slog.Info("Dispatching request to create new package")
-	pkg, statusCode, err := createPackage(Package{
-		Recipient: req.Recipient,
-		Address:   req.Address,
-		Contents:  req.Contents,
-	})
-	if err != nil {
-		http.Error(w, err.Error(), statusCode)
-		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(statusCode)).Inc()
+	if err := errors.Join(validateCargo(&req), validatePriority(&req)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
 		return
 	}
-
-	// Build the delivery ticket
-	ticket := DeliveryTicket{
-		Crew:    crew,
-		Ship:    ship,
-		Package: pkg,
-	}
-	slog.Info("Delivery ticket created", "crew", ticket.Crew.Name, "ship", ticket.Ship.Name, "package_id", ticket.Package.ID)
-
-	go func(pkgID string, address string, crew CrewMember, ship ShipInfo) {
-		distance := calcDistance(address)
-		delay := time.Duration(float64(time.Second) * distance / ship.Speed)
-		slog.Info("Ship in-flight", "delay", delay, "package_id", pkgID, "distance_ly", distance, "ship_speed", ship.Speed)
-		time.Sleep(delay)
-
-		// Determine delivery outcome based on crew risk
-		if rand.Float64() < crew.Risk {
-			reason := deliveryFailureReason(crew.Name)
-			slog.Warn("Delivery failed", "package_id", pkgID, "crew", crew.Name, "reason", reason)
-			resp, err := http.Get(fmt.Sprintf("%s/packages/update?id=%s&status=failed", packageServiceURL, pkgID))
-			if err != nil {
-				slog.Error("Failed to update package status to failed", "err", err)
-			} else {
-				resp.Body.Close()
-			}
-		} else {
-			resp, err := http.Get(fmt.Sprintf("%s/packages/update?id=%s&status=delivered", packageServiceURL, pkgID))
-			if err != nil {
-				slog.Error("Failed to update package status", "err", err)
-			} else {
-				resp.Body.Close()
-				slog.Info("Package marked as delivered", "package_id", pkgID)
-			}
-		}
-
-		// Delete package from map to prevent boundless growth
-		deleteReq, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/packages/delete?id=%s", packageServiceURL, pkgID), nil)
+	var charge float64
+	if req.QuoteID != "" {
+		q, code, err := quotes.reserve(req.QuoteID, req, caller)
 		if err != nil {
-			slog.Error("Failed to create delete request", "err", err)
-		} else {
-			resp, err := http.DefaultClient.Do(deleteReq)
-			if err != nil {
-				slog.Error("Failed to delete package from list", "err", err)
-			} else {
-				resp.Body.Close()
-				slog.Info("Package deleted successfully", "package_id", pkgID)
-			}
-		}
-
-		// Return crew to base
-		slog.Info("Returning crew member to base", "name", crew.Name)
-		data, err := json.Marshal(crew)
-		if err != nil {
-			slog.Error("Failed to marshal crew member", "name", crew.Name, "err", err)
-		} else {
-			resp, err := http.Post(fmt.Sprintf("%s/crew/return", crewServiceURL), "application/json", bytes.NewBuffer(data))
-			if err != nil {
-				slog.Error("Failed to return crew member to base", "name", crew.Name, "err", err)
-			} else {
-				resp.Body.Close()
-				slog.Info("Crew member returned to base", "name", crew.Name)
-			}
+			http.Error(w, err.Error(), code)
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(code)).Inc()
+			return
 		}
+		charge = q.Price
+	} else {
+		charge, _ = price(req)
+	}
 
-		// Return ship to base
-		slog.Info("Returning ship to base")
-		data, err = json.Marshal(ship)
-		if err != nil {
-			slog.Error("Failed to marshal ship", "name", ship.Name, "err", err)
+	res := batches.submit(req, charge, caller)
+	if req.QuoteID != "" {
+		// A request that doesn't fly leaves the quote for the next try.
+		if res.err != nil {
+			quotes.release(req.QuoteID)
 		} else {
-			resp, err := http.Post(fmt.Sprintf("%s/ship/return", shipServiceURL), "application/json", bytes.NewBuffer(data))
-			if err != nil {
-				slog.Error("Failed to return ship", "err", err)
-			} else {
-				resp.Body.Close()
-				slog.Info("Ship returned to base")
-			}
+			quotes.commit(req.QuoteID)
 		}
-	}(pkg.ID, pkg.Address, crew, ship)
+	}
+	if res.err != nil {
+		http.Error(w, res.err.Error(), res.code)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(res.code)).Inc()
+		return
+	}
+	ticket := res.ticket
+	slog.Info("Delivery ticket created", "crew", ticket.Crew.Name, "ship", ticket.Ship.Name, "package_id", ticket.Package.ID,
+		"flight_id", ticket.Package.FlightID, "charge", ticket.Package.Charge, "caller", caller)
 
 	// Send ticket to requester
 	w.Header().Set("Content-Type", "application/json")
@@ -373,14 +457,93 @@ func main() {
 	}
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
 
+	var err error
+	if clock, rng, err = sim.FromEnv(); err != nil {
+		slog.Error("Invalid simulation settings", "err", err)
+		os.Exit(1)
+	}
+
+	certs, err := tlsconfig.FromEnv()
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "err", err)
+		os.Exit(1)
+	}
+	if certs != nil {
+		transport := certs.Transport()
+		httpClient.Transport = transport
+		health.Client.Transport = transport
+	}
+
+	broker, err = events.NewBrokerFromEnv("delivery-service")
+	if err != nil {
+		slog.Error("Unable to set up event broker", "err", err)
+		os.Exit(1)
+	}
+	if _, ok := broker.(*events.MemoryBroker); ok {
+		// The other services can't see an in-process broker, so pass the
+		// events on to them over HTTP.
+		if err := bridgeEvents(broker); err != nil {
+			slog.Error("Unable to bridge events", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	batches = newBatcherFromEnv()
+	outbox, err = newOutboxFromEnv(publishEvent, eventConsumers(broker))
+	if err != nil {
+		slog.Error("Unable to open outbox", "err", err)
+		os.Exit(1)
+	}
+	go outbox.run()
+	rc, err := newReconcilerFromEnv()
+	if err != nil {
+		slog.Error("Invalid reconciler configuration", "err", err)
+		os.Exit(1)
+	}
+	go rc.run()
+	go surges.run()
+
+	readyTTL := 5 * time.Second
+	if val, err := time.ParseDuration(os.Getenv("READINESS_CACHE_TTL")); err == nil {
+		readyTTL = val
+	}
+	deps := map[string]func() error{
+		"crew":    health.HTTPDependency(crewServiceURL),
+		"ship":    health.HTTPDependency(shipServiceURL),
+		"package": health.HTTPDependency(packageServiceURL),
+	}
+	if nb, ok := broker.(*events.NATSBroker); ok {
+		deps["broker"] = nb.Connected
+	}
+	readiness := health.NewChecker(deps, readyTTL)
+
 	deliveryMux := http.NewServeMux()
 	deliveryMux.HandleFunc("/deliveries", handleDelivery)
+	deliveryMux.HandleFunc("POST /deliveries/{id}/cancel", handleCancel)
+	deliveryMux.HandleFunc("POST /quotes", handleQuote)
+	deliveryMux.HandleFunc("GET /admin/outbox", outbox.listEntries)
+	deliveryMux.HandleFunc("POST /admin/outbox/replay", outbox.replayEntries)
+	deliveryMux.HandleFunc("POST /admin/simulate", handleSimulate)
+	deliveryMux.HandleFunc("/healthz", health.Healthz)
+	deliveryMux.HandleFunc("/readyz", readiness.Readyz)
 
 	prometheus.MustRegister(requestsReceived)
 	prometheus.MustRegister(requestsProcessed)
+	prometheus.MustRegister(eventsPublished)
+	prometheus.MustRegister(outbox.metrics()...)
+	prometheus.MustRegister(reconcileDrift)
+	prometheus.MustRegister(reconcileRepairs)
+	prometheus.MustRegister(reconcileRuns)
+	prometheus.MustRegister(quotesIssued)
+	prometheus.MustRegister(quotesUsed)
+	prometheus.MustRegister(revenue)
+	prometheus.MustRegister(surgeMultiplier)
 
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
+	// Probes can't present client certificates, so serve them here as well.
+	metricsMux.HandleFunc("/healthz", health.Healthz)
+	metricsMux.HandleFunc("/readyz", readiness.Readyz)
 
 	go func() {
 		slog.Info("Prometheus metrics endpoint running", "addr", ":2112")
@@ -391,8 +554,8 @@ func main() {
 		}
 	}()
 
-	slog.Info("DeliveryService running", "addr", ":8080")
-	if err := http.ListenAndServe(":8080", deliveryMux); err != nil {
+	slog.Info("DeliveryService running", "addr", ":8080", "mtls", certs != nil)
+	if err := tlsconfig.ListenAndServe(":8080", deliveryMux, certs); err != nil {
 		slog.Error("server error", "err", err)
 		os.Exit(1)
 	}
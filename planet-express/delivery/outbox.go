@@ -0,0 +1,448 @@
+// delivery-service/outbox.go
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OutboxEntry is an event waiting to be published. It stays in the outbox,
+// and on disk, until every consumer has acknowledged it.
+type OutboxEntry struct {
+	Seq         uint64       `json:"seq"`
+	Event       events.Event `json:"event"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	LastError   string       `json:"last_error,omitempty"`
+	// Acked are the consumers that have handled the event. Retries only go
+	// to the rest.
+	Acked []string `json:"acked,omitempty"`
+	// Parked entries ran out of attempts and wait for an admin to replay them.
+	Parked bool `json:"parked"`
+}
+
+// eventOutbox records delivery events before anything acts on them and
+// publishes them in the background, retrying with exponential backoff. Events
+// for the same package are published in the order they were added; a later
+// event waits while an earlier one is still being retried.
+type eventOutbox struct {
+	dir         string // one JSON file per entry; "" keeps entries in memory only
+	publish     func(ev events.Event, consumers []string) (acked []string, err error)
+	consumers   []string
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*OutboxEntry // by event ID
+	seq     uint64
+	wake    chan struct{}
+}
+
+var (
+	outboxDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_delivery_outbox_attempts_total",
+			Help: "The total number of outbox publish attempts, by result (published, retry, parked)",
+		},
+		[]string{"result"},
+	)
+)
+
+// newOutboxFromEnv reads OUTBOX_DIR, OUTBOX_MAX_ATTEMPTS, OUTBOX_MIN_BACKOFF
+// and OUTBOX_MAX_BACKOFF, and loads any entries left over from a previous run.
+// Each event is published until every one of consumers has acknowledged it.
+func newOutboxFromEnv(publish func(events.Event, []string) ([]string, error), consumers []string) (*eventOutbox, error) {
+	o := &eventOutbox{
+		dir:         os.Getenv("OUTBOX_DIR"),
+		publish:     publish,
+		consumers:   consumers,
+		maxAttempts: 20,
+		minBackoff:  time.Second,
+		maxBackoff:  5 * time.Minute,
+		entries:     make(map[string]*OutboxEntry),
+		wake:        make(chan struct{}, 1),
+	}
+	if val, err := strconv.Atoi(os.Getenv("OUTBOX_MAX_ATTEMPTS")); err == nil && val > 0 {
+		o.maxAttempts = val
+	}
+	if val, err := time.ParseDuration(os.Getenv("OUTBOX_MIN_BACKOFF")); err == nil && val > 0 {
+		o.minBackoff = val
+	}
+	if val, err := time.ParseDuration(os.Getenv("OUTBOX_MAX_BACKOFF")); err == nil && val > 0 {
+		o.maxBackoff = val
+	}
+
+	if o.dir == "" {
+		slog.Warn("OUTBOX_DIR not set; pending events will be lost on restart")
+		return o, nil
+	}
+	if err := os.MkdirAll(o.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	if len(o.entries) > 0 {
+		slog.Info("Loaded pending events from outbox", "count", len(o.entries), "dir", o.dir)
+	}
+	return o, nil
+}
+
+func (o *eventOutbox) load() error {
+	files, err := filepath.Glob(filepath.Join(o.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		var e OutboxEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("parsing %s: %w", f, err)
+		}
+		o.entries[e.Event.ID] = &e
+		o.seq = max(o.seq, e.Seq)
+	}
+	return nil
+}
+
+func (o *eventOutbox) path(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+// save writes e to disk, replacing any previous version atomically. The
+// caller must hold mu.
+func (o *eventOutbox) save(e *OutboxEntry) error {
+	if o.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(o.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), o.path(e.Event.ID))
+}
+
+// remove deletes an entry once it has been published. The caller must hold mu.
+func (o *eventOutbox) remove(id string) {
+	delete(o.entries, id)
+	if o.dir == "" {
+		return
+	}
+	if err := os.Remove(o.path(id)); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove outbox entry", "id", id, "err", err)
+	}
+}
+
+// add stamps ev with an ID and time and stores it. Once add returns nil the
+// event will be published eventually.
+func (o *eventOutbox) add(ev events.Event) error {
+	ev.ID = rand.Text()
+	ev.At = clock.Now()
+
+	// The entry's own timestamps are real time: they drive retries.
+	now := time.Now()
+	o.mu.Lock()
+	o.seq++
+	e := &OutboxEntry{Seq: o.seq, Event: ev, CreatedAt: now, NextAttempt: now}
+	err := o.save(e)
+	if err == nil {
+		o.entries[ev.ID] = e
+	}
+	parked := o.parkedAhead(e)
+	o.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("writing to outbox: %w", err)
+	}
+	if parked != nil {
+		slog.Warn("Event is held back behind a parked outbox entry until it is replayed", "id", ev.ID, "type", ev.Type,
+			"package_id", ev.PackageID, "flight_id", ev.FlightID, "parked_id", parked.Event.ID)
+	}
+
+	o.poke()
+	return nil
+}
+
+// poke wakes the publisher without waiting for its next tick.
+func (o *eventOutbox) poke() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *eventOutbox) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		}
+		o.publishDue()
+	}
+}
+
+// orderKey groups the entries that must be published in order: those for
+// the same package, or for flight-wide events the same flight.
+func orderKey(e *OutboxEntry) string {
+	if e.Event.PackageID == "" {
+		return "flight/" + e.Event.FlightID
+	}
+	return "package/" + e.Event.PackageID
+}
+
+// sorted returns the entries oldest first. The caller must hold mu.
+func (o *eventOutbox) sorted() []*OutboxEntry {
+	all := make([]*OutboxEntry, 0, len(o.entries))
+	for _, e := range o.entries {
+		all = append(all, e)
+	}
+	slices.SortFunc(all, func(a, b *OutboxEntry) int { return cmp.Compare(a.Seq, b.Seq) })
+	return all
+}
+
+// parkedAhead returns the parked entry e is queued behind, if any. The caller
+// must hold mu.
+func (o *eventOutbox) parkedAhead(e *OutboxEntry) *OutboxEntry {
+	for _, prev := range o.entries {
+		if prev.Parked && prev.Seq < e.Seq && orderKey(prev) == orderKey(e) {
+			return prev
+		}
+	}
+	return nil
+}
+
+// queuedBehind returns how many entries wait for e to be published. The
+// caller must hold mu.
+func (o *eventOutbox) queuedBehind(e *OutboxEntry) int {
+	n := 0
+	for _, next := range o.entries {
+		if next.Seq > e.Seq && orderKey(next) == orderKey(e) {
+			n++
+		}
+	}
+	return n
+}
+
+// due returns copies of the entries ready to publish, oldest first, skipping
+// any that are queued behind an earlier entry with the same orderKey.
+func (o *eventOutbox) due(now time.Time) []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocked := make(map[string]bool)
+	var due []OutboxEntry
+	for _, e := range o.sorted() {
+		key := orderKey(e)
+		if blocked[key] {
+			continue
+		}
+		blocked[key] = true
+		if !e.Parked && !e.NextAttempt.After(now) {
+			due = append(due, *e)
+		}
+	}
+	return due
+}
+
+func (o *eventOutbox) publishDue() {
+	for _, e := range o.due(time.Now()) {
+		consumers := slices.DeleteFunc(slices.Clone(o.consumers), func(c string) bool { return slices.Contains(e.Acked, c) })
+		acked, err := o.publish(e.Event, consumers)
+
+		o.mu.Lock()
+		cur, ok := o.entries[e.Event.ID]
+		switch {
+		case !ok:
+			// Removed while we were publishing.
+		case err == nil:
+			o.remove(e.Event.ID)
+			outboxDeliveries.WithLabelValues("published").Inc()
+		default:
+			cur.Acked = append(cur.Acked, acked...)
+			cur.Attempts++
+			cur.LastError = err.Error()
+			if cur.Attempts >= o.maxAttempts {
+				cur.Parked = true
+				outboxDeliveries.WithLabelValues("parked").Inc()
+				slog.Error("Giving up on outbox entry until replayed", "id", cur.Event.ID, "type", cur.Event.Type, "package_id", cur.Event.PackageID,
+					"acked", cur.Acked, "attempts", cur.Attempts, "held_back", o.queuedBehind(cur), "err", err)
+			} else {
+				cur.NextAttempt = time.Now().Add(o.backoff(cur.Attempts))
+				outboxDeliveries.WithLabelValues("retry").Inc()
+				slog.Warn("Failed to publish event, will retry", "id", cur.Event.ID, "type", cur.Event.Type, "package_id", cur.Event.PackageID, "acked", cur.Acked, "attempts", cur.Attempts, "next_attempt", cur.NextAttempt, "err", err)
+			}
+			if err := o.save(cur); err != nil {
+				slog.Error("Failed to update outbox entry", "id", cur.Event.ID, "err", err)
+			}
+		}
+		o.mu.Unlock()
+	}
+}
+
+// backoff doubles from minBackoff with each attempt up to maxBackoff, with up
+// to 20% jitter so a burst of failures doesn't retry in lockstep.
+func (o *eventOutbox) backoff(attempts int) time.Duration {
+	d := o.minBackoff << min(attempts-1, 30)
+	if d <= 0 || d > o.maxBackoff {
+		d = o.maxBackoff
+	}
+	return d + time.Duration(mrand.Int64N(int64(d)/5+1))
+}
+
+// pending returns the events still waiting in the outbox, parked or not.
+func (o *eventOutbox) pending() []events.Event {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := make([]events.Event, 0, len(o.entries))
+	for _, e := range o.entries {
+		list = append(list, e.Event)
+	}
+	return list
+}
+
+// stats returns the number of entries, how many are parked, how many are
+// held back behind a parked entry, and the age of the oldest.
+func (o *eventOutbox) stats() (depth, parked, blocked int, oldest time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	parkedKeys := make(map[string]bool)
+	for _, e := range o.sorted() {
+		depth++
+		key := orderKey(e)
+		switch {
+		case parkedKeys[key]:
+			blocked++
+		case e.Parked:
+			parked++
+			parkedKeys[key] = true
+		}
+		oldest = max(oldest, now.Sub(e.CreatedAt))
+	}
+	return depth, parked, blocked, oldest
+}
+
+func (o *eventOutbox) metrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		outboxDeliveries,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "planet_express_delivery_outbox_depth",
+			Help: "The number of events waiting in the outbox",
+		}, func() float64 {
+			depth, _, _, _ := o.stats()
+			return float64(depth)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "planet_express_delivery_outbox_parked",
+			Help: "The number of outbox events that ran out of attempts and wait to be replayed",
+		}, func() float64 {
+			_, parked, _, _ := o.stats()
+			return float64(parked)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "planet_express_delivery_outbox_blocked",
+			Help: "The number of outbox events held back behind a parked event for the same package or flight",
+		}, func() float64 {
+			_, _, blocked, _ := o.stats()
+			return float64(blocked)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "planet_express_delivery_outbox_oldest_age_seconds",
+			Help: "The age of the oldest event in the outbox",
+		}, func() float64 {
+			_, _, _, oldest := o.stats()
+			return oldest.Seconds()
+		}),
+	}
+}
+
+// listEntries serves GET /admin/outbox, oldest first. ?parked=true limits the
+// list to parked entries.
+func (o *eventOutbox) listEntries(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+	parkedOnly := r.URL.Query().Get("parked") == "true"
+
+	o.mu.Lock()
+	list := make([]OutboxEntry, 0, len(o.entries))
+	for _, e := range o.entries {
+		if !parkedOnly || e.Parked {
+			list = append(list, *e)
+		}
+	}
+	o.mu.Unlock()
+	slices.SortFunc(list, func(a, b OutboxEntry) int { return cmp.Compare(a.Seq, b.Seq) })
+
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// replayEntries serves POST /admin/outbox/replay. It retries the entry named
+// by ?id= straight away, or every parked entry when no id is given.
+func (o *eventOutbox) replayEntries(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+	id := r.URL.Query().Get("id")
+	now := time.Now()
+
+	o.mu.Lock()
+	replayed := make([]string, 0)
+	for _, e := range o.entries {
+		if (id == "" && e.Parked) || e.Event.ID == id {
+			e.Parked, e.Attempts, e.NextAttempt = false, 0, now
+			if err := o.save(e); err != nil {
+				slog.Error("Failed to update outbox entry", "id", e.Event.ID, "err", err)
+			}
+			replayed = append(replayed, e.Event.ID)
+		}
+	}
+	o.mu.Unlock()
+
+	if id != "" && len(replayed) == 0 {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
+		http.Error(w, fmt.Sprintf("No outbox entry %q", id), http.StatusNotFound)
+		return
+	}
+	slog.Info("Replaying outbox entries", "ids", replayed, "caller", r.Header.Get(callerHeader))
+	o.poke()
+
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusAccepted)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string][]string{"replayed": replayed})
+}
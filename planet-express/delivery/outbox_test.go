@@ -0,0 +1,197 @@
+// delivery-service/outbox_test.go
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+)
+
+func newTestOutbox(dir string, publish func(events.Event, []string) ([]string, error), consumers ...string) *eventOutbox {
+	return &eventOutbox{
+		dir:         dir,
+		publish:     publish,
+		consumers:   consumers,
+		maxAttempts: 3,
+		minBackoff:  time.Second,
+		maxBackoff:  time.Minute,
+		entries:     make(map[string]*OutboxEntry),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// addEntries adds an entry per event, in order, and returns their IDs.
+func addEntries(t *testing.T, o *eventOutbox, evs ...events.Event) []string {
+	t.Helper()
+	var ids []string
+	for _, ev := range evs {
+		if err := o.add(ev); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, o.sorted()[len(o.entries)-1].Event.ID)
+	}
+	return ids
+}
+
+func TestOutboxDue(t *testing.T) {
+	now := time.Now()
+	evs := []events.Event{
+		{Type: events.Dispatched, PackageID: "A", FlightID: "F1"},
+		{Type: events.Dispatched, PackageID: "B", FlightID: "F1"},
+		{Type: events.Completed, PackageID: "A", FlightID: "F1"},
+		{Type: events.Returned, FlightID: "F1"},
+		{Type: events.Returned, FlightID: "F2"},
+	}
+	tests := []struct {
+		name  string
+		setup func(o *eventOutbox, entries []*OutboxEntry)
+		want  []int // indexes into evs
+	}{
+		{"first per key", func(*eventOutbox, []*OutboxEntry) {}, []int{0, 1, 3, 4}},
+		{"waiting to retry holds back its key", func(_ *eventOutbox, e []*OutboxEntry) { e[0].NextAttempt = now.Add(time.Minute) }, []int{1, 3, 4}},
+		{"parked holds back its key", func(_ *eventOutbox, e []*OutboxEntry) { e[0].Parked = true }, []int{1, 3, 4}},
+		{"parked flight event", func(_ *eventOutbox, e []*OutboxEntry) { e[3].Parked = true }, []int{0, 1, 4}},
+		{"next in line once published", func(o *eventOutbox, e []*OutboxEntry) { delete(o.entries, e[0].Event.ID) }, []int{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOutbox("", nil)
+			ids := addEntries(t, o, evs...)
+			entries := make([]*OutboxEntry, len(ids))
+			for i, id := range ids {
+				o.entries[id].NextAttempt = now
+				entries[i] = o.entries[id]
+			}
+			tt.setup(o, entries)
+
+			var got []int
+			for _, e := range o.due(now) {
+				got = append(got, slices.Index(ids, e.Event.ID))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("due() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := newTestOutbox("", nil)
+	tests := []struct {
+		attempts int
+		base     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, tt := range tests {
+		for range 20 {
+			if got := o.backoff(tt.attempts); got < tt.base || got > tt.base+tt.base/5 {
+				t.Errorf("backoff(%d) = %s, want %s plus up to 20%%", tt.attempts, got, tt.base)
+			}
+		}
+	}
+}
+
+func TestOutboxPublishDue(t *testing.T) {
+	errDown := errors.New("down")
+	tests := []struct {
+		name string
+		// acks are the consumers that ack on each attempt; the rest fail.
+		acks        [][]string
+		wantSent    [][]string
+		wantAcked   []string
+		wantParked  bool
+		wantRemoved bool
+	}{
+		{
+			name:        "all ack",
+			acks:        [][]string{{"package", "crew", "ship"}},
+			wantSent:    [][]string{{"package", "crew", "ship"}},
+			wantRemoved: true,
+		},
+		{
+			name:        "retries only go to consumers that missed it",
+			acks:        [][]string{{"package", "ship"}, {"crew"}},
+			wantSent:    [][]string{{"package", "crew", "ship"}, {"crew"}},
+			wantRemoved: true,
+		},
+		{
+			name:       "parks after max attempts",
+			acks:       [][]string{{"package"}, {"ship"}, {}},
+			wantSent:   [][]string{{"package", "crew", "ship"}, {"crew", "ship"}, {"crew"}},
+			wantAcked:  []string{"package", "ship"},
+			wantParked: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent [][]string
+			publish := func(ev events.Event, consumers []string) ([]string, error) {
+				sent = append(sent, consumers)
+				acked := tt.acks[len(sent)-1]
+				if len(acked) == len(consumers) {
+					return acked, nil
+				}
+				return acked, errDown
+			}
+			o := newTestOutbox(t.TempDir(), publish, "package", "crew", "ship")
+			id := addEntries(t, o, events.Event{Type: events.Returned, FlightID: "F1"})[0]
+
+			for range tt.acks {
+				if e, ok := o.entries[id]; ok {
+					e.NextAttempt = time.Now()
+				}
+				o.publishDue()
+			}
+			if !slices.EqualFunc(sent, tt.wantSent, slices.Equal) {
+				t.Errorf("sent to %v, want %v", sent, tt.wantSent)
+			}
+
+			// Whatever is left must survive a restart.
+			reloaded := newTestOutbox(o.dir, publish)
+			if err := reloaded.load(); err != nil {
+				t.Fatal(err)
+			}
+			e, ok := reloaded.entries[id]
+			if ok == tt.wantRemoved {
+				t.Fatalf("entry still in the outbox = %v, want %v", ok, !tt.wantRemoved)
+			}
+			if !ok {
+				return
+			}
+			if !slices.Equal(e.Acked, tt.wantAcked) || e.Parked != tt.wantParked {
+				t.Errorf("entry acked by %v, parked %v, want %v, %v", e.Acked, e.Parked, tt.wantAcked, tt.wantParked)
+			}
+		})
+	}
+}
+
+func TestOutboxStats(t *testing.T) {
+	o := newTestOutbox("", nil)
+	ids := addEntries(t, o,
+		events.Event{Type: events.Dispatched, PackageID: "A"},
+		events.Event{Type: events.Completed, PackageID: "A"},
+		events.Event{Type: events.Dispatched, PackageID: "B"},
+		events.Event{Type: events.Returned, FlightID: "F1"},
+	)
+	o.entries[ids[0]].Parked = true
+
+	depth, parked, blocked, _ := o.stats()
+	if depth != 4 || parked != 1 || blocked != 1 {
+		t.Errorf("stats() = depth %d, parked %d, blocked %d, want 4, 1, 1", depth, parked, blocked)
+	}
+	if n := o.queuedBehind(o.entries[ids[0]]); n != 1 {
+		t.Errorf("queuedBehind() = %d, want 1", n)
+	}
+	if p := o.parkedAhead(o.entries[ids[1]]); p == nil || p.Event.ID != ids[0] {
+		t.Errorf("parkedAhead() = %v, want entry %s", p, ids[0])
+	}
+}
@@ -0,0 +1,304 @@
+// delivery-service/pricing.go
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/env"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Priorities a delivery can be sent at. Express deliveries skip batching.
+const (
+	priorityEconomy  = "economy"
+	priorityStandard = "standard"
+	priorityExpress  = "express"
+)
+
+var (
+	// Prices are in dollars: a base fee plus a rate per light-year, scaled
+	// by priority, hazard and surge.
+	baseFee    = env.Float("PRICE_BASE_FEE", 10)
+	ratePerLY  = env.Float("PRICE_PER_LY", 1.5)
+	priorities = map[string]float64{
+		priorityEconomy:  0.8,
+		priorityStandard: 1,
+		priorityExpress:  1.5,
+	}
+	// Surge pricing starts once more than surgeThreshold of the fleet is
+	// busy, rising linearly to maxSurge when every ship is.
+	surgeThreshold = env.Float("PRICE_SURGE_THRESHOLD", 0.5)
+	maxSurge       = env.Float("PRICE_MAX_SURGE", 2)
+
+	quotes = newQuoteBook(env.Duration("QUOTE_TTL", 5*time.Minute))
+	surges = newSurgeCache(env.Duration("SURGE_REFRESH_INTERVAL", 15*time.Second))
+
+	errQuoteNotFound = errors.New("Unknown quote_id")
+
+	quotesIssued = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "planet_express_delivery_quotes_issued_total",
+			Help: "The total number of delivery quotes issued",
+		},
+	)
+
+	quotesUsed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_delivery_quotes_used_total",
+			Help: "The total number of quotes referenced by delivery requests, by result (accepted, expired, in_use, mismatched, released, unknown, wrong_caller)",
+		},
+		[]string{"result"},
+	)
+
+	revenue = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_delivery_revenue_dollars_total",
+			Help: "The total charged for settled deliveries, by priority and hazard class. Failed deliveries are refunded and cancelled ones never charged, so neither counts",
+		},
+		[]string{"priority", "hazard_class"},
+	)
+
+	surgeMultiplier = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "planet_express_delivery_surge_multiplier",
+			Help: "The surge multiplier prices are currently worked out with",
+		},
+	)
+)
+
+// PriceBreakdown shows how a price was worked out.
+type PriceBreakdown struct {
+	BaseFee     float64 `json:"base_fee"`
+	DistanceLY  float64 `json:"distance_ly"`
+	DistanceFee float64 `json:"distance_fee"`
+	Priority    float64 `json:"priority_multiplier"`
+	Hazard      float64 `json:"hazard_multiplier"`
+	Surge       float64 `json:"surge_multiplier"`
+}
+
+// Quote is a price for a delivery, held until ExpiresAt. It can be used
+// once, by the caller it was issued to, for a delivery request for the same
+// cargo to the same address at the same priority.
+type Quote struct {
+	ID        string          `json:"id"`
+	Price     float64         `json:"price"`
+	Breakdown PriceBreakdown  `json:"breakdown"`
+	Request   DeliveryRequest `json:"request"`
+	ExpiresAt time.Time       `json:"expires_at"`
+
+	caller   string // who asked for the quote; only they can use it
+	reserved bool   // by a delivery request that hasn't been dispatched yet
+}
+
+// price works out what req costs with the fleet utilisation as it stands.
+func price(req DeliveryRequest) (float64, PriceBreakdown) {
+	b := PriceBreakdown{
+		BaseFee:    baseFee,
+		DistanceLY: calcDistance(req.Address),
+		Priority:   priorities[req.Priority],
+		Hazard:     hazardMultiplier(req.Hazard),
+		Surge:      surges.current(),
+	}
+	b.DistanceFee = b.DistanceLY * ratePerLY
+	total := (b.BaseFee + b.DistanceFee) * b.Priority * b.Hazard * b.Surge
+	return math.Round(total*100) / 100, b
+}
+
+// surgeCache holds the surge multiplier, so pricing doesn't ask
+// ship-service about the whole fleet for every quote and delivery request.
+// run refreshes it every interval.
+type surgeCache struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	multiplier float64
+}
+
+func newSurgeCache(interval time.Duration) *surgeCache {
+	return &surgeCache{interval: interval, multiplier: 1}
+}
+
+func (sc *surgeCache) run() {
+	slog.Info("Surge pricing refresh running", "interval", sc.interval)
+	sc.refresh()
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sc.refresh()
+	}
+}
+
+func (sc *surgeCache) refresh() {
+	m := surge()
+	sc.mu.Lock()
+	sc.multiplier = m
+	sc.mu.Unlock()
+	surgeMultiplier.Set(m)
+}
+
+// current is the multiplier as of the last refresh.
+func (sc *surgeCache) current() float64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.multiplier
+}
+
+// surge is the price multiplier for how busy the fleet is. It is 1 if
+// ship-service can't be asked.
+func surge() float64 {
+	var fleet []struct {
+		Available        bool       `json:"available"`
+		MaintenanceUntil *time.Time `json:"maintenance_until"`
+	}
+	if err := getJSON(shipServiceURL+"/ships", &fleet); err != nil || len(fleet) == 0 {
+		slog.Warn("Unable to check fleet utilisation, not surge pricing", "err", err)
+		return 1
+	}
+	busy := 0
+	for _, s := range fleet {
+		if !s.Available || s.MaintenanceUntil != nil {
+			busy++
+		}
+	}
+	utilisation := float64(busy) / float64(len(fleet))
+	m := 1.0
+	if utilisation > surgeThreshold && surgeThreshold < 1 {
+		m += (maxSurge - 1) * (utilisation - surgeThreshold) / (1 - surgeThreshold)
+	}
+	return m
+}
+
+// earn counts pkg's charge as revenue once it has settled: delivered, or
+// brought back after its sender recalled it. This matches what the billing
+// ledger in package-service keeps.
+func earn(pkg Package) {
+	revenue.WithLabelValues(pkg.Priority, cmp.Or(pkg.Hazard, "none")).Add(pkg.Charge)
+}
+
+// validatePriority defaults req's priority to standard and rejects ones
+// that don't exist.
+func validatePriority(req *DeliveryRequest) error {
+	if req.Priority == "" {
+		req.Priority = priorityStandard
+	}
+	if _, ok := priorities[req.Priority]; !ok {
+		return fmt.Errorf("Unknown priority %q; use %s, %s or %s", req.Priority, priorityEconomy, priorityStandard, priorityExpress)
+	}
+	return nil
+}
+
+// quoteBook holds the quotes that haven't been used or expired.
+type quoteBook struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	quotes map[string]Quote
+}
+
+func newQuoteBook(ttl time.Duration) *quoteBook {
+	return &quoteBook{ttl: ttl, quotes: make(map[string]Quote)}
+}
+
+// issue prices req for caller and holds the price for the book's TTL.
+func (qb *quoteBook) issue(req DeliveryRequest, caller string) Quote {
+	q := Quote{ID: "Q-" + rand.Text()[:12], Request: req, ExpiresAt: clock.Now().Add(qb.ttl), caller: caller}
+	q.Price, q.Breakdown = price(req)
+
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	now := clock.Now()
+	for id, old := range qb.quotes {
+		if now.After(old.ExpiresAt) {
+			delete(qb.quotes, id)
+		}
+	}
+	qb.quotes[q.ID] = q
+	quotesIssued.Inc()
+	return q
+}
+
+// reserve holds quote id for req from caller while req is dispatched. The
+// caller then commits the quote if req flies, which uses it up, or releases
+// it if req doesn't, so it can be used again.
+func (qb *quoteBook) reserve(id string, req DeliveryRequest, caller string) (Quote, int, error) {
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	q, ok := qb.quotes[id]
+	switch {
+	case !ok:
+		quotesUsed.WithLabelValues("unknown").Inc()
+		return Quote{}, http.StatusBadRequest, errQuoteNotFound
+	case q.caller != caller:
+		quotesUsed.WithLabelValues("wrong_caller").Inc()
+		return Quote{}, http.StatusForbidden, fmt.Errorf("Quote %s was issued to someone else", id)
+	case q.reserved:
+		quotesUsed.WithLabelValues("in_use").Inc()
+		return Quote{}, http.StatusConflict, fmt.Errorf("Quote %s is already being used by another delivery request", id)
+	case clock.Now().After(q.ExpiresAt):
+		delete(qb.quotes, id)
+		quotesUsed.WithLabelValues("expired").Inc()
+		return Quote{}, http.StatusGone, fmt.Errorf("Quote %s expired at %s", id, q.ExpiresAt.Format(time.RFC3339))
+	}
+	quoted := q.Request
+	quoted.Recipient, quoted.Contents, quoted.QuoteID = req.Recipient, req.Contents, req.QuoteID
+	if quoted != req {
+		quotesUsed.WithLabelValues("mismatched").Inc()
+		return Quote{}, http.StatusBadRequest, fmt.Errorf("Quote %s is for a different delivery; address, priority and cargo must match", id)
+	}
+	q.reserved = true
+	qb.quotes[id] = q
+	return q, http.StatusOK, nil
+}
+
+// commit uses up reserved quote id.
+func (qb *quoteBook) commit(id string) {
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	delete(qb.quotes, id)
+	quotesUsed.WithLabelValues("accepted").Inc()
+}
+
+// release makes reserved quote id available again, until it expires.
+func (qb *quoteBook) release(id string) {
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	if q, ok := qb.quotes[id]; ok {
+		q.reserved = false
+		qb.quotes[id] = q
+	}
+	quotesUsed.WithLabelValues("released").Inc()
+}
+
+// handleQuote serves POST /quotes, pricing a prospective delivery request.
+func handleQuote(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+
+	var req DeliveryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+		return
+	}
+	req.QuoteID = ""
+	if err := errors.Join(validateCargo(&req), validatePriority(&req)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+		return
+	}
+
+	q := quotes.issue(req, r.Header.Get(callerHeader))
+	slog.Info("Quote issued", "quote_id", q.ID, "price", q.Price, "surge", q.Breakdown.Surge, "caller", r.Header.Get(callerHeader))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(q)
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusCreated)).Inc()
+}
@@ -0,0 +1,246 @@
+// delivery-service/pricing_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/sim"
+)
+
+// fixedClock is a clock for tests that only moves when told to.
+type fixedClock struct {
+	sim.RealClock
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time { return c.now }
+
+// useClock replaces clock for the rest of t.
+func useClock(t *testing.T, now time.Time) *fixedClock {
+	t.Helper()
+	c := &fixedClock{now: now}
+	prev := clock
+	clock = c
+	t.Cleanup(func() { clock = prev })
+	return c
+}
+
+// withFleet serves busy of total ships as busy from a fake ship-service for
+// the rest of t. A negative total makes ship-service fail.
+func withFleet(t *testing.T, busy, total int) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if total < 0 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fleet := make([]ShipInfo, total)
+		for i := range fleet {
+			fleet[i].Available = i >= busy
+		}
+		json.NewEncoder(w).Encode(fleet)
+	}))
+	prev := shipServiceURL
+	shipServiceURL = srv.URL
+	t.Cleanup(func() {
+		shipServiceURL = prev
+		srv.Close()
+	})
+}
+
+// useSurge replaces surges with one refreshed from the current fleet for
+// the rest of t.
+func useSurge(t *testing.T) {
+	t.Helper()
+	prev := surges
+	surges = newSurgeCache(time.Minute)
+	surges.refresh()
+	t.Cleanup(func() { surges = prev })
+}
+
+func TestSurge(t *testing.T) {
+	tests := []struct {
+		name        string
+		busy, total int
+		want        float64
+	}{
+		{"idle fleet", 0, 4, 1},
+		{"at the threshold", 2, 4, 1},
+		{"halfway up", 3, 4, 1.5},
+		{"every ship busy", 4, 4, maxSurge},
+		{"no ships", 0, 0, 1},
+		{"ship-service down", 0, -1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFleet(t, tt.busy, tt.total)
+			sc := newSurgeCache(time.Minute)
+			sc.refresh()
+			if got := sc.current(); got != tt.want {
+				t.Errorf("surge = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrice(t *testing.T) {
+	tests := []struct {
+		name string
+		req  DeliveryRequest
+		busy int
+		want float64
+	}{
+		// (10 + 25 * 1.5) = 47.5 to Mars Vegas before multipliers.
+		{"standard", DeliveryRequest{Address: "Mars Vegas", Priority: priorityStandard}, 0, 47.5},
+		{"economy", DeliveryRequest{Address: "Mars Vegas", Priority: priorityEconomy}, 0, 38},
+		{"express", DeliveryRequest{Address: "Mars Vegas", Priority: priorityExpress}, 0, 71.25},
+		{"hazardous", DeliveryRequest{Address: "Mars Vegas", Priority: priorityStandard, Hazard: "exotic"}, 0, 118.75},
+		{"surge", DeliveryRequest{Address: "Mars Vegas", Priority: priorityStandard}, 4, 95},
+		{"rounded to the cent", DeliveryRequest{Address: "Luna Park", Priority: priorityExpress, Hazard: "flammable"}, 3, 109.69},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFleet(t, tt.busy, 4)
+			useSurge(t)
+			got, b := price(tt.req)
+			if got != tt.want {
+				t.Errorf("price() = %v (%+v), want %v", got, b, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoteBookReserve(t *testing.T) {
+	withFleet(t, 0, 4)
+	useSurge(t)
+	c := useClock(t, time.Unix(1_700_000_000, 0))
+	quoted := DeliveryRequest{Recipient: "Fry", Address: "Mars Vegas", Contents: "Slurm", WeightKG: 1, VolumeM3: 0.01, Priority: priorityStandard}
+
+	tests := []struct {
+		name     string
+		id       string // the issued quote's ID if empty
+		req      func(DeliveryRequest) DeliveryRequest
+		caller   string
+		after    time.Duration
+		wantCode int
+	}{
+		{"accepted", "", func(r DeliveryRequest) DeliveryRequest { return r }, "hermes", 0, http.StatusOK},
+		{"recipient and contents may change", "", func(r DeliveryRequest) DeliveryRequest {
+			r.Recipient, r.Contents = "Leela", "Popplers"
+			return r
+		}, "hermes", 0, http.StatusOK},
+		{"unknown quote", "Q-NOPE", func(r DeliveryRequest) DeliveryRequest { return r }, "hermes", 0, http.StatusBadRequest},
+		{"someone else's quote", "", func(r DeliveryRequest) DeliveryRequest { return r }, "zapp", 0, http.StatusForbidden},
+		{"expired", "", func(r DeliveryRequest) DeliveryRequest { return r }, "hermes", time.Hour, http.StatusGone},
+		{"different address", "", func(r DeliveryRequest) DeliveryRequest {
+			r.Address = "Neptune"
+			return r
+		}, "hermes", 0, http.StatusBadRequest},
+		{"different priority", "", func(r DeliveryRequest) DeliveryRequest {
+			r.Priority = priorityEconomy
+			return r
+		}, "hermes", 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.now = time.Unix(1_700_000_000, 0)
+			qb := newQuoteBook(5 * time.Minute)
+			q := qb.issue(quoted, "hermes")
+			id := tt.id
+			if id == "" {
+				id = q.ID
+			}
+			req := tt.req(quoted)
+			req.QuoteID = id
+			c.now = c.now.Add(tt.after)
+
+			got, code, err := qb.reserve(id, req, tt.caller)
+			if code != tt.wantCode || (err == nil) != (code == http.StatusOK) {
+				t.Fatalf("reserve() = %d, %v, want %d", code, err, tt.wantCode)
+			}
+			if code == http.StatusOK && got.Price != q.Price {
+				t.Errorf("reserve() price = %v, want the quoted %v", got.Price, q.Price)
+			}
+		})
+	}
+}
+
+func TestQuoteBookLifecycle(t *testing.T) {
+	withFleet(t, 0, 4)
+	useSurge(t)
+	useClock(t, time.Unix(1_700_000_000, 0))
+	req := DeliveryRequest{Recipient: "Fry", Address: "Mars Vegas", Contents: "Slurm", WeightKG: 1, VolumeM3: 0.01, Priority: priorityStandard}
+
+	tests := []struct {
+		name  string
+		steps []string // "reserve", "commit" or "release"
+		want  []int    // status code of each reserve
+	}{
+		{"in use until settled", []string{"reserve", "reserve"}, []int{http.StatusOK, http.StatusConflict}},
+		{"released for another try", []string{"reserve", "release", "reserve"}, []int{http.StatusOK, http.StatusOK}},
+		{"used up once committed", []string{"reserve", "commit", "reserve"}, []int{http.StatusOK, http.StatusBadRequest}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := newQuoteBook(5 * time.Minute)
+			q := qb.issue(req, "hermes")
+			req := req
+			req.QuoteID = q.ID
+			var got []int
+			for _, step := range tt.steps {
+				switch step {
+				case "reserve":
+					_, code, _ := qb.reserve(q.ID, req, "hermes")
+					got = append(got, code)
+				case "commit":
+					qb.commit(q.ID)
+				case "release":
+					qb.release(q.ID)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("reserve() codes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleDeliveryQuote(t *testing.T) {
+	tests := []struct {
+		name     string
+		noCrew   bool
+		wantCode int
+		wantLeft int // status code of reserving the quote again afterwards
+	}{
+		{"used up once the package flies", false, http.StatusOK, http.StatusBadRequest},
+		{"kept when the package can't fly", true, http.StatusServiceUnavailable, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServices(t, tt.noCrew)
+			prevQuotes, prevBatches := quotes, batches
+			quotes, batches = newQuoteBook(5*time.Minute), &batcher{capacity: 4, maxWeight: 200, maxVolume: 2}
+			t.Cleanup(func() { quotes, batches = prevQuotes, prevBatches })
+
+			req := DeliveryRequest{Recipient: "Fry", Address: "Mars Vegas", Contents: "Slurm", WeightKG: 1, VolumeM3: 0.01, Priority: priorityStandard}
+			req.QuoteID = quotes.issue(req, "hermes").ID
+			body, _ := json.Marshal(req)
+			r := httptest.NewRequest(http.MethodPost, "/deliveries", bytes.NewReader(body))
+			r.Header.Set(callerHeader, "hermes")
+			w := httptest.NewRecorder()
+			handleDelivery(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if _, code, _ := quotes.reserve(req.QuoteID, req, "hermes"); code != tt.wantLeft {
+				t.Errorf("reserving the quote again = %d, want %d", code, tt.wantLeft)
+			}
+		})
+	}
+}
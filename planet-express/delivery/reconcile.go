@@ -0,0 +1,274 @@
+// delivery-service/reconcile.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of drift the reconciler looks for.
+const (
+	driftOrphanedCrew   = "orphaned_crew"   // reserved, but not on any delivery
+	driftOrphanedShip   = "orphaned_ship"   // reserved, but not on any delivery
+	driftStalePending   = "stale_pending"   // package never dispatched
+	driftOverduePackage = "overdue_package" // in-transit long past its ETA with no flight running
+)
+
+var (
+	driftKinds = []string{driftOrphanedCrew, driftOrphanedShip, driftStalePending, driftOverduePackage}
+
+	reconcileDrift = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "planet_express_delivery_reconcile_drift",
+			Help: "The number of discrepancies between crew, ship and package state found by the last reconcile pass, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	reconcileRepairs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_delivery_reconcile_repairs_total",
+			Help: "The total number of discrepancies the reconciler tried to repair, by kind and result (ok, error)",
+		},
+		[]string{"kind", "result"},
+	)
+
+	reconcileRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_delivery_reconcile_runs_total",
+			Help: "The total number of reconcile passes, by result (ok, error)",
+		},
+		[]string{"result"},
+	)
+)
+
+// discrepancy is one piece of drift. Name is the crew member, ship or
+// package ID it concerns.
+type discrepancy struct {
+	Kind string
+	Name string
+}
+
+// reconciler periodically compares crew and ship reservations with package
+// statuses and the flights this service is running. A discrepancy has to
+// show up on two passes in a row before it is reported or repaired, so
+// state changing between the calls of a single pass isn't mistaken for
+// drift.
+//
+// Repair only takes the local view of this replica into account: another
+// replica's flights, outbox and batches look like drift, and would be
+// failed or released out from under it. newReconcilerFromEnv refuses to
+// repair unless DELIVERY_REPLICAS says this is the only one.
+type reconciler struct {
+	interval       time.Duration
+	pendingTimeout time.Duration
+	overdueGrace   time.Duration
+	repair         bool
+
+	suspects map[discrepancy]bool // found on the previous pass
+}
+
+// newReconcilerFromEnv reads RECONCILE_INTERVAL (default 30s, 0 disables),
+// RECONCILE_PENDING_TIMEOUT, RECONCILE_OVERDUE_GRACE and RECONCILE_REPAIR.
+// RECONCILE_REPAIR is an error when DELIVERY_REPLICAS is more than 1.
+func newReconcilerFromEnv() (*reconciler, error) {
+	rc := &reconciler{
+		interval:       30 * time.Second,
+		pendingTimeout: 2 * time.Minute,
+		overdueGrace:   2 * time.Minute,
+		suspects:       make(map[discrepancy]bool),
+	}
+	if val, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil {
+		rc.interval = val
+	}
+	if val, err := time.ParseDuration(os.Getenv("RECONCILE_PENDING_TIMEOUT")); err == nil && val > 0 {
+		rc.pendingTimeout = val
+	}
+	if val, err := time.ParseDuration(os.Getenv("RECONCILE_OVERDUE_GRACE")); err == nil && val > 0 {
+		rc.overdueGrace = val
+	}
+	rc.repair, _ = strconv.ParseBool(os.Getenv("RECONCILE_REPAIR"))
+	replicas, err := strconv.Atoi(getEnv("DELIVERY_REPLICAS", "1"))
+	if err != nil || replicas < 1 {
+		return nil, fmt.Errorf("DELIVERY_REPLICAS must be a positive number, got %q", os.Getenv("DELIVERY_REPLICAS"))
+	}
+	if rc.repair && replicas > 1 {
+		return nil, fmt.Errorf("RECONCILE_REPAIR needs a single delivery-service replica, DELIVERY_REPLICAS is %d", replicas)
+	}
+	return rc, nil
+}
+
+func (rc *reconciler) run() {
+	if rc.interval <= 0 {
+		slog.Info("Reconciler disabled")
+		return
+	}
+	slog.Info("Reconciler running", "interval", rc.interval, "repair", rc.repair)
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := rc.reconcile(); err != nil {
+			reconcileRuns.WithLabelValues("error").Inc()
+			slog.Error("Reconcile pass failed", "err", err)
+			continue
+		}
+		reconcileRuns.WithLabelValues("ok").Inc()
+	}
+}
+
+// crewStatus is the part of crew-service's GET /crew response we need.
+type crewStatus struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+}
+
+func (rc *reconciler) reconcile() error {
+	// Take the local view first: anything dispatched after this shows up as
+	// reserved but unassigned for at most one pass.
+	busy := make(map[string]bool) // "crew/Fry", "ship/...", "package/..."
+	for _, f := range flights.list() {
+		busy["crew/"+f.Crew], busy["ship/"+f.Ship] = true, true
+		for _, id := range f.PackageIDs {
+			busy["package/"+id] = true
+		}
+	}
+	for _, ev := range outbox.pending() {
+		busy["crew/"+ev.Crew], busy["ship/"+ev.Ship], busy["package/"+ev.PackageID] = true, true, true
+	}
+	for _, id := range batches.queued() {
+		busy["package/"+id] = true
+	}
+
+	var crew []crewStatus
+	if err := getJSON(crewServiceURL+"/crew", &crew); err != nil {
+		return fmt.Errorf("listing crew: %w", err)
+	}
+	var ships []ShipInfo
+	if err := getJSON(shipServiceURL+"/ships", &ships); err != nil {
+		return fmt.Errorf("listing ships: %w", err)
+	}
+	pkgs, err := listActivePackages()
+	if err != nil {
+		return fmt.Errorf("listing packages: %w", err)
+	}
+
+	now := clock.Now()
+	var found []discrepancy
+	for _, p := range pkgs {
+		if p.Status == "in-transit" {
+			busy["crew/"+p.Crew], busy["ship/"+p.Ship] = true, true
+		}
+		if busy["package/"+p.ID] {
+			continue
+		}
+		switch {
+		case p.Status == "pending" && now.Sub(p.CreatedAt) > rc.pendingTimeout:
+			found = append(found, discrepancy{Kind: driftStalePending, Name: p.ID})
+		case p.Status == "in-transit" && p.ETA != nil && now.Sub(*p.ETA) > rc.overdueGrace:
+			found = append(found, discrepancy{Kind: driftOverduePackage, Name: p.ID})
+		}
+	}
+	for _, c := range crew {
+		if !c.Available && !busy["crew/"+c.Name] {
+			found = append(found, discrepancy{Kind: driftOrphanedCrew, Name: c.Name})
+		}
+	}
+	for _, s := range ships {
+		if !s.Available && !busy["ship/"+s.Name] {
+			found = append(found, discrepancy{Kind: driftOrphanedShip, Name: s.Name})
+		}
+	}
+
+	counts := make(map[string]int)
+	suspects := make(map[discrepancy]bool, len(found))
+	for _, d := range found {
+		suspects[d] = true
+		if !rc.suspects[d] {
+			continue
+		}
+		counts[d.Kind]++
+		slog.Warn("Found drift", "kind", d.Kind, "name", d.Name, "repair", rc.repair)
+		if rc.repair {
+			rc.fix(d)
+		}
+	}
+	rc.suspects = suspects
+	for _, kind := range driftKinds {
+		reconcileDrift.WithLabelValues(kind).Set(float64(counts[kind]))
+	}
+	return nil
+}
+
+// fix releases orphaned reservations and fails abandoned packages. Failures
+// go through the outbox like any other, so every consumer hears of them and
+// the package gets an incident report. A failed overdue package leaves its
+// crew and ship unassigned, so they are released on a later pass.
+func (rc *reconciler) fix(d discrepancy) {
+	var err error
+	switch d.Kind {
+	case driftOrphanedCrew:
+		err = returnCrew(CrewReturn{Name: d.Name})
+	case driftOrphanedShip:
+		err = returnShip(ShipReturn{Name: d.Name})
+	case driftStalePending, driftOverduePackage:
+		incident := reconcilerIncident(d)
+		ev := events.Event{Type: events.Failed, PackageID: d.Name, Reason: incident.Reason, Incident: incident}
+		if err = outbox.add(ev); err != nil {
+			_, err = updatePackageStatus(PackageStatusUpdate{ID: d.Name, Status: "failed", Incident: incident})
+		}
+	}
+	if err != nil {
+		reconcileRepairs.WithLabelValues(d.Kind, "error").Inc()
+		slog.Error("Failed to repair drift", "kind", d.Kind, "name", d.Name, "err", err)
+		return
+	}
+	reconcileRepairs.WithLabelValues(d.Kind, "ok").Inc()
+	slog.Info("Repaired drift", "kind", d.Kind, "name", d.Name)
+}
+
+// listActivePackages pages through every pending and in-transit package.
+func listActivePackages() ([]Package, error) {
+	var all []Package
+	cursor := ""
+	for {
+		q := url.Values{"status": {"pending,in-transit"}, "limit": {"500"}}
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		var page struct {
+			Packages   []Package `json:"packages"`
+			NextCursor string    `json:"next_cursor"`
+		}
+		if err := getJSON(packageServiceURL+"/packages?"+q.Encode(), &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Packages...)
+		if page.NextCursor == "" {
+			return all, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+func getJSON(url string, v any) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s returned %d: %s", url, resp.StatusCode, bodyBytes)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
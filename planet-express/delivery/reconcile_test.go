@@ -0,0 +1,234 @@
+// delivery-service/reconcile_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fleet is a fake crew-, ship- and package-service.
+type fleet struct {
+	crew  []crewStatus
+	ships []ShipInfo
+	pkgs  []Package
+}
+
+// useFleet points the service URLs at f for the rest of t, and gives the
+// reconciler an empty outbox, flight registry and batcher to look at. It
+// returns the repairs f has been asked for so far: "crew/Fry",
+// "ship/Nimbus" or "package/P1 failed".
+func useFleet(t *testing.T, f fleet) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var repairs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/crew":
+			json.NewEncoder(w).Encode(f.crew)
+		case "/ships":
+			json.NewEncoder(w).Encode(f.ships)
+		case "/packages":
+			json.NewEncoder(w).Encode(map[string]any{"packages": f.pkgs})
+		case "/crew/return", "/ship/return":
+			var body struct{ Name string }
+			json.NewDecoder(r.Body).Decode(&body)
+			repairs = append(repairs, r.URL.Path[1:5]+"/"+body.Name)
+		case "/packages/update":
+			var update PackageStatusUpdate
+			json.NewDecoder(r.Body).Decode(&update)
+			repairs = append(repairs, "package/"+update.ID+" "+update.Status)
+			json.NewEncoder(w).Encode(Package{ID: update.ID, Status: update.Status})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	prevCrew, prevShip, prevPackage := crewServiceURL, shipServiceURL, packageServiceURL
+	prevOutbox, prevFlights, prevBatches := outbox, flights, batches
+	crewServiceURL, shipServiceURL, packageServiceURL = srv.URL, srv.URL, srv.URL
+	outbox, flights, batches = newTestOutbox("", nil), &flightRegistry{flights: make(map[string]Flight)}, &batcher{}
+	t.Cleanup(func() {
+		crewServiceURL, shipServiceURL, packageServiceURL = prevCrew, prevShip, prevPackage
+		outbox, flights, batches = prevOutbox, prevFlights, prevBatches
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Sorted(slices.Values(repairs))
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	longAgo, overdue := now.Add(-time.Hour), now.Add(-time.Hour)
+	tests := []struct {
+		name       string
+		fleet      fleet
+		flight     *Flight       // running in this process
+		queued     *events.Event // waiting in the outbox
+		passes     int
+		repair     bool
+		outboxDown bool
+		wantDrift  map[string]float64
+		wantRepair []string
+		wantFailed []string // "P1 never dispatched", queued in the outbox
+	}{
+		{
+			name:      "orphaned crew and ship",
+			fleet:     fleet{crew: []crewStatus{{Name: "Fry"}, {Name: "Leela", Available: true}}, ships: []ShipInfo{{Name: "Nimbus"}}},
+			passes:    2,
+			wantDrift: map[string]float64{driftOrphanedCrew: 1, driftOrphanedShip: 1},
+		},
+		{
+			name:       "repaired",
+			fleet:      fleet{crew: []crewStatus{{Name: "Fry"}}, ships: []ShipInfo{{Name: "Nimbus"}}},
+			passes:     2,
+			repair:     true,
+			wantDrift:  map[string]float64{driftOrphanedCrew: 1, driftOrphanedShip: 1},
+			wantRepair: []string{"crew/Fry", "ship/Nimbus"},
+		},
+		{
+			name:      "only seen once",
+			fleet:     fleet{crew: []crewStatus{{Name: "Fry"}}},
+			passes:    1,
+			repair:    true,
+			wantDrift: map[string]float64{},
+		},
+		{
+			name:      "on a flight",
+			fleet:     fleet{crew: []crewStatus{{Name: "Fry"}}, ships: []ShipInfo{{Name: "Nimbus"}}, pkgs: []Package{{ID: "P1", Status: "in-transit", ETA: &overdue}}},
+			flight:    &Flight{ID: "FL-1", PackageIDs: []string{"P1"}, Crew: "Fry", Ship: "Nimbus"},
+			passes:    2,
+			wantDrift: map[string]float64{},
+		},
+		{
+			name:      "outcome waiting in the outbox",
+			fleet:     fleet{crew: []crewStatus{{Name: "Fry"}}, ships: []ShipInfo{{Name: "Nimbus"}}},
+			queued:    &events.Event{Type: events.Completed, PackageID: "P1", Crew: "Fry", Ship: "Nimbus"},
+			passes:    2,
+			wantDrift: map[string]float64{},
+		},
+		{
+			name: "in-transit package holds its crew and ship",
+			fleet: fleet{crew: []crewStatus{{Name: "Fry"}}, ships: []ShipInfo{{Name: "Nimbus"}},
+				pkgs: []Package{{ID: "P1", Status: "in-transit", Crew: "Fry", Ship: "Nimbus", ETA: &now}}},
+			passes:    2,
+			wantDrift: map[string]float64{},
+		},
+		{
+			name: "stale and overdue packages failed",
+			fleet: fleet{pkgs: []Package{
+				{ID: "P1", Status: "pending", CreatedAt: longAgo},
+				{ID: "P2", Status: "pending", CreatedAt: now},
+				{ID: "P3", Status: "in-transit", ETA: &overdue},
+			}},
+			passes:     2,
+			repair:     true,
+			wantDrift:  map[string]float64{driftStalePending: 1, driftOverduePackage: 1},
+			wantFailed: []string{"P1 never dispatched", "P3 overdue with no flight running"},
+		},
+		{
+			name:       "failed directly when the outbox is down",
+			fleet:      fleet{pkgs: []Package{{ID: "P1", Status: "pending", CreatedAt: longAgo}}},
+			passes:     2,
+			repair:     true,
+			outboxDown: true,
+			wantDrift:  map[string]float64{driftStalePending: 1},
+			wantRepair: []string{"package/P1 failed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repairs := useFleet(t, tt.fleet)
+			if tt.flight != nil {
+				flights.add(*tt.flight, FlightPlan{}, nil)
+			}
+			if tt.queued != nil {
+				outbox.add(*tt.queued)
+			}
+			if tt.outboxDown {
+				outbox.dir = filepath.Join(t.TempDir(), "missing")
+			}
+			rc := &reconciler{
+				pendingTimeout: time.Minute,
+				overdueGrace:   time.Minute,
+				repair:         tt.repair,
+				suspects:       make(map[discrepancy]bool),
+			}
+			for range tt.passes {
+				if err := rc.reconcile(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, kind := range driftKinds {
+				if got := testutil.ToFloat64(reconcileDrift.WithLabelValues(kind)); got != tt.wantDrift[kind] {
+					t.Errorf("%s drift = %v, want %v", kind, got, tt.wantDrift[kind])
+				}
+			}
+			if got := repairs(); !slices.Equal(got, tt.wantRepair) {
+				t.Errorf("repairs = %v, want %v", got, tt.wantRepair)
+			}
+			var failed []string
+			for _, ev := range outbox.pending() {
+				if ev.Type == events.Failed && ev.Incident != nil && ev.Incident.Cause == "reconciler" {
+					failed = append(failed, ev.PackageID+" "+ev.Incident.Reason)
+				}
+			}
+			slices.Sort(failed)
+			if !slices.Equal(failed, tt.wantFailed) {
+				t.Errorf("failed events = %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestNewReconcilerFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		repair   string
+		replicas string
+		wantErr  bool
+	}{
+		{name: "defaults"},
+		{name: "repair on one replica", repair: "true", replicas: "1"},
+		{name: "report only on many replicas", repair: "false", replicas: "3"},
+		{name: "repair on many replicas", repair: "true", replicas: "3", wantErr: true},
+		{name: "bad replica count", replicas: "lots", wantErr: true},
+		{name: "no replicas", replicas: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RECONCILE_REPAIR", tt.repair)
+			t.Setenv("DELIVERY_REPLICAS", tt.replicas)
+			rc, err := newReconcilerFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newReconcilerFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && rc.repair != (tt.repair == "true") {
+				t.Errorf("repair = %v, want %v", rc.repair, tt.repair == "true")
+			}
+		})
+	}
+}
+
+func TestReconcileServiceDown(t *testing.T) {
+	useFleet(t, fleet{})
+	packageServiceURL = "http://127.0.0.1:1"
+	rc := &reconciler{suspects: make(map[discrepancy]bool)}
+	if err := rc.reconcile(); err == nil {
+		t.Error("reconcile() succeeded without package-service")
+	}
+}
@@ -0,0 +1,56 @@
+// delivery-service/records.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/gingercookie/planet-express/internal/sim"
+)
+
+// signatureChance is how often the recipient is in to sign for a package.
+const signatureChance = 0.85
+
+// proofOfDelivery records package pkgID, on flight f, being handed over to
+// recipient at address.
+func proofOfDelivery(r *sim.Rand, f Flight, pkgID, recipient, address string, at time.Time) *events.ProofOfDelivery {
+	proof := &events.ProofOfDelivery{
+		DeliveredAt: at, Crew: f.Crew, Ship: f.Ship, FlightID: f.ID,
+		Recipient: recipient, Address: address,
+	}
+	if r.Float64() < signatureChance {
+		sum := sha256.Sum256(fmt.Appendf(nil, "%s|%s|%s|%016x", pkgID, recipient, at.Format(time.RFC3339Nano), r.Uint64()))
+		proof.SignatureHash = hex.EncodeToString(sum[:])
+	} else {
+		proof.PhotoRef = fmt.Sprintf("pod-photos/%s/%s.jpg", f.ID, pkgID)
+	}
+	return proof
+}
+
+// flightIncident records drop failing on flight f.
+func flightIncident(f Flight, drop Drop, at time.Time) *events.IncidentReport {
+	return &events.IncidentReport{
+		OccurredAt: at, Crew: f.Crew, Ship: f.Ship, FlightID: f.ID,
+		Location: drop.Address, Cause: drop.Cause, Reason: drop.Reason, EnRouteEvents: drop.Events,
+	}
+}
+
+// dispatchIncident records a package failing because it couldn't be sent
+// off at all.
+func dispatchIncident(err error) *events.IncidentReport {
+	return &events.IncidentReport{OccurredAt: clock.Now(), Location: hq, Cause: "dispatch", Reason: strings.TrimSpace(err.Error())}
+}
+
+// reconcilerIncident records the reconciler giving up on a package that was
+// never dispatched, or whose flight is long overdue and no longer running.
+func reconcilerIncident(d discrepancy) *events.IncidentReport {
+	location, reason := hq, "never dispatched"
+	if d.Kind == driftOverduePackage {
+		location, reason = "unknown", "overdue with no flight running"
+	}
+	return &events.IncidentReport{OccurredAt: clock.Now(), Location: location, Cause: "reconciler", Reason: reason}
+}
@@ -0,0 +1,71 @@
+// delivery-service/records_test.go
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/gingercookie/planet-express/internal/sim"
+)
+
+func TestProofOfDelivery(t *testing.T) {
+	f := Flight{ID: "FL-1", Crew: "Fry", Ship: "Planet Express Ship"}
+	at := time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+	signed, photographed := 0, 0
+	for seed := range uint64(100) {
+		proof := proofOfDelivery(sim.NewRand(seed), f, "P1", "Hermes", "Mars Vegas", at)
+		if proof.Crew != "Fry" || proof.FlightID != "FL-1" || proof.Recipient != "Hermes" || !proof.DeliveredAt.Equal(at) {
+			t.Fatalf("seed %d: proof = %+v", seed, proof)
+		}
+		switch {
+		case proof.SignatureHash != "" && proof.PhotoRef == "":
+			if len(proof.SignatureHash) != 64 {
+				t.Errorf("seed %d: signature hash %q isn't hex SHA-256", seed, proof.SignatureHash)
+			}
+			signed++
+		case proof.SignatureHash == "" && proof.PhotoRef == "pod-photos/FL-1/P1.jpg":
+			photographed++
+		default:
+			t.Fatalf("seed %d: proof has signature %q and photo %q, want exactly one", seed, proof.SignatureHash, proof.PhotoRef)
+		}
+		if again := proofOfDelivery(sim.NewRand(seed), f, "P1", "Hermes", "Mars Vegas", at); *again != *proof {
+			t.Fatalf("seed %d: proof not reproducible: %+v then %+v", seed, proof, again)
+		}
+	}
+	if signed < 70 || photographed == 0 {
+		t.Errorf("signed %d, photographed %d of 100, want about %v signed", signed, photographed, signatureChance)
+	}
+}
+
+func TestIncidents(t *testing.T) {
+	f := Flight{ID: "FL-1", Crew: "Bender", Ship: "Nimbus"}
+	at := time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+	drop := Drop{Address: "Neptune", Failed: true, Reason: "Pirates", Cause: "space_pirates", Events: []string{"space_pirates"}}
+	tests := []struct {
+		name      string
+		got, want *events.IncidentReport
+	}{
+		{
+			"on a flight",
+			flightIncident(f, drop, at),
+			&events.IncidentReport{OccurredAt: at, Crew: "Bender", Ship: "Nimbus", FlightID: "FL-1",
+				Location: "Neptune", Cause: "space_pirates", Reason: "Pirates", EnRouteEvents: []string{"space_pirates"}},
+		},
+		{
+			"never left",
+			dispatchIncident(errors.New("No ship available\n")),
+			&events.IncidentReport{Location: hq, Cause: "dispatch", Reason: "No ship available"},
+		},
+	}
+	for _, tt := range tests {
+		if tt.want.OccurredAt.IsZero() {
+			tt.got.OccurredAt = time.Time{} // on the service clock
+		}
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: incident = %+v, want %+v", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// delivery-service/simulate.go
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/sim"
+)
+
+// maxSimulatedDeliveries bounds a single simulation run.
+const maxSimulatedDeliveries = 1_000_000
+
+// SimulationRequest configures a virtual-time run. Crew and ships default to
+// the current crew- and ship-service rosters, addresses to every known
+// destination. Without a seed one is picked at random and reported back.
+type SimulationRequest struct {
+	Deliveries int          `json:"deliveries"`
+	Rate       float64      `json:"rate,omitempty"` // requests per virtual second, default 1
+	Seed       *uint64      `json:"seed,omitempty"`
+	Crew       []CrewMember `json:"crew,omitempty"`
+	Ships      []ShipInfo   `json:"ships,omitempty"`
+	Addresses  []string     `json:"addresses,omitempty"`
+}
+
+type SimulationReport struct {
+	Seed           uint64                    `json:"seed"`
+	Requested      int                       `json:"requested"`
+	Dispatched     int                       `json:"dispatched"`
+	RejectedNoCrew int                       `json:"rejected_no_crew"`
+	RejectedNoShip int                       `json:"rejected_no_ship"`
+	Delivered      int                       `json:"delivered"`
+	Failed         int                       `json:"failed"`
+	MeanFlightTime string                    `json:"mean_flight_time"` // out to the recipient
+	MeanRoundTrip  string                    `json:"mean_round_trip"`
+	EnRouteEvents  map[string]int            `json:"en_route_events"`
+	VirtualTime    string                    `json:"virtual_time"`
+	WallTime       string                    `json:"wall_time"`
+	Crew           map[string]*SimulatedCrew `json:"crew"`
+	Ships          map[string]*SimulatedShip `json:"ships"`
+}
+
+type SimulatedCrew struct {
+	Deliveries  int     `json:"deliveries"`
+	Failed      int     `json:"failed"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+type SimulatedShip struct {
+	Flights     int     `json:"flights"`
+	Utilization float64 `json:"utilization"` // share of virtual time spent flying
+}
+
+// landing is a simulated flight back at HQ, freeing its crew and ship.
+type landing struct {
+	at         time.Duration
+	crew, ship int
+}
+
+// landings is a min-heap of flights by landing time.
+type landings []landing
+
+func (l landings) Len() int           { return len(l) }
+func (l landings) Less(i, j int) bool { return l[i].at < l[j].at }
+func (l landings) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l *landings) Push(x any)        { *l = append(*l, x.(landing)) }
+func (l *landings) Pop() any {
+	old := *l
+	x := old[len(old)-1]
+	*l = old[:len(old)-1]
+	return x
+}
+
+// simulate runs req as a discrete-event simulation: virtual time jumps from
+// one arrival or landing to the next, so nothing sleeps. Crew and ships are
+// reserved first-available, in roster order, as crew- and ship-service do,
+// and are busy until the return leg lands. Flights are planned exactly as
+// real ones are.
+func simulate(req SimulationRequest) SimulationReport {
+	wallStart := time.Now()
+	r := sim.NewRand(*req.Seed)
+
+	report := SimulationReport{
+		Seed:          *req.Seed,
+		Requested:     req.Deliveries,
+		EnRouteEvents: make(map[string]int),
+		Crew:          make(map[string]*SimulatedCrew, len(req.Crew)),
+		Ships:         make(map[string]*SimulatedShip, len(req.Ships)),
+	}
+	for _, c := range req.Crew {
+		report.Crew[c.Name] = &SimulatedCrew{}
+	}
+	for _, s := range req.Ships {
+		report.Ships[s.Name] = &SimulatedShip{}
+	}
+	crewBusy := make([]bool, len(req.Crew))
+	shipBusy := make([]bool, len(req.Ships))
+	shipFlying := make([]time.Duration, len(req.Ships))
+	var inFlight landings
+	var now, totalFlight, totalRoundTrip time.Duration
+
+	land := func(until time.Duration) {
+		for inFlight.Len() > 0 && inFlight[0].at <= until {
+			l := heap.Pop(&inFlight).(landing)
+			crewBusy[l.crew], shipBusy[l.ship] = false, false
+			now = l.at
+		}
+	}
+
+	for range req.Deliveries {
+		next := now + time.Duration(r.ExpFloat64()/req.Rate*float64(time.Second))
+		land(next)
+		now = next
+
+		address := req.Addresses[r.IntN(len(req.Addresses))]
+		ci := slices.Index(crewBusy, false)
+		if ci < 0 {
+			report.RejectedNoCrew++
+			continue
+		}
+		si := slices.Index(shipBusy, false)
+		if si < 0 {
+			report.RejectedNoShip++
+			continue
+		}
+		crew, ship := req.Crew[ci], req.Ships[si]
+		// One ordinary package per flight: batching and hazardous cargo
+		// aren't simulated.
+		plan := planFlight(r, []string{address}, nil, crew, ship)
+		drop := plan.Drops[0]
+		roundTrip := plan.total()
+
+		crewBusy[ci], shipBusy[si] = true, true
+		heap.Push(&inFlight, landing{at: now + roundTrip, crew: ci, ship: si})
+		report.Dispatched++
+		totalFlight += plan.arrival(drop.Leg)
+		totalRoundTrip += roundTrip
+		shipFlying[si] += roundTrip
+		for _, leg := range plan.Legs {
+			for _, name := range leg.Events {
+				report.EnRouteEvents[name]++
+			}
+		}
+		report.Ships[ship.Name].Flights++
+		report.Crew[crew.Name].Deliveries++
+		if drop.Failed {
+			report.Failed++
+			report.Crew[crew.Name].Failed++
+		} else {
+			report.Delivered++
+		}
+	}
+	land(1<<63 - 1)
+
+	for _, c := range report.Crew {
+		if c.Deliveries > 0 {
+			c.FailureRate = float64(c.Failed) / float64(c.Deliveries)
+		}
+	}
+	for i, s := range req.Ships {
+		if now > 0 {
+			report.Ships[s.Name].Utilization = float64(shipFlying[i]) / float64(now)
+		}
+	}
+	if report.Dispatched > 0 {
+		report.MeanFlightTime = (totalFlight / time.Duration(report.Dispatched)).String()
+		report.MeanRoundTrip = (totalRoundTrip / time.Duration(report.Dispatched)).String()
+	}
+	report.VirtualTime = now.String()
+	report.WallTime = time.Since(wallStart).String()
+	return report
+}
+
+// handleSimulate serves POST /admin/simulate. It doesn't touch crew, ships
+// or packages, and doesn't draw from the service's own random source, so it
+// can run alongside real traffic.
+func handleSimulate(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+
+	var req SimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+		http.Error(w, "Invalid simulation request", http.StatusBadRequest)
+		return
+	}
+	if err := prepareSimulation(&req); err != nil {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Crew == nil {
+		if err := getJSON(crewServiceURL+"/crew", &req.Crew); err != nil {
+			slog.Error("Failed to list crew for simulation", "err", err)
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+			http.Error(w, "Unable to list crew", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if req.Ships == nil {
+		if err := getJSON(shipServiceURL+"/ships", &req.Ships); err != nil {
+			slog.Error("Failed to list ships for simulation", "err", err)
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+			http.Error(w, "Unable to list ships", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	for _, s := range req.Ships {
+		if s.Speed <= 0 {
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+			http.Error(w, fmt.Sprintf("Ship %q needs a positive speed", s.Name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report := simulate(req)
+	slog.Info("Ran delivery simulation", "seed", report.Seed, "deliveries", req.Deliveries,
+		"virtual_time", report.VirtualTime, "wall_time", report.WallTime, "caller", r.Header.Get(callerHeader))
+
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// prepareSimulation validates req and fills in defaults other than the
+// rosters.
+func prepareSimulation(req *SimulationRequest) error {
+	if req.Deliveries <= 0 || req.Deliveries > maxSimulatedDeliveries {
+		return fmt.Errorf("deliveries must be between 1 and %d", maxSimulatedDeliveries)
+	}
+	if req.Rate < 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if req.Rate == 0 {
+		req.Rate = 1
+	}
+	if req.Seed == nil {
+		seed := rand.Uint64()
+		req.Seed = &seed
+	}
+	if len(req.Addresses) == 0 {
+		for address := range distances {
+			req.Addresses = append(req.Addresses, address)
+		}
+		// Map order is random; sort so a seed always picks the same ones.
+		slices.Sort(req.Addresses)
+	}
+	return nil
+}
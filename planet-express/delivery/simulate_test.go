@@ -0,0 +1,96 @@
+// delivery-service/simulate_test.go
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrepareSimulation(t *testing.T) {
+	seed := uint64(7)
+	tests := []struct {
+		name     string
+		req      SimulationRequest
+		wantRate float64
+		wantErr  bool
+	}{
+		{"defaults", SimulationRequest{Deliveries: 10}, 1, false},
+		{"kept", SimulationRequest{Deliveries: 10, Rate: 5, Seed: &seed, Addresses: []string{"Mars Vegas"}}, 5, false},
+		{"no deliveries", SimulationRequest{}, 0, true},
+		{"too many deliveries", SimulationRequest{Deliveries: maxSimulatedDeliveries + 1}, 0, true},
+		{"negative rate", SimulationRequest{Deliveries: 10, Rate: -1}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			err := prepareSimulation(&req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareSimulation() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if req.Rate != tt.wantRate || req.Seed == nil || len(req.Addresses) == 0 {
+				t.Errorf("prepareSimulation() = rate %v, seed %v, %d addresses, want rate %v, a seed and addresses",
+					req.Rate, req.Seed, len(req.Addresses), tt.wantRate)
+			}
+			if tt.req.Seed != nil && *req.Seed != *tt.req.Seed {
+				t.Errorf("seed = %d, want %d kept", *req.Seed, *tt.req.Seed)
+			}
+		})
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	seed := uint64(42)
+	base := SimulationRequest{
+		Deliveries: 500,
+		Rate:       1,
+		Seed:       &seed,
+		Crew:       []CrewMember{{Name: "Leela", Risk: 0}, {Name: "Fry", Risk: 1}},
+		Ships:      []ShipInfo{{Name: "Planet Express Ship", Speed: 10}, {Name: "Nimbus", Speed: 10}},
+		Addresses:  []string{"Mars Vegas"},
+	}
+	tests := []struct {
+		name   string
+		modify func(req *SimulationRequest)
+		check  func(t *testing.T, r SimulationReport)
+	}{
+		{"every request accounted for", func(*SimulationRequest) {}, func(t *testing.T, r SimulationReport) {
+			if got := r.Dispatched + r.RejectedNoCrew + r.RejectedNoShip; got != r.Requested {
+				t.Errorf("dispatched %d + rejected %d + %d = %d, want %d", r.Dispatched, r.RejectedNoCrew, r.RejectedNoShip, got, r.Requested)
+			}
+			if r.Delivered+r.Failed != r.Dispatched {
+				t.Errorf("delivered %d + failed %d != dispatched %d", r.Delivered, r.Failed, r.Dispatched)
+			}
+		}},
+		{"outcomes follow crew risk", func(*SimulationRequest) {}, func(t *testing.T, r SimulationReport) {
+			leela, fry := r.Crew["Leela"], r.Crew["Fry"]
+			if fry.Deliveries == 0 || fry.Failed != fry.Deliveries || leela.FailureRate > 0.1 {
+				t.Errorf("crew = Leela %+v, Fry %+v, want Leela rarely failing and Fry always", *leela, *fry)
+			}
+		}},
+		{"one ship limits dispatch", func(req *SimulationRequest) { req.Rate, req.Ships = 100, req.Ships[:1] }, func(t *testing.T, r SimulationReport) {
+			if r.RejectedNoShip == 0 || r.RejectedNoCrew != 0 {
+				t.Errorf("rejected %d for crew, %d for ships, want only ships", r.RejectedNoCrew, r.RejectedNoShip)
+			}
+			if u := r.Ships["Planet Express Ship"].Utilization; u < 0.9 || u > 1 {
+				t.Errorf("utilization = %v, want nearly 1", u)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := base
+			tt.modify(&req)
+			r := simulate(req)
+			tt.check(t, r)
+
+			again := simulate(req)
+			r.WallTime, again.WallTime = "", ""
+			if !reflect.DeepEqual(r, again) {
+				t.Errorf("simulate() with seed %d gave different reports", seed)
+			}
+		})
+	}
+}
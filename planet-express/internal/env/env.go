@@ -0,0 +1,28 @@
+// internal/env/env.go
+
+// Package env reads the services' numeric settings from the environment.
+package env
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Float returns the non-negative number in key, or def if it is unset or
+// invalid.
+func Float(key string, def float64) float64 {
+	if val, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil && val >= 0 {
+		return val
+	}
+	return def
+}
+
+// Duration returns the positive duration in key, such as "30s", or def if it
+// is unset or invalid.
+func Duration(key string, def time.Duration) time.Duration {
+	if val, err := time.ParseDuration(os.Getenv(key)); err == nil && val > 0 {
+		return val
+	}
+	return def
+}
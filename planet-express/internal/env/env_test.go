@@ -0,0 +1,45 @@
+// internal/env/env_test.go
+package env
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFloat(t *testing.T) {
+	tests := []struct {
+		val  string
+		want float64
+	}{
+		{"", 2},
+		{"0.5", 0.5},
+		{"0", 0},
+		{"-1", 2},
+		{"lots", 2},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_FLOAT", tt.val)
+		if got := Float("TEST_FLOAT", 2); got != tt.want {
+			t.Errorf("Float(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		val  string
+		want time.Duration
+	}{
+		{"", time.Minute},
+		{"30s", 30 * time.Second},
+		{"0s", time.Minute},
+		{"-1s", time.Minute},
+		{"30", time.Minute},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_DURATION", tt.val)
+		if got := Duration("TEST_DURATION", time.Minute); got != tt.want {
+			t.Errorf("Duration(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
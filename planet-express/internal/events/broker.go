@@ -0,0 +1,525 @@
+// internal/events/broker.go
+package events
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Broker carries events between services. Each consumer is a subscriber
+// group with its own copy of every message; subscribers sharing a group
+// split the messages between them, so each replica of a service doesn't act
+// on the same event.
+//
+// Publish sends data to each of consumers and only counts it as delivered
+// to those whose handler returned nil, which it returns as acked. The error
+// is nil once every consumer has acked, so the publisher knows which ones
+// still need the message.
+type Broker interface {
+	Publish(subject string, data []byte, consumers []string) (acked []string, err error)
+	Subscribe(subject, group string, handler func(data []byte) error) error
+	Close() error
+}
+
+// NewBrokerFromEnv picks the broker named by EVENT_BROKER: "memory" (the
+// default) or "nats", which connects to NATS_URL. name identifies this
+// service to the broker.
+func NewBrokerFromEnv(name string) (Broker, error) {
+	switch kind := os.Getenv("EVENT_BROKER"); kind {
+	case "", "memory":
+		return NewMemoryBroker(), nil
+	case "nats":
+		addr := os.Getenv("NATS_URL")
+		if addr == "" {
+			addr = "nats://nats:4222"
+		}
+		return NewNATSBroker(addr, name)
+	default:
+		return nil, fmt.Errorf("unknown EVENT_BROKER %q", kind)
+	}
+}
+
+// MemoryBroker delivers events within this process only. Publish runs each
+// consumer's handlers in turn, so the publisher knows whether the event was
+// acted on.
+type MemoryBroker struct {
+	mu     sync.RWMutex
+	subs   map[string][]func(data []byte) error // by subject and group
+	closed bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: make(map[string][]func(data []byte) error)}
+}
+
+func (b *MemoryBroker) Publish(subject string, data []byte, consumers []string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return nil, errors.New("broker closed")
+	}
+	var acked []string
+	var errs []error
+	for _, c := range consumers {
+		handlers := b.subs[consumerSubject(subject, c)]
+		if len(handlers) == 0 {
+			errs = append(errs, fmt.Errorf("%s: not subscribed", c))
+			continue
+		}
+		var failed []error
+		for _, handler := range handlers {
+			if err := handler(data); err != nil {
+				failed = append(failed, err)
+			}
+		}
+		if len(failed) > 0 {
+			errs = append(errs, fmt.Errorf("%s: %w", c, errors.Join(failed...)))
+			continue
+		}
+		acked = append(acked, c)
+	}
+	return acked, errors.Join(errs...)
+}
+
+func (b *MemoryBroker) Subscribe(subject, group string, handler func(data []byte) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := consumerSubject(subject, group)
+	b.subs[key] = append(b.subs[key], handler)
+	return nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+// ackTimeout is how long Publish waits for consumers to acknowledge a
+// message before counting it as undelivered to them.
+var ackTimeout = 5 * time.Second
+
+// consumerSubject is the subject carrying group's copy of messages on
+// subject. Giving each consumer its own subject lets a message be resent to
+// the consumers that missed it without the others seeing it again.
+func consumerSubject(subject, group string) string {
+	if group == "" {
+		return subject
+	}
+	return subject + "." + group
+}
+
+// NATSBroker speaks the core NATS text protocol, so any NATS server (or a
+// local container running one) works. Core NATS keeps nothing, so messages
+// are published as requests: a subscriber replies once its handler has
+// succeeded, and anything unacknowledged is the publisher's to resend. It
+// reconnects and resubscribes when the connection drops; events published
+// while disconnected fail.
+//
+// Each subscription handles its messages on a goroutine of its own, in the
+// order they arrive, so a slow handler holds up neither other subscriptions
+// nor the connection's read loop, which also carries acks and PINGs.
+type NATSBroker struct {
+	addr  string
+	name  string
+	inbox string                   // prefix of the subjects acks come back on
+	dial  func() (net.Conn, error) // to addr
+
+	mu      sync.Mutex // guards everything below
+	conn    net.Conn
+	w       *bufio.Writer
+	subs    map[int]natsSubscription
+	nextID  int
+	waiting map[string]chan<- natsAck // by reply subject
+	closed  bool
+}
+
+type natsSubscription struct {
+	subject, group string
+	handler        func(data []byte) error
+	queue          chan natsMsg // closed by Close
+}
+
+// natsMsg is a message waiting for its subscription's handler. conn is the
+// connection it came in on, which the ack has to go back out on.
+type natsMsg struct {
+	conn  net.Conn
+	reply string
+	data  []byte
+}
+
+// subscriptionQueue is how many messages a subscription holds while its
+// handler is busy. Messages beyond that are refused, and their publisher
+// resends them later.
+const subscriptionQueue = 256
+
+type natsAck struct {
+	consumer string
+	err      error
+}
+
+// inboxSID is the subscription for acks. Subscriptions added by Subscribe
+// start at 1.
+const inboxSID = 0
+
+func NewNATSBroker(rawURL, name string) (*NATSBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS_URL: %w", err)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	// Don't fail startup if NATS isn't up yet; keep trying in the background.
+	b := &NATSBroker{
+		addr:    addr,
+		name:    name,
+		inbox:   "_INBOX." + rand.Text(),
+		dial:    func() (net.Conn, error) { return net.DialTimeout("tcp", addr, 5*time.Second) },
+		subs:    make(map[int]natsSubscription),
+		waiting: make(map[string]chan<- natsAck),
+	}
+	if err := b.connect(); err != nil {
+		slog.Error("Unable to connect to NATS", "addr", addr, "err", err)
+		go b.reconnect()
+	} else {
+		slog.Info("Connected to NATS", "addr", addr)
+	}
+	return b, nil
+}
+
+func (b *NATSBroker) connect() error {
+	conn, err := b.dial()
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from NATS server: %q %v", line, err)
+	}
+	opts, _ := json.Marshal(map[string]any{"verbose": false, "pedantic": false, "name": b.name})
+	fmt.Fprintf(w, "CONNECT %s\r\nPING\r\n", opts)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	line, err = r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "PONG" {
+		conn.Close()
+		return fmt.Errorf("NATS server refused connection: %q %v", strings.TrimSpace(line), err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		conn.Close()
+		return errors.New("broker closed")
+	}
+	b.conn, b.w = conn, w
+	fmt.Fprintf(b.w, "SUB %s.* %d\r\n", b.inbox, inboxSID)
+	for sid, sub := range b.subs {
+		b.writeSub(sid, sub)
+	}
+	if err := b.flush(); err != nil {
+		conn.Close()
+		b.conn, b.w = nil, nil
+		return err
+	}
+	go b.readLoop(conn, r)
+	return nil
+}
+
+// writeSub queues a SUB command. The caller must hold mu.
+func (b *NATSBroker) writeSub(sid int, sub natsSubscription) {
+	subject := consumerSubject(sub.subject, sub.group)
+	if sub.group != "" {
+		fmt.Fprintf(b.w, "SUB %s %s %d\r\n", subject, sub.group, sid)
+	} else {
+		fmt.Fprintf(b.w, "SUB %s %d\r\n", subject, sid)
+	}
+}
+
+// writePub queues a PUB command. The caller must hold mu.
+func (b *NATSBroker) writePub(subject, reply string, data []byte) {
+	if reply != "" {
+		fmt.Fprintf(b.w, "PUB %s %s %d\r\n", subject, reply, len(data))
+	} else {
+		fmt.Fprintf(b.w, "PUB %s %d\r\n", subject, len(data))
+	}
+	b.w.Write(data)
+	b.w.WriteString("\r\n")
+}
+
+// flush sends buffered commands. The caller must hold mu.
+func (b *NATSBroker) flush() error {
+	b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return b.w.Flush()
+}
+
+func (b *NATSBroker) readLoop(conn net.Conn, r *bufio.Reader) {
+loop:
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || len(fields) > 5 {
+				slog.Error("Malformed message from NATS", "line", line)
+				continue
+			}
+			sid, _ := strconv.Atoi(fields[2])
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				slog.Error("Malformed message from NATS", "line", line)
+				continue
+			}
+			payload := make([]byte, size+2) // payload is followed by \r\n
+			if _, err := io.ReadFull(r, payload); err != nil {
+				break loop
+			}
+			if sid == inboxSID {
+				b.receiveAck(fields[1], payload[:size])
+				continue
+			}
+			msg := natsMsg{conn: conn, data: payload[:size]}
+			if len(fields) == 5 {
+				msg.reply = fields[3]
+			}
+			b.mu.Lock()
+			sub, ok := b.subs[sid]
+			queued := false
+			if ok && !b.closed {
+				select {
+				case sub.queue <- msg:
+					queued = true
+				default:
+				}
+			}
+			b.mu.Unlock()
+			if ok && !queued {
+				slog.Warn("Event handler falling behind, refusing message", "subject", sub.subject, "queued", subscriptionQueue)
+				if msg.reply != "" {
+					b.ack(conn, msg.reply, sub.group, errors.New("subscriber busy"))
+				}
+			}
+		case line == "PING":
+			b.mu.Lock()
+			if b.conn == conn {
+				b.w.WriteString("PONG\r\n")
+				b.flush()
+			}
+			b.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			slog.Error("NATS server error", "err", strings.TrimPrefix(line, "-ERR "))
+		}
+	}
+
+	conn.Close()
+	b.mu.Lock()
+	if b.conn == conn {
+		b.conn, b.w = nil, nil
+	}
+	closed := b.closed
+	b.mu.Unlock()
+	if !closed {
+		slog.Warn("Lost connection to NATS, reconnecting", "addr", b.addr)
+		go b.reconnect()
+	}
+}
+
+// handle runs sub's handler on each of its messages in turn, and acks each
+// once it has been handled.
+func (b *NATSBroker) handle(sub natsSubscription) {
+	for msg := range sub.queue {
+		err := sub.handler(msg.data)
+		if err != nil {
+			slog.Error("Event handler failed", "subject", sub.subject, "err", err)
+		}
+		if msg.reply != "" {
+			b.ack(msg.conn, msg.reply, sub.group, err)
+		}
+	}
+}
+
+// ack replies to a message with "+ACK" if its handler succeeded or "-NAK"
+// and the error if it didn't. Either way the reply names group.
+func (b *NATSBroker) ack(conn net.Conn, reply, group string, err error) {
+	msg := "+ACK " + group
+	if err != nil {
+		msg = "-NAK " + group + " " + err.Error()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != conn {
+		// The publisher will resend it.
+		return
+	}
+	b.writePub(reply, "", []byte(msg))
+	if err := b.flush(); err != nil {
+		slog.Error("Unable to acknowledge event", "err", err)
+	}
+}
+
+// receiveAck passes a consumer's reply on to the Publish waiting for it.
+func (b *NATSBroker) receiveAck(subject string, data []byte) {
+	verdict, rest, _ := strings.Cut(string(data), " ")
+	consumer, reason, _ := strings.Cut(rest, " ")
+	a := natsAck{consumer: consumer}
+	if verdict != "+ACK" {
+		a.err = errors.New(cmp.Or(reason, "not acknowledged"))
+	}
+	b.mu.Lock()
+	ch, ok := b.waiting[subject]
+	delete(b.waiting, subject)
+	b.mu.Unlock()
+	if ok {
+		ch <- a
+	}
+}
+
+func (b *NATSBroker) reconnect() {
+	backoff := time.Second
+	for {
+		time.Sleep(backoff)
+		b.mu.Lock()
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return
+		}
+		err := b.connect()
+		if err == nil {
+			slog.Info("Reconnected to NATS", "addr", b.addr)
+			return
+		}
+		slog.Error("Unable to reconnect to NATS", "addr", b.addr, "err", err)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// Connected is a readiness check: it fails while the broker is reconnecting.
+func (b *NATSBroker) Connected() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return errors.New("not connected to NATS")
+	}
+	return nil
+}
+
+// Publish sends each consumer its copy of data as a request and waits up to
+// ackTimeout for them to reply.
+func (b *NATSBroker) Publish(subject string, data []byte, consumers []string) ([]string, error) {
+	acks := make(chan natsAck, len(consumers))
+	replies := make(map[string]string, len(consumers)) // consumer by reply subject
+
+	b.mu.Lock()
+	if b.conn == nil {
+		b.mu.Unlock()
+		return nil, errors.New("not connected to NATS")
+	}
+	for _, c := range consumers {
+		reply := b.inbox + "." + rand.Text()
+		replies[reply] = c
+		b.waiting[reply] = acks
+		b.writePub(consumerSubject(subject, c), reply, data)
+	}
+	err := b.flush()
+	b.mu.Unlock()
+
+	var acked []string
+	var errs []error
+	if err == nil {
+		timeout := time.After(ackTimeout)
+	wait:
+		for range consumers {
+			select {
+			case a := <-acks:
+				if a.err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", a.consumer, a.err))
+				} else if slices.Contains(consumers, a.consumer) {
+					acked = append(acked, a.consumer)
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+
+	b.mu.Lock()
+	for reply, c := range replies {
+		if _, ok := b.waiting[reply]; ok {
+			delete(b.waiting, reply)
+			if err == nil {
+				errs = append(errs, fmt.Errorf("%s: no acknowledgement within %s", c, ackTimeout))
+			}
+		}
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return acked, errors.Join(errs...)
+}
+
+func (b *NATSBroker) Subscribe(subject, group string, handler func(data []byte) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("broker closed")
+	}
+	b.nextID++
+	sub := natsSubscription{subject: subject, group: group, handler: handler, queue: make(chan natsMsg, subscriptionQueue)}
+	b.subs[b.nextID] = sub
+	go b.handle(sub)
+	if b.conn == nil {
+		// Sent on reconnect.
+		return nil
+	}
+	b.writeSub(b.nextID, sub)
+	return b.flush()
+}
+
+func (b *NATSBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, sub := range b.subs {
+		close(sub.queue)
+	}
+	if b.conn == nil {
+		return nil
+	}
+	return b.conn.Close()
+}
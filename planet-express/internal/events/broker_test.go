@@ -0,0 +1,280 @@
+// internal/events/broker_test.go
+package events
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewBrokerFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{"default", nil, ""},
+		{"memory", map[string]string{"EVENT_BROKER": "memory"}, ""},
+		{"unknown", map[string]string{"EVENT_BROKER": "kafka"}, "unknown EVENT_BROKER"},
+		{"bad NATS_URL", map[string]string{"EVENT_BROKER": "nats", "NATS_URL": "nats://[::1"}, "invalid NATS_URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("EVENT_BROKER", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			b, err := NewBrokerFromEnv("test")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewBrokerFromEnv() error = %v, want it to mention %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := b.(*MemoryBroker); !ok {
+				t.Errorf("NewBrokerFromEnv() = %T, want *MemoryBroker", b)
+			}
+		})
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	fail := errors.New("package unknown")
+	tests := []struct {
+		name      string
+		handlers  map[string]error // one subscriber per consumer, returning it
+		consumers []string
+		wantAcked []string
+		wantErr   bool
+	}{
+		{"all ack", map[string]error{"package": nil, "crew": nil}, []string{"package", "crew"}, []string{"package", "crew"}, false},
+		{"one fails", map[string]error{"package": nil, "crew": fail}, []string{"package", "crew"}, []string{"package"}, true},
+		{"not subscribed", map[string]error{"package": nil}, []string{"package", "ship"}, []string{"package"}, true},
+		{"only the consumers asked for", map[string]error{"package": nil, "crew": nil}, []string{"crew"}, []string{"crew"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemoryBroker()
+			var ran []string
+			for c, err := range tt.handlers {
+				b.Subscribe("deliveries", c, func(data []byte) error {
+					if string(data) != "a" {
+						t.Errorf("handler got %q, want a", data)
+					}
+					ran = append(ran, c)
+					return err
+				})
+			}
+			acked, err := b.Publish("deliveries", []byte("a"), tt.consumers)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Publish() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(acked, tt.wantAcked) {
+				t.Errorf("Publish() acked %v, want %v", acked, tt.wantAcked)
+			}
+			for _, c := range ran {
+				if !slices.Contains(tt.consumers, c) {
+					t.Errorf("Publish() ran %s's handler, which wasn't asked for", c)
+				}
+			}
+
+			b.Close()
+			if _, err := b.Publish("deliveries", []byte("a"), tt.consumers); err == nil {
+				t.Error("Publish() after Close succeeded")
+			}
+		})
+	}
+}
+
+// fakeNATS is just enough of a NATS server for a single client. It delivers
+// each PUB to every matching SUB, once per queue group.
+func fakeNATS(conn net.Conn) {
+	out := make(chan string, 1024)
+	go func() {
+		for frame := range out {
+			if _, err := io.WriteString(conn, frame); err != nil {
+				return
+			}
+		}
+	}()
+	defer close(out)
+	defer conn.Close()
+
+	type sub struct{ subject, group, sid string }
+	var subs []sub
+	matches := func(pattern, subject string) bool {
+		if prefix, ok := strings.CutSuffix(pattern, ".*"); ok {
+			rest, ok := strings.CutPrefix(subject, prefix+".")
+			return ok && rest != "" && !strings.Contains(rest, ".")
+		}
+		return pattern == subject
+	}
+
+	out <- "INFO {}\r\n"
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		switch {
+		case len(f) == 0:
+		case f[0] == "PING":
+			out <- "PONG\r\n"
+		case f[0] == "SUB" && len(f) == 3:
+			subs = append(subs, sub{subject: f[1], sid: f[2]})
+		case f[0] == "SUB" && len(f) == 4:
+			subs = append(subs, sub{subject: f[1], group: f[2], sid: f[3]})
+		case f[0] == "PUB":
+			size, _ := strconv.Atoi(f[len(f)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			reply := ""
+			if len(f) == 4 {
+				reply = " " + f[2]
+			}
+			delivered := make(map[string]bool)
+			for _, s := range subs {
+				if !matches(s.subject, f[1]) || (s.group != "" && delivered[s.group]) {
+					continue
+				}
+				delivered[s.group] = true
+				out <- fmt.Sprintf("MSG %s %s%s %d\r\n%s", f[1], s.sid, reply, size, payload)
+			}
+		}
+	}
+}
+
+// testNATSBroker connects a broker to a fakeNATS of its own.
+func testNATSBroker(t *testing.T) *NATSBroker {
+	t.Helper()
+	b := &NATSBroker{
+		name:  "test",
+		inbox: "_INBOX.test",
+		dial: func() (net.Conn, error) {
+			client, server := net.Pipe()
+			go fakeNATS(server)
+			return client, nil
+		},
+		subs:    make(map[int]natsSubscription),
+		waiting: make(map[string]chan<- natsAck),
+	}
+	if err := b.connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestNATSBroker(t *testing.T) {
+	prev := ackTimeout
+	ackTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { ackTimeout = prev })
+
+	tests := []struct {
+		name      string
+		handlers  map[string]error // one subscriber per consumer, returning it
+		consumers []string
+		wantAcked []string
+		wantErr   string
+	}{
+		{"all ack", map[string]error{"package": nil, "crew": nil}, []string{"package", "crew"}, []string{"package", "crew"}, ""},
+		{"handler fails", map[string]error{"package": nil, "crew": errors.New("crew unknown")}, []string{"package", "crew"}, []string{"package"}, "crew: crew unknown"},
+		{"nobody subscribed", map[string]error{"package": nil}, []string{"package", "ship"}, []string{"package"}, "ship: no acknowledgement"},
+		{"only the consumers asked for", map[string]error{"package": nil, "crew": nil}, []string{"crew"}, []string{"crew"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testNATSBroker(t)
+			var mu sync.Mutex
+			var ran []string
+			for c, err := range tt.handlers {
+				b.Subscribe("deliveries", c, func(data []byte) error {
+					if string(data) != "a" {
+						t.Errorf("handler got %q, want a", data)
+					}
+					mu.Lock()
+					ran = append(ran, c)
+					mu.Unlock()
+					return err
+				})
+			}
+			if err := b.Connected(); err != nil {
+				t.Fatal(err)
+			}
+
+			acked, err := b.Publish("deliveries", []byte("a"), tt.consumers)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Publish() error = %v, want %q", err, tt.wantErr)
+			}
+			slices.Sort(acked)
+			slices.Sort(tt.wantAcked)
+			if !slices.Equal(acked, tt.wantAcked) {
+				t.Errorf("Publish() acked %v, want %v", acked, tt.wantAcked)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, c := range ran {
+				if !slices.Contains(tt.consumers, c) {
+					t.Errorf("Publish() ran %s's handler, which wasn't asked for", c)
+				}
+			}
+		})
+	}
+}
+
+func TestNATSBrokerSlowHandler(t *testing.T) {
+	b := testNATSBroker(t)
+	release := make(chan struct{})
+	b.Subscribe("deliveries", "slow", func([]byte) error {
+		<-release
+		return nil
+	})
+	b.Subscribe("deliveries", "fast", func([]byte) error { return nil })
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := b.Publish("deliveries", []byte("a"), []string{"slow"})
+		slow <- err
+	}()
+
+	// The fast consumer acks while the slow one is still busy.
+	if acked, err := b.Publish("deliveries", []byte("b"), []string{"fast"}); err != nil || !slices.Equal(acked, []string{"fast"}) {
+		t.Errorf("Publish() to fast = %v, %v, want it acked", acked, err)
+	}
+	select {
+	case err := <-slow:
+		t.Fatalf("Publish() to slow returned %v before its handler finished", err)
+	default:
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("Publish() to slow = %v, want it acked once its handler finished", err)
+	}
+}
+
+func TestNATSBrokerClose(t *testing.T) {
+	b := testNATSBroker(t)
+	b.Subscribe("deliveries", "package", func([]byte) error { return nil })
+	b.Close()
+	if _, err := b.Publish("deliveries", []byte("a"), []string{"package"}); err == nil {
+		t.Error("Publish() after Close succeeded")
+	}
+	if err := b.Subscribe("deliveries", "crew", func([]byte) error { return nil }); err == nil {
+		t.Error("Subscribe() after Close succeeded")
+	}
+}
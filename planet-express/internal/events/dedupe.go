@@ -0,0 +1,48 @@
+// internal/events/dedupe.go
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Deduper remembers the IDs of recently handled events so a redelivered
+// event is only acted on once.
+type Deduper struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func NewDeduper(ttl time.Duration) *Deduper {
+	return &Deduper{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// FirstTime records id and reports whether it hadn't been seen before.
+func (d *Deduper) FirstTime(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if now.Sub(d.pruned) > d.ttl {
+		for k, at := range d.seen {
+			if now.Sub(at) > d.ttl {
+				delete(d.seen, k)
+			}
+		}
+		d.pruned = now
+	}
+	if _, ok := d.seen[id]; ok {
+		return false
+	}
+	d.seen[id] = now
+	return true
+}
+
+// Forget lets id through again, for events whose handling failed.
+func (d *Deduper) Forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, id)
+}
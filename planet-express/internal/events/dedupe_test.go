@@ -0,0 +1,43 @@
+// internal/events/dedupe_test.go
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduper(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		steps func(d *Deduper) []bool
+		want  []bool
+	}{
+		{"first time", time.Hour, func(d *Deduper) []bool {
+			return []bool{d.FirstTime("a"), d.FirstTime("b")}
+		}, []bool{true, true}},
+		{"redelivery", time.Hour, func(d *Deduper) []bool {
+			return []bool{d.FirstTime("a"), d.FirstTime("a")}
+		}, []bool{true, false}},
+		{"forgotten", time.Hour, func(d *Deduper) []bool {
+			first := d.FirstTime("a")
+			d.Forget("a")
+			return []bool{first, d.FirstTime("a")}
+		}, []bool{true, true}},
+		{"expired", time.Millisecond, func(d *Deduper) []bool {
+			first := d.FirstTime("a")
+			time.Sleep(5 * time.Millisecond)
+			return []bool{first, d.FirstTime("a")}
+		}, []bool{true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.steps(NewDeduper(tt.ttl))
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("FirstTime() call %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// internal/events/events.go
+
+// Package events carries delivery lifecycle events from delivery-service to
+// the services that keep packages, crew and ships in step with them.
+package events
+
+import "time"
+
+// Delivery lifecycle events, published by delivery-service on
+// DeliveriesSubject. They share a subject so consumers see them in the
+// order they were published. Completed or Failed settles the package;
+// crew and ship stay reserved until FlightReturned, once the return leg
+// has landed. Cancelled settles a package that never left; Recalled one
+// that was brought back to HQ.
+const (
+	Dispatched = "DeliveryDispatched"
+	Completed  = "DeliveryCompleted"
+	Failed     = "DeliveryFailed"
+	Cancelled  = "DeliveryCancelled"
+	Recalled   = "DeliveryRecalled"
+	Returned   = "FlightReturned"
+
+	DeliveriesSubject = "planet-express.deliveries"
+)
+
+// Event is the payload of every delivery event. ID is unique per event so
+// consumers can drop redeliveries.
+type Event struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	At        time.Time  `json:"at"`
+	PackageID string     `json:"package_id"`
+	Crew      string     `json:"crew"`
+	Ship      string     `json:"ship"`
+	ETA       *time.Time `json:"eta,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	FlightID  string     `json:"flight_id,omitempty"`
+
+	// Set on FlightReturned, which has no PackageID, for crew- and
+	// ship-service's records.
+	Delivered     int     `json:"delivered,omitempty"`
+	Failed        int     `json:"failed,omitempty"`
+	FlightSeconds float64 `json:"flight_seconds,omitempty"`
+	Distance      float64 `json:"distance_ly,omitempty"`
+
+	// Set on Completed and Failed respectively, for package-service's
+	// records.
+	Proof    *ProofOfDelivery `json:"proof,omitempty"`
+	Incident *IncidentReport  `json:"incident,omitempty"`
+}
+
+// ProofOfDelivery records a package being handed over. Recipients who are
+// in sign for it, which sets SignatureHash; otherwise the crew leave it and
+// take a photo, which sets PhotoRef.
+type ProofOfDelivery struct {
+	DeliveredAt   time.Time `json:"delivered_at"`
+	Crew          string    `json:"crew"`
+	Ship          string    `json:"ship"`
+	FlightID      string    `json:"flight_id,omitempty"`
+	Recipient     string    `json:"recipient"`
+	Address       string    `json:"address"`
+	SignatureHash string    `json:"signature_hash,omitempty"`
+	PhotoRef      string    `json:"photo_ref,omitempty"`
+}
+
+// IncidentReport records why a delivery failed. Cause is "crew", the
+// en-route event to blame, "dispatch" if the package never left HQ, or
+// "reconciler" if delivery-service gave up on a package it lost track of.
+type IncidentReport struct {
+	OccurredAt    time.Time `json:"occurred_at"`
+	Crew          string    `json:"crew,omitempty"`
+	Ship          string    `json:"ship,omitempty"`
+	FlightID      string    `json:"flight_id,omitempty"`
+	Location      string    `json:"location"`
+	Cause         string    `json:"cause"`
+	Reason        string    `json:"reason"`
+	EnRouteEvents []string  `json:"en_route_events,omitempty"` // on the way to Location
+}
@@ -0,0 +1,127 @@
+// internal/health/health.go
+
+// Package health serves the liveness and readiness probes of the
+// planet-express services.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type DependencyStatus struct {
+	Status    string    `json:"status"` // "ok" or "down"
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type Readiness struct {
+	Status string                      `json:"status"` // "ready" or "not ready"
+	Checks map[string]DependencyStatus `json:"checks"`
+}
+
+// Checker runs a check per dependency and caches the results for
+// ttl, so probes from Kubernetes don't turn into a storm of requests against
+// the dependencies.
+type Checker struct {
+	deps map[string]func() error
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	result  Readiness
+}
+
+func NewChecker(deps map[string]func() error, ttl time.Duration) *Checker {
+	return &Checker{deps: deps, ttl: ttl}
+}
+
+// Client makes the requests of HTTPDependency checks. Services calling
+// their dependencies over mutual TLS give it their transport.
+var Client = &http.Client{Timeout: 2 * time.Second}
+
+// HTTPDependency checks that the service at baseURL answers its liveness
+// probe.
+func HTTPDependency(baseURL string) func() error {
+	return func() error {
+		resp, err := Client.Get(baseURL + "/healthz")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("healthz returned %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+func (rc *Checker) check() Readiness {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if time.Since(rc.checked) < rc.ttl {
+		return rc.result
+	}
+
+	checks := make(map[string]DependencyStatus, len(rc.deps))
+	var wg sync.WaitGroup
+	var checksMu sync.Mutex
+	for name, dep := range rc.deps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st := probe(dep)
+			checksMu.Lock()
+			checks[name] = st
+			checksMu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	result := Readiness{Status: "ready", Checks: checks}
+	for _, st := range checks {
+		if st.Status != "ok" {
+			result.Status = "not ready"
+		}
+	}
+	rc.result = result
+	rc.checked = time.Now()
+	return result
+}
+
+func probe(dep func() error) DependencyStatus {
+	start := time.Now()
+	err := dep()
+	st := DependencyStatus{Status: "ok", CheckedAt: start, LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		st.Status, st.Error = "down", err.Error()
+	}
+	return st
+}
+
+// Healthz is the liveness probe: the process is up and serving HTTP.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// Ready is the readiness probe of services with no dependencies to check:
+// they are ready as soon as they are serving.
+func Ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ready"}`))
+}
+
+// Readyz is the readiness probe: every dependency check passed.
+func (rc *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	result := rc.check()
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,159 @@
+// internal/sim/sim.go
+
+// Package sim provides the clock and random source behind everything the
+// services simulate, so runs can be sped up and replayed from a seed.
+package sim
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clock is the source of simulated time: flight times, ETAs and package
+// timestamps. Infrastructure timing (HTTP timeouts, retries, probes) stays on
+// the real clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	Since(t time.Time) time.Duration
+	// After is time.After on this clock, for sleeps that can be cut short.
+	After(d time.Duration) <-chan time.Time
+}
+
+type RealClock struct{}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (RealClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// scaledClock runs scale times faster than real time, starting from epoch.
+// Services given the same epoch and scale agree on the current time.
+type scaledClock struct {
+	epoch time.Time
+	scale float64
+}
+
+func (c scaledClock) Now() time.Time {
+	return c.epoch.Add(time.Duration(float64(time.Since(c.epoch)) * c.scale))
+}
+
+func (c scaledClock) Sleep(d time.Duration) {
+	time.Sleep(time.Duration(float64(d) / c.scale))
+}
+
+func (c scaledClock) After(d time.Duration) <-chan time.Time {
+	return time.After(time.Duration(float64(d) / c.scale))
+}
+
+func (c scaledClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// NewClockFromEnv returns the real clock unless SIM_TIME_SCALE is set, in
+// which case virtual time runs that many times faster from SIM_EPOCH (an
+// RFC 3339 timestamp, default now).
+func NewClockFromEnv() (Clock, error) {
+	val := os.Getenv("SIM_TIME_SCALE")
+	if val == "" {
+		return RealClock{}, nil
+	}
+	scale, err := strconv.ParseFloat(val, 64)
+	if err != nil || scale <= 0 {
+		return nil, fmt.Errorf("SIM_TIME_SCALE must be a positive number")
+	}
+	epoch := time.Now()
+	if val := os.Getenv("SIM_EPOCH"); val != "" {
+		if epoch, err = time.Parse(time.RFC3339, val); err != nil {
+			return nil, fmt.Errorf("SIM_EPOCH: %w", err)
+		}
+	}
+	if scale == 1 {
+		return RealClock{}, nil
+	}
+	return scaledClock{epoch: epoch, scale: scale}, nil
+}
+
+// Rand is a random number generator that is safe for concurrent use.
+// Seeded, it produces the same sequence on every run, though goroutines
+// drawing from it concurrently may take values in a different order.
+type Rand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func NewRand(seed uint64) *Rand {
+	return &Rand{r: rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15))}
+}
+
+// NewRandFromEnv seeds from SIM_SEED, or randomly when it isn't set.
+func NewRandFromEnv() (*Rand, error) {
+	val := os.Getenv("SIM_SEED")
+	if val == "" {
+		return NewRand(rand.Uint64()), nil
+	}
+	seed, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("SIM_SEED must be an unsigned integer")
+	}
+	return NewRand(seed), nil
+}
+
+func (s *Rand) Float64() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Float64()
+}
+
+func (s *Rand) IntN(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.IntN(n)
+}
+
+func (s *Rand) ExpFloat64() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.ExpFloat64()
+}
+
+func (s *Rand) Int64N(n int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Int64N(n)
+}
+
+func (s *Rand) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Uint64()
+}
+
+// Read fills b with random bytes. It never fails.
+func (s *Rand) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < len(b); i += 8 {
+		v := s.r.Uint64()
+		for j := i; j < len(b) && j < i+8; j++ {
+			b[j] = byte(v)
+			v >>= 8
+		}
+	}
+	return len(b), nil
+}
+
+// FromEnv returns the clock and random source configured by the SIM_*
+// variables.
+func FromEnv() (Clock, *Rand, error) {
+	clock, err := NewClockFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := NewRandFromEnv()
+	return clock, r, err
+}
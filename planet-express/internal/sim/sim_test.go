@@ -0,0 +1,107 @@
+// internal/sim/sim_test.go
+package sim
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewClockFromEnv(t *testing.T) {
+	epoch := time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		scale     string
+		epoch     string
+		wantScale float64 // 0 for the real clock
+		wantErr   bool
+	}{
+		{"real time", "", "", 0, false},
+		{"scale of one", "1", "", 0, false},
+		{"faster", "60", epoch.Format(time.RFC3339), 60, false},
+		{"zero scale", "0", "", 0, true},
+		{"bad scale", "fast", "", 0, true},
+		{"bad epoch", "2", "yesterday", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SIM_TIME_SCALE", tt.scale)
+			t.Setenv("SIM_EPOCH", tt.epoch)
+			c, err := NewClockFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewClockFromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantScale == 0 {
+				if _, ok := c.(RealClock); !ok {
+					t.Errorf("NewClockFromEnv() = %T, want RealClock", c)
+				}
+				return
+			}
+			sc, ok := c.(scaledClock)
+			if !ok || sc.scale != tt.wantScale || !sc.epoch.Equal(epoch) {
+				t.Errorf("NewClockFromEnv() = %+v, want scale %v from %s", c, tt.wantScale, epoch)
+			}
+		})
+	}
+}
+
+func TestScaledClock(t *testing.T) {
+	c := scaledClock{epoch: time.Now(), scale: 1000}
+	start := c.Now()
+	c.Sleep(time.Second) // a millisecond of real time
+	if got := c.Since(start); got < time.Second || got > time.Minute {
+		t.Errorf("Since() after sleeping 1s of virtual time = %s", got)
+	}
+	start = c.Now()
+	<-c.After(time.Second)
+	if got := c.Since(start); got < time.Second || got > time.Minute {
+		t.Errorf("Since() after waiting 1s of virtual time = %s", got)
+	}
+}
+
+func TestNewRandFromEnv(t *testing.T) {
+	draw := func(r *Rand) []uint64 {
+		var out []uint64
+		for range 5 {
+			out = append(out, r.Uint64())
+		}
+		return out
+	}
+	tests := []struct {
+		seed     string
+		wantSame bool
+		wantErr  bool
+	}{
+		{"42", true, false},
+		{"", false, false},
+		{"-1", false, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("SIM_SEED", tt.seed)
+		a, err := NewRandFromEnv()
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("NewRandFromEnv() with SIM_SEED=%q error = %v, want error %v", tt.seed, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		b, _ := NewRandFromEnv()
+		if same := slices.Equal(draw(a), draw(b)); same != tt.wantSame {
+			t.Errorf("SIM_SEED=%q gave the same sequence twice = %v, want %v", tt.seed, same, tt.wantSame)
+		}
+	}
+}
+
+func TestRandRead(t *testing.T) {
+	for _, n := range []int{0, 3, 8, 13} {
+		a, b := make([]byte, n), make([]byte, n)
+		NewRand(7).Read(a)
+		NewRand(7).Read(b)
+		if !slices.Equal(a, b) {
+			t.Errorf("Read() of %d bytes differs between runs with the same seed", n)
+		}
+	}
+}
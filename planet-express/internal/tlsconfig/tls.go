@@ -0,0 +1,192 @@
+// internal/tlsconfig/tls.go
+
+// Package tlsconfig sets up mutual TLS between the planet-express services
+// from certificates mounted out of a cert-manager secret.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certs holds this service's certificate and the CA bundle used to verify
+// its peers, loaded from TLS_CERT_FILE, TLS_KEY_FILE and TLS_CA_FILE. The
+// files are mounted from a cert-manager secret and re-read when it rotates.
+type Certs struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// newCertsFromEnv returns nil when TLS is not configured.
+func newCertsFromEnv() (*Certs, error) {
+	c := &Certs{
+		certFile: os.Getenv("TLS_CERT_FILE"),
+		keyFile:  os.Getenv("TLS_KEY_FILE"),
+		caFile:   os.Getenv("TLS_CA_FILE"),
+	}
+	if c.certFile == "" && c.keyFile == "" && c.caFile == "" {
+		return nil, nil
+	}
+	if c.certFile == "" || c.keyFile == "" || c.caFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE, TLS_KEY_FILE and TLS_CA_FILE must all be set to enable TLS")
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Certs) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile, c.caFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *Certs) load() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading key pair: %w", err)
+	}
+	caPEM, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", c.caFile)
+	}
+
+	c.mu.Lock()
+	c.cert, c.pool, c.modTime = &cert, pool, modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// watch polls the files and reloads them when they change. A failed reload
+// keeps serving the previous certificate.
+func (c *Certs) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		modTime, err := c.latestModTime()
+		if err != nil {
+			slog.Error("Unable to stat TLS files", "err", err)
+			continue
+		}
+		c.mu.RLock()
+		changed := modTime.After(c.modTime)
+		c.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.load(); err != nil {
+			slog.Error("Failed to reload TLS certificates", "err", err)
+			continue
+		}
+		slog.Info("Reloaded TLS certificates", "cert", c.certFile)
+	}
+}
+
+func (c *Certs) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, c.pool
+}
+
+// ServerConfig requires clients to present a certificate signed by the CA.
+func (c *Certs) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    pool,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig presents our certificate and verifies the server against the
+// current CA bundle. Verification is done by hand in VerifyConnection so a
+// rotated CA is picked up without rebuilding the transport.
+func (c *Certs) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := c.current()
+			return cert, nil
+		},
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, pool := c.current()
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         pool,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}
+}
+
+// Transport is an HTTP transport for calling other services over mutual
+// TLS.
+func (c *Certs) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = c.ClientConfig()
+	return transport
+}
+
+// FromEnv loads the certificates named by TLS_CERT_FILE, TLS_KEY_FILE and
+// TLS_CA_FILE and keeps them up to date. It returns nil when TLS is
+// disabled.
+func FromEnv() (*Certs, error) {
+	certs, err := newCertsFromEnv()
+	if err != nil || certs == nil {
+		return nil, err
+	}
+	go certs.watch(30 * time.Second)
+	return certs, nil
+}
+
+// ListenAndServe serves handler over mutual TLS when certs is set, or plain
+// HTTP otherwise.
+func ListenAndServe(addr string, handler http.Handler, certs *Certs) error {
+	if certs == nil {
+		return http.ListenAndServe(addr, handler)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: certs.ServerConfig()}
+	return srv.ListenAndServeTLS("", "")
+}
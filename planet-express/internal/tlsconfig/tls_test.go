@@ -0,0 +1,289 @@
+// internal/tlsconfig/tls_test.go
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "planet-express-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for name, valid for 127.0.0.1 if ip is set,
+// along with its key and the CA bundle to dir, and points the TLS_* variables
+// at them.
+func (ca *testCA) issue(t *testing.T, dir, name string, ip bool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip {
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"tls.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		"ca.crt":  ca.pem,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("TLS_CERT_FILE", filepath.Join(dir, "tls.crt"))
+	t.Setenv("TLS_KEY_FILE", filepath.Join(dir, "tls.key"))
+	t.Setenv("TLS_CA_FILE", filepath.Join(dir, "ca.crt"))
+}
+
+// loadCerts issues a certificate for name into a new directory and loads it.
+func (ca *testCA) loadCerts(t *testing.T, name string, ip bool) *Certs {
+	t.Helper()
+	ca.issue(t, t.TempDir(), name, ip)
+	c, err := newCertsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// serve runs an HTTPS server with certs on a local port and returns its URL.
+func serve(t *testing.T, certs *Certs) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: certs.ServerConfig(),
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+func TestNewCertsFromEnv(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	ca.issue(t, dir, "crew-service", false)
+	if err := os.WriteFile(filepath.Join(dir, "empty.crt"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantNil  bool
+		wantErr  string
+		wantCert bool
+	}{
+		{"disabled", map[string]string{"TLS_CERT_FILE": "", "TLS_KEY_FILE": "", "TLS_CA_FILE": ""}, true, "", false},
+		{"loaded", nil, false, "", true},
+		{"missing key", map[string]string{"TLS_KEY_FILE": ""}, true, "must all be set", false},
+		{"missing file", map[string]string{"TLS_CA_FILE": filepath.Join(dir, "nope.crt")}, true, "no such file", false},
+		{"key doesn't match", map[string]string{"TLS_KEY_FILE": filepath.Join(dir, "ca.crt")}, true, "key pair", false},
+		{"empty CA bundle", map[string]string{"TLS_CA_FILE": filepath.Join(dir, "empty.crt")}, true, "no certificates", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, err := newCertsFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newCertsFromEnv() error = %v, want it to mention %s", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if (c == nil) != tt.wantNil {
+				t.Fatalf("newCertsFromEnv() = %v, want nil %v", c, tt.wantNil)
+			}
+			if tt.wantCert {
+				if cert, pool := c.current(); cert == nil || pool == nil {
+					t.Errorf("current() = %v, %v, want a certificate and CA pool", cert, pool)
+				}
+			}
+		})
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	server := ca.loadCerts(t, "crew-service", true)
+	url := serve(t, server)
+
+	tests := []struct {
+		name    string
+		client  func() *http.Client
+		wantErr bool
+	}{
+		{"client signed by the CA", func() *http.Client {
+			return &http.Client{Transport: ca.loadCerts(t, "delivery-service", false).Transport()}
+		}, false},
+		{"no client certificate", func() *http.Client {
+			transport := ca.loadCerts(t, "delivery-service", false).Transport()
+			transport.TLSClientConfig.GetClientCertificate = nil
+			return &http.Client{Transport: transport}
+		}, true},
+		{"client from another CA", func() *http.Client {
+			return &http.Client{Transport: otherCA.loadCerts(t, "delivery-service", false).Transport()}
+		}, true},
+		{"server from another CA", func() *http.Client {
+			// Signed by the server's CA, but trusting only otherCA.
+			dir := t.TempDir()
+			ca.issue(t, dir, "delivery-service", false)
+			if err := os.WriteFile(filepath.Join(dir, "ca.crt"), otherCA.pem, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := newCertsFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &http.Client{Transport: c.Transport()}
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client().Get(url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GET over mTLS error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientVerifiesServerName(t *testing.T) {
+	ca := newTestCA(t)
+	addr := strings.TrimPrefix(serve(t, ca.loadCerts(t, "crew-service", false)), "https://")
+	_, port, _ := net.SplitHostPort(addr)
+
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{"crew-service", false},
+		{"ship-service", true},
+	}
+	for _, tt := range tests {
+		transport := ca.loadCerts(t, "delivery-service", false).Transport()
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + net.JoinHostPort(tt.host, port))
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("GET %s error = %v, want error %v", tt.host, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	oldCA, newCA := newTestCA(t), newTestCA(t)
+	dir := t.TempDir()
+	oldCA.issue(t, dir, "crew-service", true)
+	server, err := newCertsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serve(t, server)
+	client := &http.Client{Transport: newCA.loadCerts(t, "delivery-service", false).Transport()}
+	if resp, err := client.Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("GET succeeded before the server trusted the new CA")
+	}
+
+	// cert-manager rotates the secret; the server picks it up without a
+	// restart. The files' mtime may not move within the test, so push it.
+	newCA.issue(t, dir, "crew-service", true)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{"tls.crt", "tls.key", "ca.crt"} {
+		if err := os.Chtimes(filepath.Join(dir, f), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go server.watch(10 * time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server didn't pick up the rotated certificates: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
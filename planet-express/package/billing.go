@@ -0,0 +1,289 @@
+// package-service/billing.go
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	entryCharge = "charge"
+	entryRefund = "refund"
+
+	monthLayout = "2006-01"
+)
+
+var (
+	billing = newLedger()
+
+	errForbidden = errors.New("Customers can only see their own billing")
+
+	billedDollars = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_package_billed_dollars_total",
+			Help: "The total amount written to the billing ledger, by kind (charge, refund) and priority",
+		},
+		[]string{"kind", "priority"},
+	)
+
+	refundsIssued = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_package_refunds_total",
+			Help: "The total number of refunds issued for failed deliveries, by incident cause",
+		},
+		[]string{"cause"},
+	)
+)
+
+// LedgerEntry is one line of a customer's billing ledger. Refunds have a
+// negative Amount.
+type LedgerEntry struct {
+	ID        string    `json:"id"`
+	Customer  string    `json:"customer"`
+	PackageID string    `json:"package_id"`
+	Kind      string    `json:"kind"` // "charge" or "refund"
+	Amount    float64   `json:"amount"`
+	Priority  string    `json:"priority,omitempty"`
+	Hazard    string    `json:"hazard_class,omitempty"`
+	Status    string    `json:"status"` // the package's final status
+	Reason    string    `json:"reason,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Invoice totals a customer's ledger entries for one calendar month.
+type Invoice struct {
+	Customer string        `json:"customer"`
+	Month    string        `json:"month"` // YYYY-MM
+	Lines    []LedgerEntry `json:"lines"`
+	Charges  float64       `json:"charges"`
+	Refunds  float64       `json:"refunds"`
+	Total    float64       `json:"total"`
+	IssuedAt time.Time     `json:"issued_at"`
+}
+
+// ledger holds every customer's billing entries. Unlike packages, entries
+// are never pruned.
+type ledger struct {
+	mu      sync.Mutex
+	seq     int
+	entries map[string][]LedgerEntry // by customer
+}
+
+func newLedger() *ledger {
+	return &ledger{entries: make(map[string][]LedgerEntry)}
+}
+
+// customerOf is who pays for pkg: whoever requested it through the gateway,
+// or else its recipient.
+func customerOf(pkg Package) string {
+	return cmp.Or(pkg.CreatedBy, pkg.Recipient)
+}
+
+// settle bills pkg once it reaches a final status. Delivered and returned
+// packages are charged what was agreed; a returned package was recalled by
+// its sender after it flew. Failed packages are charged and refunded in
+// full. Cancelled packages never flew and aren't billed.
+func (l *ledger) settle(pkg Package) {
+	if pkg.Charge <= 0 {
+		return
+	}
+	switch pkg.Status {
+	case statusDelivered, statusReturned:
+		l.add(pkg, entryCharge, pkg.Charge, "")
+	case statusFailed:
+		reason, cause := "Delivery failed", "unknown"
+		if pkg.Incident != nil {
+			reason = cmp.Or(pkg.Incident.Reason, reason)
+			cause = cmp.Or(pkg.Incident.Cause, cause)
+		}
+		l.add(pkg, entryCharge, pkg.Charge, "")
+		l.add(pkg, entryRefund, -pkg.Charge, reason)
+		refundsIssued.WithLabelValues(cause).Inc()
+	}
+}
+
+func (l *ledger) add(pkg Package, kind string, amount float64, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	e := LedgerEntry{
+		ID:        fmt.Sprintf("L-%06d", l.seq),
+		Customer:  customerOf(pkg),
+		PackageID: pkg.ID,
+		Kind:      kind,
+		Amount:    amount,
+		Priority:  pkg.Priority,
+		Hazard:    pkg.Hazard,
+		Status:    pkg.Status,
+		Reason:    reason,
+		At:        clock.Now(),
+	}
+	l.entries[e.Customer] = append(l.entries[e.Customer], e)
+	billedDollars.WithLabelValues(kind, cmp.Or(pkg.Priority, "standard")).Add(math.Abs(amount))
+	slog.Info("Billed package", "id", e.ID, "customer", e.Customer, "package_id", pkg.ID, "kind", kind, "amount", amount)
+}
+
+// statement returns customer's entries, only those in month if it is set.
+func (l *ledger) statement(customer string, month time.Time) []LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := []LedgerEntry{}
+	for _, e := range l.entries[customer] {
+		if month.IsZero() || e.At.UTC().Format(monthLayout) == month.Format(monthLayout) {
+			lines = append(lines, e)
+		}
+	}
+	return lines
+}
+
+func (l *ledger) customers() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Sorted(maps.Keys(l.entries))
+}
+
+// invoice totals customer's entries for month. It returns nil if there are
+// none.
+func (l *ledger) invoice(customer string, month time.Time) *Invoice {
+	lines := l.statement(customer, month)
+	if len(lines) == 0 {
+		return nil
+	}
+	inv := &Invoice{Customer: customer, Month: month.Format(monthLayout), Lines: lines, IssuedAt: clock.Now()}
+	for _, e := range lines {
+		if e.Kind == entryRefund {
+			inv.Refunds += -e.Amount
+		} else {
+			inv.Charges += e.Amount
+		}
+	}
+	inv.Charges = math.Round(inv.Charges*100) / 100
+	inv.Refunds = math.Round(inv.Refunds*100) / 100
+	inv.Total = math.Round((inv.Charges-inv.Refunds)*100) / 100
+	return inv
+}
+
+// billingScope works out whose billing a request may see and which month it
+// is for. Customers only ever see their own; everyone else sees the
+// ?customer= asked for, or every customer if it is left out.
+func billingScope(r *http.Request) (customers []string, month time.Time, err error) {
+	q := r.URL.Query()
+	if m := q.Get("month"); m != "" {
+		if month, err = time.Parse(monthLayout, m); err != nil {
+			return nil, month, fmt.Errorf("month must be YYYY-MM, got %q", m)
+		}
+	}
+	switch {
+	case r.Header.Get(roleHeader) == "customer":
+		caller := r.Header.Get(callerHeader)
+		if c := q.Get("customer"); c != "" && c != caller {
+			return nil, month, errForbidden
+		}
+		return []string{caller}, month, nil
+	case q.Get("customer") != "":
+		return []string{q.Get("customer")}, month, nil
+	}
+	return billing.customers(), month, nil
+}
+
+// getLedger serves GET /billing/ledger?customer=&month=, the ledger entries
+// of one customer, or of every customer, optionally for a single month.
+func getLedger(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+	customers, month, err := billingScope(r)
+	if err != nil {
+		code := billingErrorCode(err)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(code)).Inc()
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	entries := []LedgerEntry{}
+	for _, c := range customers {
+		entries = append(entries, billing.statement(c, month)...)
+	}
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// getInvoices serves GET /billing/invoices?month=&customer=&format=, the
+// invoices for a month (the current one by default) as JSON or, with
+// format=csv, one CSV row per ledger line. Customers with nothing billed
+// that month get no invoice.
+func getInvoices(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+	fail := func(code int, msg string) {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(code)).Inc()
+		http.Error(w, msg, code)
+	}
+
+	customers, month, err := billingScope(r)
+	if err != nil {
+		fail(billingErrorCode(err), err.Error())
+		return
+	}
+	if month.IsZero() {
+		now := clock.Now().UTC()
+		month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	format := cmp.Or(r.URL.Query().Get("format"), "json")
+	if format != "json" && format != "csv" {
+		fail(http.StatusBadRequest, fmt.Sprintf("Unknown format %q; use json or csv", format))
+		return
+	}
+
+	invoices := []Invoice{}
+	for _, c := range customers {
+		if inv := billing.invoice(c, month); inv != nil {
+			invoices = append(invoices, *inv)
+		}
+	}
+	slog.Info("Generated invoices", "month", month.Format(monthLayout), "count", len(invoices), "format", format)
+
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invoices)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="invoices-%s.csv"`, month.Format(monthLayout)))
+	writeInvoicesCSV(w, invoices)
+}
+
+// writeInvoicesCSV writes a row per ledger line followed by a total row for
+// each invoice.
+func writeInvoicesCSV(w http.ResponseWriter, invoices []Invoice) {
+	money := func(f float64) string { return strconv.FormatFloat(f, 'f', 2, 64) }
+	out := csv.NewWriter(w)
+	out.Write([]string{"month", "customer", "entry_id", "at", "package_id", "kind", "priority", "hazard_class", "status", "reason", "amount"})
+	for _, inv := range invoices {
+		for _, e := range inv.Lines {
+			out.Write([]string{inv.Month, inv.Customer, e.ID, e.At.UTC().Format(time.RFC3339), e.PackageID,
+				e.Kind, e.Priority, e.Hazard, e.Status, e.Reason, money(e.Amount)})
+		}
+		out.Write([]string{inv.Month, inv.Customer, "", "", "", "total", "", "", "", "", money(inv.Total)})
+	}
+	out.Flush()
+}
+
+func billingErrorCode(err error) int {
+	if errors.Is(err, errForbidden) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
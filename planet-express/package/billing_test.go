@@ -0,0 +1,134 @@
+// package-service/billing_test.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+)
+
+func TestLedgerSettle(t *testing.T) {
+	useClock(t, time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC))
+	tests := []struct {
+		name      string
+		pkg       Package
+		wantKinds []string
+		wantTotal float64
+	}{
+		{"delivered", Package{Status: statusDelivered, Charge: 47.5}, []string{entryCharge}, 47.5},
+		{"returned", Package{Status: statusReturned, Charge: 47.5}, []string{entryCharge}, 47.5},
+		{"failed is refunded", Package{Status: statusFailed, Charge: 47.5}, []string{entryCharge, entryRefund}, 0},
+		{"cancelled isn't billed", Package{Status: statusCancelled, Charge: 47.5}, nil, 0},
+		{"free isn't billed", Package{Status: statusDelivered}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLedger()
+			tt.pkg.ID, tt.pkg.CreatedBy = "P1", "hermes"
+			l.settle(tt.pkg)
+
+			var kinds []string
+			var total float64
+			for _, e := range l.statement("hermes", time.Time{}) {
+				kinds = append(kinds, e.Kind)
+				total += e.Amount
+			}
+			if !slices.Equal(kinds, tt.wantKinds) || total != tt.wantTotal {
+				t.Errorf("settle() billed %v totalling %v, want %v totalling %v", kinds, total, tt.wantKinds, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestLedgerRefundReason(t *testing.T) {
+	l := newLedger()
+	l.settle(Package{ID: "P1", Recipient: "Fry", Status: statusFailed, Charge: 10,
+		Incident: &events.IncidentReport{Cause: "space_pirates", Reason: "Pirates"}})
+	lines := l.statement("Fry", time.Time{})
+	if len(lines) != 2 || lines[1].Kind != entryRefund || lines[1].Reason != "Pirates" {
+		t.Errorf("statement() = %+v, want a charge and a refund for Pirates billed to the recipient", lines)
+	}
+}
+
+func TestLedgerInvoice(t *testing.T) {
+	c := useClock(t, time.Time{})
+	march := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	l := newLedger()
+	bill := func(at time.Time, status string, charge float64) {
+		c.now = at
+		l.settle(Package{ID: "P", CreatedBy: "hermes", Status: status, Charge: charge})
+	}
+	// Three charges of 0.1 add up to 0.30000000000000004 in floating point.
+	bill(march.Add(time.Hour), statusDelivered, 0.1)
+	bill(march.Add(2*time.Hour), statusDelivered, 0.1)
+	bill(march.Add(3*time.Hour), statusDelivered, 0.1)
+	bill(march.Add(4*time.Hour), statusFailed, 19.99)
+	bill(march.AddDate(0, 1, 0), statusDelivered, 100)
+
+	tests := []struct {
+		name                    string
+		customer                string
+		month                   time.Time
+		wantNil                 bool
+		wantLines               int
+		charges, refunds, total float64
+	}{
+		{"march", "hermes", march, false, 5, 20.29, 19.99, 0.3},
+		{"april", "hermes", march.AddDate(0, 1, 0), false, 1, 100, 0, 100},
+		{"nothing billed", "hermes", march.AddDate(0, 2, 0), true, 0, 0, 0, 0},
+		{"someone else", "zapp", march, true, 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := l.invoice(tt.customer, tt.month)
+			if (inv == nil) != tt.wantNil {
+				t.Fatalf("invoice() = %+v, want nil %v", inv, tt.wantNil)
+			}
+			if inv == nil {
+				return
+			}
+			if len(inv.Lines) != tt.wantLines || inv.Charges != tt.charges || inv.Refunds != tt.refunds || inv.Total != tt.total {
+				t.Errorf("invoice() has %d lines, charges %v, refunds %v, total %v, want %d, %v, %v, %v",
+					len(inv.Lines), inv.Charges, inv.Refunds, inv.Total, tt.wantLines, tt.charges, tt.refunds, tt.total)
+			}
+		})
+	}
+}
+
+func TestBillingScope(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		role, caller  string
+		wantCustomers []string
+		wantErr       error
+	}{
+		{"customer sees their own", "", "customer", "hermes", []string{"hermes"}, nil},
+		{"customer asking for themselves", "customer=hermes", "customer", "hermes", []string{"hermes"}, nil},
+		{"customer asking for someone else", "customer=zapp", "customer", "hermes", nil, errForbidden},
+		{"admin asking for one customer", "customer=zapp", "admin", "boss", []string{"zapp"}, nil},
+		{"bad month", "month=March", "admin", "boss", nil, errors.New("month")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/billing/ledger?"+tt.query, nil)
+			r.Header.Set(roleHeader, tt.role)
+			r.Header.Set(callerHeader, tt.caller)
+			customers, _, err := billingScope(r)
+			if (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("billingScope() error = %v, want %v", err, tt.wantErr)
+			}
+			if errors.Is(tt.wantErr, errForbidden) && billingErrorCode(err) != http.StatusForbidden {
+				t.Errorf("billingErrorCode(%v) = %d, want %d", err, billingErrorCode(err), http.StatusForbidden)
+			}
+			if !slices.Equal(customers, tt.wantCustomers) {
+				t.Errorf("billingScope() = %v, want %v", customers, tt.wantCustomers)
+			}
+		})
+	}
+}
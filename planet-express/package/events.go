@@ -0,0 +1,74 @@
+// package-service/events.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deduper = events.NewDeduper(time.Hour)
+
+	eventsConsumed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_package_events_consumed_total",
+			Help: "The total number of delivery events consumed, by type and result (applied, duplicate, rejected, error)",
+		},
+		[]string{"type", "result"},
+	)
+)
+
+// consumeEvents keeps package statuses in step with delivery events.
+func consumeEvents(b events.Broker) error {
+	return b.Subscribe(events.DeliveriesSubject, "package-service", handleEvent)
+}
+
+func handleEvent(data []byte) error {
+	var ev events.Event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		eventsConsumed.WithLabelValues("unknown", "error").Inc()
+		return fmt.Errorf("invalid delivery event: %w", err)
+	}
+
+	update := StatusUpdate{ID: ev.PackageID}
+	switch ev.Type {
+	case events.Dispatched:
+		update.Status, update.Crew, update.Ship, update.ETA = statusInTransit, ev.Crew, ev.Ship, ev.ETA
+		update.FlightID = ev.FlightID
+	case events.Completed:
+		update.Status, update.Proof = statusDelivered, ev.Proof
+	case events.Failed:
+		update.Status, update.Incident = statusFailed, ev.Incident
+	case events.Cancelled:
+		update.Status = statusCancelled
+	case events.Recalled:
+		update.Status = statusReturned
+	default:
+		return nil
+	}
+	if !deduper.FirstTime(ev.ID) {
+		eventsConsumed.WithLabelValues(ev.Type, "duplicate").Inc()
+		return nil
+	}
+
+	_, code, err := applyStatusUpdate(update, "")
+	switch {
+	case err == nil:
+		eventsConsumed.WithLabelValues(ev.Type, "applied").Inc()
+	case code == http.StatusConflict || code == http.StatusNotFound:
+		// Retrying won't help: the package has moved on or is gone.
+		slog.Warn("Ignoring delivery event", "type", ev.Type, "package_id", ev.PackageID, "err", err)
+		eventsConsumed.WithLabelValues(ev.Type, "rejected").Inc()
+	default:
+		eventsConsumed.WithLabelValues(ev.Type, "error").Inc()
+		deduper.Forget(ev.ID)
+		return fmt.Errorf("applying %s to package %s: %w", ev.Type, ev.PackageID, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// package-service/ids.go
+package main
+
+import (
+	"crypto/rand"
+	"sync"
+)
+
+// crockford is Crockford's base32 alphabet, which sorts in the same order as
+// the values it encodes and leaves out easily confused letters.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// idGenerator produces ULIDs: a 48-bit millisecond timestamp followed by 80
+// random bits, encoded as 26 base32 characters. IDs sort by creation time.
+// Within a single millisecond the random part is incremented rather than
+// redrawn, so IDs from one generator are strictly increasing.
+type idGenerator struct {
+	prefix string
+	read   func([]byte) (int, error) // source of the random part
+
+	mu     sync.Mutex
+	lastMs uint64
+	random [10]byte
+}
+
+func newIDGenerator(prefix string) *idGenerator {
+	return &idGenerator{prefix: prefix, read: rand.Read}
+}
+
+func (g *idGenerator) next() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(clock.Now().UnixMilli())
+	if ms <= g.lastMs {
+		// Same millisecond, or the clock went backwards: keep counting from
+		// the last ID. If the random part overflows, borrow the next ms.
+		ms = g.lastMs
+		if !increment(g.random[:]) {
+			ms++
+		}
+	} else {
+		g.read(g.random[:])
+	}
+	g.lastMs = ms
+
+	var b [16]byte
+	for i := range 6 {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(b[6:], g.random[:])
+	return g.prefix + encodeULID(b)
+}
+
+// increment adds one to b as a big-endian number and reports false if it
+// wrapped around to zero.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID writes the 128 bits of b as 26 base32 characters, most
+// significant first. The leading character only carries 3 bits.
+func encodeULID(b [16]byte) string {
+	var out [26]byte
+	var acc uint64
+	bits := 2 // pad to 130 bits so the groups of 5 line up
+	pos := 0
+	for _, c := range b {
+		acc = acc<<8 | uint64(c)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = crockford[(acc>>bits)&31]
+			pos++
+		}
+	}
+	return string(out[:])
+}
@@ -0,0 +1,107 @@
+// package-service/ids_test.go
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/sim"
+)
+
+// fixedClock is a clock for tests that only moves when told to.
+type fixedClock struct {
+	sim.RealClock
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time { return c.now }
+
+// useClock replaces clock for the rest of t.
+func useClock(t *testing.T, now time.Time) *fixedClock {
+	t.Helper()
+	c := &fixedClock{now: now}
+	prev := clock
+	clock = c
+	t.Cleanup(func() { clock = prev })
+	return c
+}
+
+func TestEncodeULID(t *testing.T) {
+	tests := []struct {
+		name string
+		in   [16]byte
+		want string
+	}{
+		{"zero", [16]byte{}, "00000000000000000000000000"},
+		{"max", [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+		{"first ms", [16]byte{5: 1}, "00000000010000000000000000"},
+		{"last bit", [16]byte{15: 1}, "00000000000000000000000001"},
+		{"random part", [16]byte{6: 0x80}, "0000000000G000000000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeULID(tt.in); got != tt.want {
+				t.Errorf("encodeULID(%x) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	tests := []struct {
+		in, want []byte
+		ok       bool
+	}{
+		{[]byte{0, 0}, []byte{0, 1}, true},
+		{[]byte{0, 0xff}, []byte{1, 0}, true},
+		{[]byte{0xfe, 0xff}, []byte{0xff, 0}, true},
+		{[]byte{0xff, 0xff}, []byte{0, 0}, false},
+	}
+	for _, tt := range tests {
+		got := bytes.Clone(tt.in)
+		if ok := increment(got); ok != tt.ok || !bytes.Equal(got, tt.want) {
+			t.Errorf("increment(%x) = %x, %v, want %x, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestIDGeneratorNext(t *testing.T) {
+	start := time.UnixMilli(1_700_000_000_000)
+	tests := []struct {
+		name   string
+		random byte            // fills the random part on each new millisecond
+		steps  []time.Duration // clock offset from start for each ID
+	}{
+		{"new millisecond each time", 0x42, []time.Duration{0, time.Millisecond, time.Second}},
+		{"same millisecond", 0x42, []time.Duration{0, 0, 0, 0}},
+		{"clock goes backwards", 0x42, []time.Duration{time.Second, 0, -time.Hour}},
+		{"random part overflows", 0xff, []time.Duration{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useClock(t, start)
+			g := newIDGenerator("PE-")
+			g.read = func(b []byte) (int, error) {
+				for i := range b {
+					b[i] = tt.random
+				}
+				return len(b), nil
+			}
+
+			prev := ""
+			for i, step := range tt.steps {
+				c.now = start.Add(step)
+				id := g.next()
+				if len(id) != len("PE-")+26 || !strings.HasPrefix(id, "PE-") {
+					t.Fatalf("ID %d = %q, want PE- and 26 characters", i, id)
+				}
+				if id <= prev {
+					t.Errorf("ID %d = %s, not after %s", i, id, prev)
+				}
+				prev = id
+			}
+		})
+	}
+}
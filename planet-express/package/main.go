@@ -3,29 +3,79 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"math/rand/v2"
 	"net/http"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/gingercookie/planet-express/internal/health"
+	"github.com/gingercookie/planet-express/internal/sim"
+	"github.com/gingercookie/planet-express/internal/tlsconfig"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Package struct {
-	ID        string `json:"id"`
-	Recipient string `json:"recipient"`
-	Address   string `json:"address"`
-	Status    string `json:"status"` // "pending", "in-transit", "delivered"
-	Contents  string `json:"contents"`
+	ID        string    `json:"id"`
+	Recipient string    `json:"recipient"`
+	Address   string    `json:"address"`
+	Status    string    `json:"status"` // see status.go for the allowed transitions
+	Contents  string    `json:"contents"`
+	WeightKG  float64   `json:"weight_kg,omitempty"`
+	VolumeM3  float64   `json:"volume_m3,omitempty"`
+	Hazard    string    `json:"hazard_class,omitempty"` // checked against the contents by delivery-service
+	Priority  string    `json:"priority,omitempty"`
+	QuoteID   string    `json:"quote_id,omitempty"`
+	Charge    float64   `json:"charge"`               // in dollars, as agreed when the delivery was requested
+	CreatedBy string    `json:"created_by,omitempty"` // caller identity forwarded by the api gateway
+	CreatedAt time.Time `json:"created_at"`
+	Version   int       `json:"version"` // bumped on every update, also served as the ETag
+
+	// Set by delivery-service once the package is assigned to a flight.
+	// Packages batched together share a FlightID.
+	FlightID     string     `json:"flight_id,omitempty"`
+	Crew         string     `json:"crew,omitempty"`
+	Ship         string     `json:"ship,omitempty"`
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	ETA          *time.Time `json:"eta,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+
+	// Set when the package is delivered or fails respectively.
+	Proof    *events.ProofOfDelivery `json:"proof,omitempty"`
+	Incident *events.IncidentReport  `json:"incident,omitempty"`
 }
 
+const (
+	// Set by the api gateway on proxied requests.
+	callerHeader = "X-Planet-Express-Caller"
+	roleHeader   = "X-Planet-Express-Role"
+)
+
 var (
+	// clock and rng drive everything simulated. main replaces them from
+	// the SIM_* variables at startup.
+	clock sim.Clock = sim.RealClock{}
+	rng             = sim.NewRand(rand.Uint64())
+
 	packages = make(map[string]Package)
 	mu       sync.Mutex
 
+	// ids hands out time-sortable package IDs, optionally prefixed with
+	// PACKAGE_ID_PREFIX (e.g. "pkg_").
+	ids = newIDGenerator(os.Getenv("PACKAGE_ID_PREFIX"))
+
+	errNotYours = errors.New("Customers can only see their own packages")
+
+	// finished records when each package reached a final status, so that it
+	// can be pruned once PACKAGE_RETENTION has passed.
+	finished = make(map[string]time.Time)
+
 	requestsReceived = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "planet_express_package_requests_received_total",
@@ -53,24 +103,58 @@ func createPackage(w http.ResponseWriter, r *http.Request) {
 	}
 	mu.Lock()
 	defer mu.Unlock()
-	pkg.ID = randomID()
-	pkg.Status = "pending"
+	pkg.ID = newPackageID()
+	pkg.Status = statusPending
+	pkg.Version = 1
+	pkg.CreatedAt = clock.Now()
+	pkg.CreatedBy = r.Header.Get(callerHeader)
 	packages[pkg.ID] = pkg
+	slog.Info("Created package", "id", pkg.ID, "created_by", pkg.CreatedBy)
 	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusCreated)).Inc()
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(pkg)
 }
 
+// listPackages supports filtering by status (comma-separated), recipient,
+// address, contents, flight_id, hazard_class and created_after, and sorting
+// with sort=[-]field. It returns a JSON array of every match, unless limit or
+// cursor is given; then it returns a PackagePage to page through with the
+// next_cursor.
 func listPackages(w http.ResponseWriter, r *http.Request) {
 	requestsReceived.WithLabelValues(r.Method).Inc()
-	mu.Lock()
-	defer mu.Unlock()
-	list := make([]Package, 0, len(packages))
-	for _, pkg := range packages {
-		list = append(list, pkg)
+	query, err := parsePackageQuery(r.URL.Query())
+	if err != nil {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get(roleHeader) == "customer" {
+		caller := r.Header.Get(callerHeader)
+		query.createdBy = &caller
 	}
+
+	mu.Lock()
+	page := query.run(packages)
+	mu.Unlock()
+
 	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
-	json.NewEncoder(w).Encode(list)
+	w.Header().Set("Content-Type", "application/json")
+	if !query.paged {
+		json.NewEncoder(w).Encode(page.Packages)
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// etag is the entity tag for a package version.
+func etag(pkg Package) string {
+	return `"` + strconv.Itoa(pkg.Version) + `"`
+}
+
+// canSee reports whether the caller of r may see pkg. Customers can only see
+// packages they requested.
+func canSee(r *http.Request, pkg Package) bool {
+	return r.Header.Get(roleHeader) != "customer" || pkg.CreatedBy == r.Header.Get(callerHeader)
 }
 
 func getPackage(w http.ResponseWriter, r *http.Request) {
@@ -80,7 +164,13 @@ func getPackage(w http.ResponseWriter, r *http.Request) {
 	mu.Lock()
 	defer mu.Unlock()
 	if pkg, ok := packages[id]; ok {
+		if !canSee(r, pkg) {
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusForbidden)).Inc()
+			http.Error(w, errNotYours.Error(), http.StatusForbidden)
+			return
+		}
 		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+		w.Header().Set("ETag", etag(pkg))
 		json.NewEncoder(w).Encode(pkg)
 	} else {
 		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
@@ -88,29 +178,111 @@ func getPackage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// StatusUpdate is the body of PATCH/POST /packages/update. Version is
+// optional; when set, the update only applies if the package is still at
+// that version. An If-Match header works the same way.
+//
+// Crew, Ship, FlightID and ETA are recorded when a package goes in-transit,
+// which requires Crew and Ship to be set. Proof is recorded when it is
+// delivered and Incident when it fails.
+type StatusUpdate struct {
+	ID       string                  `json:"id"`
+	Status   string                  `json:"status"`
+	Version  *int                    `json:"version,omitempty"`
+	Crew     string                  `json:"crew,omitempty"`
+	Ship     string                  `json:"ship,omitempty"`
+	FlightID string                  `json:"flight_id,omitempty"`
+	ETA      *time.Time              `json:"eta,omitempty"`
+	Proof    *events.ProofOfDelivery `json:"proof,omitempty"`
+	Incident *events.IncidentReport  `json:"incident,omitempty"`
+}
+
 func updatePackageStatus(w http.ResponseWriter, r *http.Request) {
 	requestsReceived.WithLabelValues(r.Method).Inc()
 	slog.Info("Received request to update package status")
-	id := r.URL.Query().Get("id")
-	status := r.URL.Query().Get("status")
-	if status == "" {
+	if r.Method != http.MethodPatch && r.Method != http.MethodPost {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusMethodNotAllowed)).Inc()
+		http.Error(w, "PATCH or POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var update StatusUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
 		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
-		http.Error(w, "Missing status", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validStatus(update.Status) {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+		http.Error(w, fmt.Sprintf("Unknown status %q", update.Status), http.StatusBadRequest)
+		return
+	}
+	if update.Status == statusInTransit && (update.Crew == "" || update.Ship == "") {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+		http.Error(w, "crew and ship are required to mark a package in-transit", http.StatusBadRequest)
 		return
 	}
+
+	pkg, code, err := applyStatusUpdate(update, r.Header.Get("If-Match"))
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(code)).Inc()
+	if pkg.Version > 0 {
+		w.Header().Set("ETag", etag(pkg))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	json.NewEncoder(w).Encode(pkg)
+}
+
+// applyStatusUpdate moves a package to a new status. ifMatch, when set, must
+// be the package's current ETag. It returns the package as it now stands,
+// along with the HTTP status describing the outcome. Moving a package to the
+// status it already has is a no-op, so repeated updates are harmless.
+func applyStatusUpdate(update StatusUpdate, ifMatch string) (Package, int, error) {
 	mu.Lock()
 	defer mu.Unlock()
-	if pkg, ok := packages[id]; ok {
-		pkg.Status = status
-		packages[id] = pkg
-		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
-		json.NewEncoder(w).Encode(pkg)
-		slog.Info("Successfully updated package status", "id", pkg.ID, "status", status)
-	} else {
-		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
-		http.NotFound(w, r)
-		slog.Warn("Package was not found", "id", id)
+	pkg, ok := packages[update.ID]
+	if !ok {
+		slog.Warn("Package was not found", "id", update.ID)
+		return Package{}, http.StatusNotFound, fmt.Errorf("package %s not found", update.ID)
 	}
+
+	if ifMatch != "" && ifMatch != etag(pkg) {
+		return pkg, http.StatusPreconditionFailed, fmt.Errorf("Package has been modified")
+	}
+	if update.Version != nil && *update.Version != pkg.Version {
+		return pkg, http.StatusConflict, fmt.Errorf("Package is at version %d, not %d", pkg.Version, *update.Version)
+	}
+	if pkg.Status == update.Status {
+		return pkg, http.StatusOK, nil
+	}
+	if !canTransition(pkg.Status, update.Status) {
+		slog.Warn("Rejected illegal status transition", "id", pkg.ID, "from", pkg.Status, "to", update.Status)
+		return pkg, http.StatusConflict, fmt.Errorf("Cannot move package from %s to %s", pkg.Status, update.Status)
+	}
+
+	now := clock.Now()
+	pkg.Status = update.Status
+	pkg.Version++
+	if pkg.Status == statusInTransit {
+		pkg.Crew, pkg.Ship, pkg.FlightID, pkg.ETA = update.Crew, update.Ship, update.FlightID, update.ETA
+		pkg.DispatchedAt = &now
+	}
+	switch pkg.Status {
+	case statusDelivered:
+		pkg.Proof = update.Proof
+	case statusFailed:
+		pkg.Incident = update.Incident
+	}
+	if isFinal(pkg.Status) {
+		pkg.CompletedAt = &now
+		finished[pkg.ID] = now
+		billing.settle(pkg)
+	}
+	packages[pkg.ID] = pkg
+	slog.Info("Successfully updated package status", "id", pkg.ID, "status", pkg.Status, "version", pkg.Version)
+	return pkg, http.StatusOK, nil
 }
 
 func deletePackage(w http.ResponseWriter, r *http.Request) {
@@ -137,17 +309,45 @@ func deletePackage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	delete(packages, id)
+	delete(finished, id)
 	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
 	w.WriteHeader(http.StatusOK)
 }
 
-func randomID() string {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, 8)
-	for i := range b {
-		b[i] = letters[rand.IntN(len(letters))]
+// prunePackages removes packages that finished more than retention ago, so
+// the map doesn't grow without bound while still letting clients see the
+// final status of recent deliveries.
+func prunePackages(retention time.Duration) {
+	ticker := time.NewTicker(max(retention/10, time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := clock.Now().Add(-retention)
+		mu.Lock()
+		pruned := 0
+		for id, at := range finished {
+			if at.Before(cutoff) {
+				delete(packages, id)
+				delete(finished, id)
+				pruned++
+			}
+		}
+		mu.Unlock()
+		if pruned > 0 {
+			slog.Debug("Pruned finished packages", "count", pruned)
+		}
+	}
+}
+
+// newPackageID returns an ID not used by any stored package. The caller must
+// hold mu.
+func newPackageID() string {
+	for {
+		id := ids.next()
+		if _, taken := packages[id]; !taken {
+			return id
+		}
+		slog.Warn("Package ID collision, generating another", "id", id)
 	}
-	return string(b)
 }
 
 func main() {
@@ -163,6 +363,43 @@ func main() {
 
 	prometheus.MustRegister(requestsReceived)
 	prometheus.MustRegister(requestsProcessed)
+	prometheus.MustRegister(eventsConsumed)
+	prometheus.MustRegister(billedDollars)
+	prometheus.MustRegister(refundsIssued)
+
+	var err error
+	if clock, rng, err = sim.FromEnv(); err != nil {
+		slog.Error("Invalid simulation settings", "err", err)
+		os.Exit(1)
+	}
+	if os.Getenv("SIM_SEED") != "" {
+		// Seeded runs get reproducible package IDs too.
+		ids.read = rng.Read
+	}
+
+	retention := 10 * time.Minute
+	if val, err := time.ParseDuration(os.Getenv("PACKAGE_RETENTION")); err == nil && val > 0 {
+		retention = val
+	}
+	go prunePackages(retention)
+
+	certs, err := tlsconfig.FromEnv()
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "err", err)
+		os.Exit(1)
+	}
+
+	broker, err := events.NewBrokerFromEnv("package-service")
+	if err != nil {
+		slog.Error("Unable to set up event broker", "err", err)
+		os.Exit(1)
+	}
+	if _, ok := broker.(*events.MemoryBroker); ok {
+		slog.Info("No event broker configured; delivery-service will update packages over HTTP")
+	} else if err := consumeEvents(broker); err != nil {
+		slog.Error("Unable to subscribe to delivery events", "err", err)
+		os.Exit(1)
+	}
 
 	packageMux := http.NewServeMux()
 	packageMux.HandleFunc("/packages", func(w http.ResponseWriter, r *http.Request) {
@@ -173,11 +410,20 @@ func main() {
 		}
 	})
 	packageMux.HandleFunc("/packages/get", getPackage)
+	packageMux.HandleFunc("GET /packages/proof", getProof)
+	packageMux.HandleFunc("GET /packages/incident", getIncident)
+	packageMux.HandleFunc("GET /billing/ledger", getLedger)
+	packageMux.HandleFunc("GET /billing/invoices", getInvoices)
 	packageMux.HandleFunc("/packages/update", updatePackageStatus)
 	packageMux.HandleFunc("/packages/delete", deletePackage)
+	packageMux.HandleFunc("/healthz", health.Healthz)
+	packageMux.HandleFunc("/readyz", health.Ready)
 
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
+	// Probes can't present client certificates, so serve them here as well.
+	metricsMux.HandleFunc("/healthz", health.Healthz)
+	metricsMux.HandleFunc("/readyz", health.Ready)
 
 	go func() {
 		slog.Info("Prometheus metrics endpoint running", "addr", ":2112")
@@ -187,8 +433,8 @@ func main() {
 		}
 	}()
 
-	slog.Info("PackageService running", "addr", ":8080")
-	if err := http.ListenAndServe(":8080", packageMux); err != nil {
+	slog.Info("PackageService running", "addr", ":8080", "mtls", certs != nil)
+	if err := tlsconfig.ListenAndServe(":8080", packageMux, certs); err != nil {
 		slog.Error("server error", "err", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,63 @@
+// package-service/records.go
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// getProof serves GET /packages/proof?id=, the proof of delivery of a
+// delivered package.
+func getProof(w http.ResponseWriter, r *http.Request) {
+	serveRecord(w, r, "proof of delivery", func(pkg Package) any {
+		if pkg.Proof == nil {
+			return nil
+		}
+		return pkg.Proof
+	})
+}
+
+// getIncident serves GET /packages/incident?id=, the incident report of a
+// failed package.
+func getIncident(w http.ResponseWriter, r *http.Request) {
+	serveRecord(w, r, "incident report", func(pkg Package) any {
+		if pkg.Incident == nil {
+			return nil
+		}
+		return pkg.Incident
+	})
+}
+
+// serveRecord writes the record that get picks out of the package with
+// ?id=, or a 404 naming what is missing.
+func serveRecord(w http.ResponseWriter, r *http.Request, kind string, get func(Package) any) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+	id := r.URL.Query().Get("id")
+	slog.Debug("Received request for package record", "id", id, "kind", kind)
+
+	mu.Lock()
+	pkg, ok := packages[id]
+	mu.Unlock()
+	if !ok {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
+		http.NotFound(w, r)
+		return
+	}
+	if !canSee(r, pkg) {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusForbidden)).Inc()
+		http.Error(w, errNotYours.Error(), http.StatusForbidden)
+		return
+	}
+	record := get(pkg)
+	if record == nil {
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
+		http.Error(w, "Package "+id+" is "+pkg.Status+" and has no "+kind, http.StatusNotFound)
+		return
+	}
+
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
@@ -0,0 +1,78 @@
+// package-service/records_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gingercookie/planet-express/internal/events"
+)
+
+func TestStatusUpdateRecords(t *testing.T) {
+	proof := &events.ProofOfDelivery{Crew: "Fry", Recipient: "Hermes", PhotoRef: "pod-photos/FL-1/P1.jpg"}
+	incident := &events.IncidentReport{Location: "Neptune", Cause: "crew", Reason: "Fry ate it"}
+	tests := []struct {
+		name         string
+		update       StatusUpdate
+		wantProof    bool
+		wantIncident bool
+	}{
+		{"delivered with proof", StatusUpdate{ID: "P1", Status: statusDelivered, Proof: proof}, true, false},
+		{"failed with incident", StatusUpdate{ID: "P1", Status: statusFailed, Incident: incident}, false, true},
+		{"incident only kept on failure", StatusUpdate{ID: "P1", Status: statusDelivered, Proof: proof, Incident: incident}, true, false},
+		{"proof only kept on delivery", StatusUpdate{ID: "P1", Status: statusReturned, Proof: proof}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPackages(t, Package{ID: "P1", Status: statusInTransit, Crew: "Fry", Ship: "Nimbus"})
+			pkg, code, err := applyStatusUpdate(tt.update, "")
+			if err != nil {
+				t.Fatalf("applyStatusUpdate() = %d, %v", code, err)
+			}
+			if (pkg.Proof != nil) != tt.wantProof || (pkg.Incident != nil) != tt.wantIncident {
+				t.Errorf("proof %+v, incident %+v; want proof %v, incident %v", pkg.Proof, pkg.Incident, tt.wantProof, tt.wantIncident)
+			}
+		})
+	}
+}
+
+func TestServeRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		id       string
+		customer string // the calling customer, if any
+		wantCode int
+		wantBody string
+	}{
+		{"proof", getProof, "P1", "", http.StatusOK, `"recipient":"Hermes"`},
+		{"incident", getIncident, "P2", "", http.StatusOK, `"cause":"crew"`},
+		{"no proof for a failed package", getProof, "P2", "", http.StatusNotFound, "P2 is failed and has no proof of delivery"},
+		{"no incident for a delivered package", getIncident, "P1", "", http.StatusNotFound, "P1 is delivered and has no incident report"},
+		{"in the air", getProof, "P3", "", http.StatusNotFound, "P3 is in-transit"},
+		{"unknown package", getIncident, "P9", "", http.StatusNotFound, "not found"},
+		{"customer's own package", getProof, "P1", "hermes", http.StatusOK, `"recipient":"Hermes"`},
+		{"someone else's package", getIncident, "P2", "zapp", http.StatusForbidden, "only see their own"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPackages(t,
+				Package{ID: "P1", Status: statusDelivered, CreatedBy: "hermes", Proof: &events.ProofOfDelivery{Recipient: "Hermes"}},
+				Package{ID: "P2", Status: statusFailed, CreatedBy: "hermes", Incident: &events.IncidentReport{Cause: "crew"}},
+				Package{ID: "P3", Status: statusInTransit},
+			)
+			r := httptest.NewRequest(http.MethodGet, "/packages/record?id="+tt.id, nil)
+			if tt.customer != "" {
+				r.Header.Set(roleHeader, "customer")
+				r.Header.Set(callerHeader, tt.customer)
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("GET %s = %d %q, want %d containing %q", tt.id, w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// package-service/search.go
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// PackagePage is one page of GET /packages results.
+type PackagePage struct {
+	Packages   []Package `json:"packages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// packageQuery holds the filters, sort order and page position parsed from
+// the GET /packages query string.
+type packageQuery struct {
+	statuses     []string
+	recipient    string
+	address      string
+	contents     string
+	flightID     string
+	hazard       string
+	createdAfter time.Time
+	createdBy    *string // set for customers, who only see their own packages
+
+	sortField string // "created_at", "id", "recipient" or "status"
+	desc      bool
+
+	limit int
+	after *pageCursor
+	// paged is set when the client asked for a limit or a cursor. Other
+	// requests get every match as a plain array, as GET /packages always
+	// returned.
+	paged bool
+}
+
+// pageCursor marks the last package of the previous page. It is handed to
+// clients as opaque base64 JSON.
+type pageCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"id"`
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+func parsePackageQuery(q url.Values) (packageQuery, error) {
+	pq := packageQuery{
+		recipient: strings.ToLower(q.Get("recipient")),
+		address:   strings.ToLower(q.Get("address")),
+		contents:  strings.ToLower(q.Get("contents")),
+		flightID:  q.Get("flight_id"),
+		hazard:    q.Get("hazard_class"),
+		sortField: "created_at",
+		limit:     defaultPageSize,
+	}
+
+	if s := q.Get("status"); s != "" {
+		pq.statuses = strings.Split(s, ",")
+	}
+	if s := q.Get("created_after"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return pq, fmt.Errorf("created_after must be an RFC 3339 timestamp")
+		}
+		pq.createdAfter = t
+	}
+
+	if s := q.Get("sort"); s != "" {
+		pq.desc = strings.HasPrefix(s, "-")
+		pq.sortField = strings.TrimPrefix(s, "-")
+		switch pq.sortField {
+		case "created_at", "id", "recipient", "status":
+		default:
+			return pq, fmt.Errorf("cannot sort by %q", pq.sortField)
+		}
+	}
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return pq, fmt.Errorf("limit must be a positive integer")
+		}
+		pq.limit = min(n, maxPageSize)
+		pq.paged = true
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return pq, err
+		}
+		if c.Sort != pq.sortParam() {
+			return pq, fmt.Errorf("cursor was issued for a different sort order")
+		}
+		pq.after = c
+		pq.paged = true
+	}
+	return pq, nil
+}
+
+// sortParam is the canonical form of the sort parameter, e.g. "-created_at".
+func (pq packageQuery) sortParam() string {
+	if pq.desc {
+		return "-" + pq.sortField
+	}
+	return pq.sortField
+}
+
+func (pq packageQuery) matches(pkg Package) bool {
+	switch {
+	case len(pq.statuses) > 0 && !slices.Contains(pq.statuses, pkg.Status):
+		return false
+	case pq.recipient != "" && !strings.Contains(strings.ToLower(pkg.Recipient), pq.recipient):
+		return false
+	case pq.address != "" && !strings.Contains(strings.ToLower(pkg.Address), pq.address):
+		return false
+	case pq.contents != "" && !strings.Contains(strings.ToLower(pkg.Contents), pq.contents):
+		return false
+	case pq.flightID != "" && pkg.FlightID != pq.flightID:
+		return false
+	case pq.hazard != "" && pkg.Hazard != pq.hazard:
+		return false
+	case !pq.createdAfter.IsZero() && !pkg.CreatedAt.After(pq.createdAfter):
+		return false
+	case pq.createdBy != nil && pkg.CreatedBy != *pq.createdBy:
+		return false
+	}
+	return true
+}
+
+// sortKey returns the value packages are ordered by. Timestamps are
+// formatted so that they sort correctly as strings.
+func (pq packageQuery) sortKey(pkg Package) string {
+	switch pq.sortField {
+	case "id":
+		return pkg.ID
+	case "recipient":
+		return pkg.Recipient
+	case "status":
+		return pkg.Status
+	}
+	return pkg.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// compare orders by the sort key, then by ID so the order is stable across pages.
+func (pq packageQuery) compare(aKey, aID, bKey, bID string) int {
+	c := cmp.Or(strings.Compare(aKey, bKey), strings.Compare(aID, bID))
+	if pq.desc {
+		return -c
+	}
+	return c
+}
+
+// run filters, sorts and pages through all, returning one page.
+func (pq packageQuery) run(all map[string]Package) PackagePage {
+	list := make([]Package, 0)
+	for _, pkg := range all {
+		if !pq.matches(pkg) {
+			continue
+		}
+		if pq.after != nil && pq.compare(pq.sortKey(pkg), pkg.ID, pq.after.Key, pq.after.ID) <= 0 {
+			continue
+		}
+		list = append(list, pkg)
+	}
+	slices.SortFunc(list, func(a, b Package) int {
+		return pq.compare(pq.sortKey(a), a.ID, pq.sortKey(b), b.ID)
+	})
+
+	page := PackagePage{Packages: list}
+	if pq.paged && len(list) > pq.limit {
+		page.Packages = list[:pq.limit]
+		last := page.Packages[pq.limit-1]
+		page.NextCursor = pageCursor{Sort: pq.sortParam(), Key: pq.sortKey(last), ID: last.ID}.encode()
+	}
+	return page
+}
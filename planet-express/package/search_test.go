@@ -0,0 +1,161 @@
+// package-service/search_test.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParsePackageQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		wantErr   bool
+		wantPaged bool
+		wantLimit int
+		wantSort  string
+	}{
+		{"", false, false, defaultPageSize, "created_at"},
+		{"sort=-recipient", false, false, defaultPageSize, "-recipient"},
+		{"limit=10", false, true, 10, "created_at"},
+		{"limit=100000", false, true, maxPageSize, "created_at"},
+		{"cursor=" + pageCursor{Sort: "id", Key: "A", ID: "A"}.encode() + "&sort=id", false, true, defaultPageSize, "id"},
+		{"limit=0", true, false, 0, ""},
+		{"limit=ten", true, false, 0, ""},
+		{"sort=weight", true, false, 0, ""},
+		{"created_after=yesterday", true, false, 0, ""},
+		{"cursor=not-base64!", true, false, 0, ""},
+		{"cursor=" + pageCursor{Sort: "id"}.encode() + "&sort=-id", true, false, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			pq, err := parsePackageQuery(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePackageQuery(%q) error = %v, want error %v", tt.query, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if pq.paged != tt.wantPaged || pq.limit != tt.wantLimit || pq.sortParam() != tt.wantSort {
+				t.Errorf("parsePackageQuery(%q) = paged %v, limit %d, sort %s, want %v, %d, %s",
+					tt.query, pq.paged, pq.limit, pq.sortParam(), tt.wantPaged, tt.wantLimit, tt.wantSort)
+			}
+		})
+	}
+}
+
+func TestPackageQueryRun(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	all := make(map[string]Package)
+	recipients := []string{"Fry", "Leela", "Bender"}
+	for i := range 7 {
+		id := fmt.Sprintf("P%d", i)
+		// Pairs of packages share a timestamp, so paging has to fall back
+		// to the ID to keep its place.
+		all[id] = Package{ID: id, Recipient: recipients[i%3], Status: statusPending, CreatedAt: start.Add(time.Duration(i/2) * time.Second)}
+	}
+
+	tests := []struct {
+		query string
+		want  []string // IDs across every page, in order
+		pages int
+	}{
+		{"", []string{"P0", "P1", "P2", "P3", "P4", "P5", "P6"}, 1},
+		{"limit=3", []string{"P0", "P1", "P2", "P3", "P4", "P5", "P6"}, 3},
+		{"limit=2&sort=-created_at", []string{"P6", "P5", "P4", "P3", "P2", "P1", "P0"}, 4},
+		{"limit=2&sort=recipient", []string{"P2", "P5", "P0", "P3", "P6", "P1", "P4"}, 4},
+		{"limit=7", []string{"P0", "P1", "P2", "P3", "P4", "P5", "P6"}, 1},
+		{"limit=1&recipient=lee", []string{"P1", "P4"}, 2},
+		{"status=delivered", []string{}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got := []string{}
+			q, _ := url.ParseQuery(tt.query)
+			for pages := 1; ; pages++ {
+				pq, err := parsePackageQuery(q)
+				if err != nil {
+					t.Fatalf("parsePackageQuery(%q): %v", q.Encode(), err)
+				}
+				page := pq.run(all)
+				for _, pkg := range page.Packages {
+					got = append(got, pkg.ID)
+				}
+				if page.NextCursor == "" {
+					if pages != tt.pages {
+						t.Errorf("got %d pages, want %d", pages, tt.pages)
+					}
+					break
+				}
+				if pages > len(all) {
+					t.Fatalf("still paging after %d pages", pages)
+				}
+				q.Set("cursor", page.NextCursor)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListPackages(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		caller   string
+		query    string
+		want     []string
+		wantNext bool
+	}{
+		{"dispatcher sees everything", "dispatcher", "ops", "", []string{"P1", "P2", "P3"}, false},
+		{"no caller headers", "", "", "", []string{"P1", "P2", "P3"}, false},
+		{"customer sees their own", "customer", "hermes", "", []string{"P1", "P3"}, false},
+		{"customer's own, paged", "customer", "hermes", "limit=1", []string{"P1"}, true},
+		{"customer with no packages", "customer", "zapp", "", []string{}, false},
+		{"customer without a name", "customer", "", "", []string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Unix(1_700_000_000, 0)
+			withPackages(t,
+				Package{ID: "P1", Status: statusPending, CreatedBy: "hermes", CreatedAt: start},
+				Package{ID: "P2", Status: statusPending, CreatedBy: "amy", CreatedAt: start.Add(time.Second)},
+				Package{ID: "P3", Status: statusPending, CreatedBy: "hermes", CreatedAt: start.Add(2 * time.Second)},
+			)
+			r := httptest.NewRequest(http.MethodGet, "/packages?"+tt.query, nil)
+			if tt.role != "" {
+				r.Header.Set(roleHeader, tt.role)
+				r.Header.Set(callerHeader, tt.caller)
+			}
+			w := httptest.NewRecorder()
+			listPackages(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /packages?%s = %d %q", tt.query, w.Code, w.Body.String())
+			}
+
+			// Unpaged requests get a plain array.
+			var page PackagePage
+			var body any = &page
+			if tt.query == "" {
+				body = &page.Packages
+			}
+			if err := json.NewDecoder(w.Body).Decode(body); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, pkg := range page.Packages {
+				got = append(got, pkg.ID)
+			}
+			if !slices.Equal(got, tt.want) || (page.NextCursor != "") != tt.wantNext {
+				t.Errorf("GET /packages?%s = %v, next cursor %q, want %v, next %v", tt.query, got, page.NextCursor, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
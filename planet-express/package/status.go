@@ -0,0 +1,39 @@
+// package-service/status.go
+package main
+
+import "slices"
+
+const (
+	statusPending   = "pending"
+	statusInTransit = "in-transit"
+	statusDelivered = "delivered"
+	statusFailed    = "failed"
+	statusReturned  = "returned"
+	statusCancelled = "cancelled"
+)
+
+// transitions lists the statuses a package may move to from each status.
+// Statuses with no outgoing transitions are final.
+var transitions = map[string][]string{
+	// pending packages fail without flying when dispatch goes wrong, and
+	// can be cancelled while they wait for a flight.
+	statusPending:   {statusInTransit, statusFailed, statusCancelled},
+	statusInTransit: {statusDelivered, statusFailed, statusReturned},
+	statusDelivered: {},
+	statusFailed:    {},
+	statusReturned:  {},
+	statusCancelled: {},
+}
+
+func validStatus(status string) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+func canTransition(from, to string) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+func isFinal(status string) bool {
+	return len(transitions[status]) == 0
+}
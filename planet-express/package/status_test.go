@@ -0,0 +1,113 @@
+// package-service/status_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withPackages replaces the package store with pkgs for the rest of t.
+func withPackages(t *testing.T, pkgs ...Package) {
+	t.Helper()
+	prev, prevFinished := packages, finished
+	packages, finished = make(map[string]Package), make(map[string]time.Time)
+	for _, pkg := range pkgs {
+		packages[pkg.ID] = pkg
+	}
+	t.Cleanup(func() { packages, finished = prev, prevFinished })
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{statusPending, statusInTransit, true},
+		{statusPending, statusFailed, true},
+		{statusPending, statusDelivered, false},
+		{statusPending, statusReturned, false},
+		{statusPending, statusCancelled, true},
+		{statusInTransit, statusCancelled, false},
+		{statusInTransit, statusDelivered, true},
+		{statusInTransit, statusFailed, true},
+		{statusInTransit, statusReturned, true},
+		{statusInTransit, statusPending, false},
+		{statusDelivered, statusFailed, false},
+		{statusFailed, statusInTransit, false},
+		{statusReturned, statusPending, false},
+		{statusCancelled, statusPending, false},
+		{"lost", statusDelivered, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestIsFinal(t *testing.T) {
+	for status := range maps.Keys(transitions) {
+		want := status != statusPending && status != statusInTransit
+		if got := isFinal(status); got != want {
+			t.Errorf("isFinal(%s) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestUpdatePackageStatus(t *testing.T) {
+	version := func(v int) *int { return &v }
+	pending := Package{ID: "P1", Status: statusPending, Version: 3}
+
+	tests := []struct {
+		name        string
+		update      StatusUpdate
+		ifMatch     string
+		wantCode    int
+		wantStatus  string
+		wantVersion int
+	}{
+		{"dispatch", StatusUpdate{ID: "P1", Status: statusInTransit, Crew: "Fry", Ship: "Planet Express Ship"}, "", http.StatusOK, statusInTransit, 4},
+		{"dispatch without a crew", StatusUpdate{ID: "P1", Status: statusInTransit, Ship: "Planet Express Ship"}, "", http.StatusBadRequest, statusPending, 3},
+		{"matching etag", StatusUpdate{ID: "P1", Status: statusFailed}, `"3"`, http.StatusOK, statusFailed, 4},
+		{"stale etag", StatusUpdate{ID: "P1", Status: statusFailed}, `"2"`, http.StatusPreconditionFailed, statusPending, 3},
+		{"matching version", StatusUpdate{ID: "P1", Status: statusFailed, Version: version(3)}, "", http.StatusOK, statusFailed, 4},
+		{"stale version", StatusUpdate{ID: "P1", Status: statusFailed, Version: version(2)}, "", http.StatusConflict, statusPending, 3},
+		{"illegal transition", StatusUpdate{ID: "P1", Status: statusReturned}, "", http.StatusConflict, statusPending, 3},
+		{"unknown status", StatusUpdate{ID: "P1", Status: "lost"}, "", http.StatusBadRequest, statusPending, 3},
+		{"unknown package", StatusUpdate{ID: "P2", Status: statusFailed}, "", http.StatusNotFound, statusPending, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPackages(t, pending)
+			body, err := json.Marshal(tt.update)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPatch, "/packages/update", bytes.NewReader(body))
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			updatePackageStatus(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			stored := packages["P1"]
+			if stored.Status != tt.wantStatus || stored.Version != tt.wantVersion {
+				t.Errorf("package is %s at version %d, want %s at version %d", stored.Status, stored.Version, tt.wantStatus, tt.wantVersion)
+			}
+			if _, ok := finished["P1"]; ok != isFinal(tt.wantStatus) {
+				t.Errorf("finished = %v, want %v", ok, isFinal(tt.wantStatus))
+			}
+			if w.Code == http.StatusOK && w.Header().Get("ETag") != `"`+strconv.Itoa(stored.Version)+`"` {
+				t.Errorf("ETag = %s, want the version quoted", w.Header().Get("ETag"))
+			}
+		})
+	}
+}
@@ -3,34 +3,71 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/gingercookie/planet-express/internal/events"
+	"github.com/gingercookie/planet-express/internal/health"
+	"github.com/gingercookie/planet-express/internal/sim"
+	"github.com/gingercookie/planet-express/internal/tlsconfig"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Ship's fuel is in the same units as FuelCapacity; BurnRate is fuel per
+// light-year. MaxCargoKG and MaxCargoM3 are the size of its hold.
 type Ship struct {
-	Name      string     `json:"name"`
-	Available bool       `json:"available"`
-	Speed     float64    `json:"speed"`
-	Lock      sync.Mutex `json:"-"`
+	Name         string  `json:"name"`
+	Available    bool    `json:"available"`
+	Speed        float64 `json:"speed"`
+	FuelCapacity float64 `json:"fuel_capacity"`
+	BurnRate     float64 `json:"burn_rate"`
+	MaxCargoKG   float64 `json:"max_cargo_kg"`
+	MaxCargoM3   float64 `json:"max_cargo_m3"`
+
+	Fuel             float64    `json:"-"`
+	Wear             float64    `json:"-"`
+	RefuelledAt      time.Time  `json:"-"` // fuel was last brought up to date
+	MaintenanceUntil time.Time  `json:"-"` // zero unless in maintenance
+	Lock             sync.Mutex `json:"-"`
 }
 
 type ShipInfo struct {
-	Name      string  `json:"name"`
-	Available bool    `json:"available"`
-	Speed     float64 `json:"speed"`
+	Name             string     `json:"name"`
+	Available        bool       `json:"available"`
+	Speed            float64    `json:"speed"`
+	Fuel             float64    `json:"fuel"`
+	FuelCapacity     float64    `json:"fuel_capacity"`
+	RangeLY          *float64   `json:"range_ly,omitempty"` // unset if unlimited
+	Wear             float64    `json:"wear"`
+	MaxCargoKG       float64    `json:"max_cargo_kg"`
+	MaxCargoM3       float64    `json:"max_cargo_m3"`
+	MaintenanceUntil *time.Time `json:"maintenance_until,omitempty"`
+}
+
+// ShipReturn is the body of POST /ship/return. Distance is set when the
+// ship is back from a flight, and burns fuel and wears the hull.
+type ShipReturn struct {
+	Name     string  `json:"name"`
+	Distance float64 `json:"distance_ly,omitempty"`
 }
 
 var (
+	// clock and rng drive everything simulated. main replaces them from
+	// the SIM_* variables at startup.
+	clock sim.Clock = sim.RealClock{}
+	rng             = sim.NewRand(rand.Uint64())
+
 	fleet = []Ship{
-		{Name: "Old Bessie", Available: true, Speed: 10},
-		{Name: "The Dinghy", Available: true, Speed: 15},
-		{Name: "Leela's Cruiser", Available: true, Speed: 20},
+		{Name: "Old Bessie", Available: true, Speed: 10, FuelCapacity: 300, BurnRate: 1, MaxCargoKG: 2000, MaxCargoM3: 20},
+		{Name: "The Dinghy", Available: true, Speed: 15, FuelCapacity: 120, BurnRate: 1, MaxCargoKG: 200, MaxCargoM3: 2},
+		{Name: "Leela's Cruiser", Available: true, Speed: 20, FuelCapacity: 500, BurnRate: 1.5, MaxCargoKG: 800, MaxCargoM3: 8},
 	}
 
 	requestsReceived = prometheus.NewCounterVec(
@@ -70,7 +107,8 @@ func getStatus(w http.ResponseWriter, r *http.Request) {
 		if fleet[i].Lock.TryLock() {
 			if fleet[i].Name == ship {
 				found = true
-				json.NewEncoder(w).Encode(ShipInfo{Name: fleet[i].Name, Available: fleet[i].Available, Speed: fleet[i].Speed})
+				fleet[i].catchUp(clock.Now())
+				json.NewEncoder(w).Encode(fleet[i].info())
 			}
 
 			fleet[i].Lock.Unlock()
@@ -85,19 +123,87 @@ func getStatus(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+func listShips(w http.ResponseWriter, r *http.Request) {
+	requestsReceived.WithLabelValues(r.Method).Inc()
+	slog.Debug("Received request to list ships")
+
+	list := make([]ShipInfo, 0, len(fleet))
+	now := clock.Now()
+	for i := range fleet {
+		fleet[i].Lock.Lock()
+		fleet[i].catchUp(now)
+		list = append(list, fleet[i].info())
+		fleet[i].Lock.Unlock()
+	}
+
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// reserveShip reserves the first free ship that isn't in maintenance, has
+// the fuel for ?distance= light-years and the hold for ?weight= kg and
+// ?volume= m³ of cargo, each if given.
 func reserveShip(w http.ResponseWriter, r *http.Request) {
 	requestsReceived.WithLabelValues(r.Method).Inc()
 	slog.Info("Received request to reserve ship")
 
-	found := false
+	var distance, weight, volume float64
+	for _, param := range []struct {
+		name, unit string
+		value      *float64
+	}{
+		{"distance", "light-years", &distance},
+		{"weight", "kg", &weight},
+		{"volume", "m³", &volume},
+	} {
+		val := r.URL.Query().Get(param.name)
+		if val == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil || v < 0 {
+			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
+			http.Error(w, fmt.Sprintf("%s must be a non-negative number of %s", param.name, param.unit), http.StatusBadRequest)
+			return
+		}
+		*param.value = v
+	}
+
+	// Holds never change, so there's no need to lock to check them.
+	var maxKG, maxM3 float64
+	fits := false
+	for i := range fleet {
+		maxKG, maxM3 = max(maxKG, fleet[i].MaxCargoKG), max(maxM3, fleet[i].MaxCargoM3)
+		fits = fits || fleet[i].holds(weight, volume)
+	}
+	if !fits {
+		slog.Warn("Cargo is too big for every ship", "weight_kg", weight, "volume_m3", volume)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusUnprocessableEntity)).Inc()
+		http.Error(w, fmt.Sprintf("Cargo of %g kg and %g m³ doesn't fit in any ship; the biggest holds take %g kg and %g m³",
+			weight, volume, maxKG, maxM3), http.StatusUnprocessableEntity)
+		return
+	}
+
+	found, shortOfFuel, tooSmall := false, 0, 0
+	now := clock.Now()
 	for i := range fleet {
 		if fleet[i].Lock.TryLock() {
-			if fleet[i].Available {
+			fleet[i].catchUp(now)
+			switch {
+			case !fleet[i].Available || fleet[i].inMaintenance():
+			case !fleet[i].holds(weight, volume):
+				tooSmall++
+			case fleet[i].rangeLY() < distance:
+				shortOfFuel++
+			default:
 				found = true
-				slog.Info("Ship is available", "name", fleet[i].Name, "speed", fleet[i].Speed)
+				info := fleet[i].info()
+				slog.Info("Ship is available", "name", info.Name, "speed", info.Speed, "range_ly", info.RangeLY)
 				fleet[i].Available = false
-				slog.Info("Ship has been reserved", "name", fleet[i].Name)
-				json.NewEncoder(w).Encode(ShipInfo{Name: fleet[i].Name, Available: fleet[i].Available, Speed: fleet[i].Speed})
+				info.Available = false
+				slog.Info("Ship has been reserved", "name", info.Name)
+				json.NewEncoder(w).Encode(info)
 			}
 
 			fleet[i].Lock.Unlock()
@@ -108,6 +214,19 @@ func reserveShip(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if tooSmall > 0 && shortOfFuel == 0 {
+		slog.Warn("No free ship has the hold", "weight_kg", weight, "volume_m3", volume, "ships", tooSmall)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+		http.Error(w, fmt.Sprintf("No ship available with the hold for %g kg and %g m³", weight, volume), http.StatusServiceUnavailable)
+		return
+	}
+	if shortOfFuel > 0 {
+		rangeRejections.Inc()
+		slog.Warn("No free ship has the range", "distance_ly", distance, "ships", shortOfFuel)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+		http.Error(w, fmt.Sprintf("No ship available with the range for %g light-years", distance), http.StatusServiceUnavailable)
+		return
+	}
 	slog.Warn("No ship is available")
 	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
 	http.Error(w, "No ship available", http.StatusServiceUnavailable)
@@ -117,28 +236,43 @@ func returnShip(w http.ResponseWriter, r *http.Request) {
 	requestsReceived.WithLabelValues(r.Method).Inc()
 	slog.Info("Received request to return ship")
 
-	var ship ShipInfo
+	var ship ShipReturn
 	if err := json.NewDecoder(r.Body).Decode(&ship); err != nil {
 		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
 		http.Error(w, "Failed to unmarshal data into ship member", http.StatusServiceUnavailable)
 		return
 	}
 
+	slog.Info("Returning ship to base", "name", ship.Name)
+	if releaseShip(ship) {
+		slog.Info("Ship returned and is now available", "name", ship.Name)
+		requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
+	http.NotFound(w, r)
+}
+
+// releaseShip makes the named ship available again, after burning fuel and
+// wearing the hull for any distance flown. It reports false if there is no
+// such ship.
+func releaseShip(ret ShipReturn) bool {
 	for i := range fleet {
-		if fleet[i].Name == ship.Name {
-			slog.Info("Returning ship to base", "name", fleet[i].Name)
+		if fleet[i].Name == ret.Name {
 			fleet[i].Lock.Lock()
+			now := clock.Now()
+			fleet[i].catchUp(now)
+			if ret.Distance > 0 {
+				fleet[i].recordFlight(ret.Distance, now)
+			}
 			fleet[i].Available = true
 			fleet[i].Lock.Unlock()
-			slog.Info("Ship returned and is now available", "name", fleet[i].Name)
-			requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusOK)).Inc()
-			w.WriteHeader(http.StatusOK)
-			return
+			return true
 		}
 	}
-
-	requestsProcessed.WithLabelValues(r.Method, strconv.Itoa(http.StatusNotFound)).Inc()
-	http.NotFound(w, r)
+	return false
 }
 
 func main() {
@@ -152,16 +286,55 @@ func main() {
 	}
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
 
+	var err error
+	if clock, rng, err = sim.FromEnv(); err != nil {
+		slog.Error("Invalid simulation settings", "err", err)
+		os.Exit(1)
+	}
+	now := clock.Now()
+	for i := range fleet {
+		fleet[i].Fuel, fleet[i].RefuelledAt = fleet[i].FuelCapacity, now
+	}
+
 	prometheus.MustRegister(requestsReceived)
 	prometheus.MustRegister(requestsProcessed)
+	prometheus.MustRegister(eventsConsumed)
+	prometheus.MustRegister(fuelUsed)
+	prometheus.MustRegister(maintenanceEvents)
+	prometheus.MustRegister(rangeRejections)
+	prometheus.MustRegister(fleetCollectors()...)
+
+	certs, err := tlsconfig.FromEnv()
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "err", err)
+		os.Exit(1)
+	}
+
+	broker, err := events.NewBrokerFromEnv("ship-service")
+	if err != nil {
+		slog.Error("Unable to set up event broker", "err", err)
+		os.Exit(1)
+	}
+	if _, ok := broker.(*events.MemoryBroker); ok {
+		slog.Info("No event broker configured; delivery-service will return ships over HTTP")
+	} else if err := consumeEvents(broker); err != nil {
+		slog.Error("Unable to subscribe to delivery events", "err", err)
+		os.Exit(1)
+	}
 
 	shipMux := http.NewServeMux()
+	shipMux.HandleFunc("GET /ships", listShips)
 	shipMux.HandleFunc("/ship/status", getStatus)
 	shipMux.HandleFunc("/ship/reserve", reserveShip)
 	shipMux.HandleFunc("/ship/return", returnShip)
+	shipMux.HandleFunc("/healthz", health.Healthz)
+	shipMux.HandleFunc("/readyz", health.Ready)
 
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
+	// Probes can't present client certificates, so serve them here as well.
+	metricsMux.HandleFunc("/healthz", health.Healthz)
+	metricsMux.HandleFunc("/readyz", health.Ready)
 
 	go func() {
 		slog.Info("Prometheus metrics endpoint running", "addr", ":2112")
@@ -171,8 +344,8 @@ func main() {
 		}
 	}()
 
-	slog.Info("ShipService running", "addr", ":8080")
-	if err := http.ListenAndServe(":8080", shipMux); err != nil {
+	slog.Info("ShipService running", "addr", ":8080", "mtls", certs != nil)
+	if err := tlsconfig.ListenAndServe(":8080", shipMux, certs); err != nil {
 		slog.Error("server error", "err", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,142 @@
+// ship-service/maintenance.go
+package main
+
+import (
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/env"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// refuelRate is how much fuel a ship takes on per second at base.
+	refuelRate = env.Float("SHIP_REFUEL_RATE", 10)
+	// wearPerLY is how much hull wear a light-year of flying adds, out of 1.
+	wearPerLY = env.Float("SHIP_WEAR_PER_LY", 0.0005)
+	// wearThreshold is the wear that sends a ship to maintenance.
+	wearThreshold = env.Float("SHIP_MAINTENANCE_THRESHOLD", 0.8)
+	// maintenanceTime is how long a ship spends in maintenance. It comes out
+	// with no wear and full tanks.
+	maintenanceTime = env.Duration("SHIP_MAINTENANCE_DURATION", time.Minute)
+
+	fuelUsed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_ship_fuel_used_total",
+			Help: "The total fuel burned by each ship",
+		},
+		[]string{"name"},
+	)
+
+	maintenanceEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_ship_maintenance_events_total",
+			Help: "The total number of maintenance events, by ship and event (started, finished)",
+		},
+		[]string{"name", "event"},
+	)
+
+	rangeRejections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "planet_express_ship_range_rejections_total",
+			Help: "The total number of reservations refused because no free ship had the range",
+		},
+	)
+)
+
+// catchUp brings s up to now: refuelling since it landed and finishing any
+// maintenance that is due. s.Lock must be held.
+func (s *Ship) catchUp(now time.Time) {
+	if !s.MaintenanceUntil.IsZero() && !now.Before(s.MaintenanceUntil) {
+		slog.Info("Ship is out of maintenance", "name", s.Name)
+		maintenanceEvents.WithLabelValues(s.Name, "finished").Inc()
+		s.Wear, s.Fuel = 0, s.FuelCapacity
+		s.MaintenanceUntil = time.Time{}
+	}
+	if s.Available && s.Fuel < s.FuelCapacity && now.After(s.RefuelledAt) {
+		s.Fuel = min(s.Fuel+refuelRate*now.Sub(s.RefuelledAt).Seconds(), s.FuelCapacity)
+	}
+	s.RefuelledAt = now
+}
+
+func (s *Ship) inMaintenance() bool {
+	return !s.MaintenanceUntil.IsZero()
+}
+
+// holds reports whether weight kg and volume m³ of cargo fit in s's hold.
+func (s *Ship) holds(weight, volume float64) bool {
+	return weight <= s.MaxCargoKG && volume <= s.MaxCargoM3
+}
+
+// rangeLY is how far s can fly on the fuel it has. A ship that burns no
+// fuel can go anywhere.
+func (s *Ship) rangeLY() float64 {
+	if s.BurnRate == 0 {
+		return math.Inf(1)
+	}
+	return s.Fuel / s.BurnRate
+}
+
+// recordFlight burns fuel and wears the hull for distance light-years, and
+// sends the ship to maintenance once it is worn out. s.Lock must be held.
+func (s *Ship) recordFlight(distance float64, now time.Time) {
+	burned := min(distance*s.BurnRate, s.Fuel)
+	s.Fuel -= burned
+	s.Wear = min(s.Wear+distance*wearPerLY, 1)
+	s.RefuelledAt = now
+	fuelUsed.WithLabelValues(s.Name).Add(burned)
+
+	if s.Wear >= wearThreshold && !s.inMaintenance() {
+		s.MaintenanceUntil = now.Add(maintenanceTime)
+		maintenanceEvents.WithLabelValues(s.Name, "started").Inc()
+		slog.Info("Ship sent to maintenance", "name", s.Name, "wear", s.Wear, "until", s.MaintenanceUntil)
+	}
+}
+
+func (s *Ship) info() ShipInfo {
+	info := ShipInfo{
+		Name: s.Name, Available: s.Available, Speed: s.Speed,
+		Fuel: s.Fuel, FuelCapacity: s.FuelCapacity, Wear: s.Wear,
+		MaxCargoKG: s.MaxCargoKG, MaxCargoM3: s.MaxCargoM3,
+	}
+	if r := s.rangeLY(); !math.IsInf(r, 1) {
+		info.RangeLY = &r
+	}
+	if s.inMaintenance() {
+		until := s.MaintenanceUntil
+		info.MaintenanceUntil = &until
+	}
+	return info
+}
+
+// fleetCollectors report each ship's fuel, wear and maintenance state as it
+// stands when scraped, since ships refuel and finish maintenance on their own.
+func fleetCollectors() []prometheus.Collector {
+	var collectors []prometheus.Collector
+	for i := range fleet {
+		s := &fleet[i]
+		gauge := func(name, help string, value func() float64) prometheus.Collector {
+			return prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{Name: name, Help: help, ConstLabels: prometheus.Labels{"name": s.Name}},
+				func() float64 {
+					s.Lock.Lock()
+					defer s.Lock.Unlock()
+					s.catchUp(clock.Now())
+					return value()
+				},
+			)
+		}
+		collectors = append(collectors,
+			gauge("planet_express_ship_fuel", "The fuel in each ship's tanks", func() float64 { return s.Fuel }),
+			gauge("planet_express_ship_wear", "Each ship's hull wear, from 0 (new) to 1", func() float64 { return s.Wear }),
+			gauge("planet_express_ship_in_maintenance", "Whether each ship is in maintenance (1) or not (0)", func() float64 {
+				if s.inMaintenance() {
+					return 1
+				}
+				return 0
+			}),
+		)
+	}
+	return collectors
+}
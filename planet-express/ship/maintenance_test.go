@@ -0,0 +1,187 @@
+// ship-service/maintenance_test.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gingercookie/planet-express/internal/sim"
+)
+
+var start = time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fixedClock is a clock for tests that only moves when told to.
+type fixedClock struct {
+	sim.RealClock
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time { return c.now }
+
+// useFleet replaces fleet and clock for the rest of t, with the clock
+// stopped at start.
+func useFleet(t *testing.T, ships []Ship) {
+	t.Helper()
+	prevFleet, prevClock := fleet, clock
+	fleet, clock = ships, &fixedClock{now: start}
+	t.Cleanup(func() { fleet, clock = prevFleet, prevClock })
+}
+
+func TestShipCatchUp(t *testing.T) {
+	tests := []struct {
+		name      string
+		ship      *Ship
+		after     time.Duration
+		wantFuel  float64
+		wantWear  float64
+		wantMaint bool
+	}{
+		{"refuels at base", &Ship{Available: true, FuelCapacity: 300, Fuel: 100, RefuelledAt: start}, 5 * time.Second, 100 + 5*refuelRate, 0, false},
+		{"stops at capacity", &Ship{Available: true, FuelCapacity: 300, Fuel: 290, RefuelledAt: start}, time.Hour, 300, 0, false},
+		{"not while flying", &Ship{FuelCapacity: 300, Fuel: 100, RefuelledAt: start}, 5 * time.Second, 100, 0, false},
+		{"still in maintenance", &Ship{FuelCapacity: 300, Fuel: 0, Wear: 0.9, RefuelledAt: start, MaintenanceUntil: start.Add(time.Minute)}, time.Second, 0, 0.9, true},
+		{"maintenance done", &Ship{FuelCapacity: 300, Fuel: 0, Wear: 0.9, RefuelledAt: start, MaintenanceUntil: start.Add(time.Minute)}, time.Minute, 300, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.ship
+			s.Name = "Old Bessie"
+			s.catchUp(start.Add(tt.after))
+			if s.Fuel != tt.wantFuel || s.Wear != tt.wantWear || s.inMaintenance() != tt.wantMaint {
+				t.Errorf("after catchUp: fuel %v, wear %v, in maintenance %v; want %v, %v, %v",
+					s.Fuel, s.Wear, s.inMaintenance(), tt.wantFuel, tt.wantWear, tt.wantMaint)
+			}
+		})
+	}
+}
+
+func TestShipRecordFlight(t *testing.T) {
+	tests := []struct {
+		name      string
+		ship      *Ship
+		distance  float64
+		wantFuel  float64
+		wantMaint bool
+	}{
+		{"burns fuel", &Ship{FuelCapacity: 300, Fuel: 300, BurnRate: 1.5}, 100, 150, false},
+		{"never below empty", &Ship{FuelCapacity: 300, Fuel: 50, BurnRate: 1}, 100, 0, false},
+		{"wears out", &Ship{FuelCapacity: 300, Fuel: 300, BurnRate: 1, Wear: wearThreshold - 50*wearPerLY}, 50, 250, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.ship
+			s.Name = "Old Bessie"
+			wear := s.Wear
+			s.recordFlight(tt.distance, start)
+			if s.Fuel != tt.wantFuel {
+				t.Errorf("fuel = %v, want %v", s.Fuel, tt.wantFuel)
+			}
+			if want := min(wear+tt.distance*wearPerLY, 1); s.Wear != want {
+				t.Errorf("wear = %v, want %v", s.Wear, want)
+			}
+			if s.inMaintenance() != tt.wantMaint {
+				t.Errorf("in maintenance = %v, want %v", s.inMaintenance(), tt.wantMaint)
+			}
+			if tt.wantMaint && !s.MaintenanceUntil.Equal(start.Add(maintenanceTime)) {
+				t.Errorf("maintenance until %s, want %s", s.MaintenanceUntil, start.Add(maintenanceTime))
+			}
+		})
+	}
+}
+
+func TestShipRangeLY(t *testing.T) {
+	tests := []struct {
+		name string
+		ship *Ship
+		want float64
+	}{
+		{"full tanks", &Ship{Fuel: 300, BurnRate: 1}, 300},
+		{"thirsty", &Ship{Fuel: 300, BurnRate: 1.5}, 200},
+		{"empty", &Ship{Fuel: 0, BurnRate: 1}, 0},
+		{"burns no fuel", &Ship{Fuel: 0, FuelCapacity: 300, BurnRate: 0}, math.Inf(1)},
+	}
+	for _, tt := range tests {
+		if got := tt.ship.rangeLY(); got != tt.want {
+			t.Errorf("%s: rangeLY() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReserveShip(t *testing.T) {
+	tests := []struct {
+		name     string
+		ships    []Ship
+		query    string
+		wantCode int
+		wantBody string
+	}{
+		{
+			"first free ship",
+			[]Ship{{Name: "Old Bessie", Available: true, Fuel: 300, BurnRate: 1}, {Name: "The Dinghy", Available: true, Fuel: 120, BurnRate: 1}},
+			"", http.StatusOK, `"name":"Old Bessie"`,
+		},
+		{
+			"skips ships in maintenance",
+			[]Ship{{Name: "Old Bessie", Available: true, MaintenanceUntil: start.Add(time.Minute)}, {Name: "The Dinghy", Available: true, Fuel: 120, BurnRate: 1}},
+			"", http.StatusOK, `"name":"The Dinghy"`,
+		},
+		{
+			"skips ships short of fuel",
+			[]Ship{{Name: "The Dinghy", Available: true, Fuel: 120, BurnRate: 1}, {Name: "Old Bessie", Available: true, Fuel: 300, BurnRate: 1}},
+			"?distance=200", http.StatusOK, `"name":"Old Bessie"`,
+		},
+		{
+			"ship that burns no fuel goes anywhere",
+			[]Ship{{Name: "The Dinghy", Available: true, Fuel: 120, BurnRate: 1}, {Name: "Planet Express Ship", Available: true, Fuel: 120, BurnRate: 0}},
+			"?distance=5000", http.StatusOK, `"name":"Planet Express Ship"`,
+		},
+		{
+			"no ship has the range",
+			[]Ship{{Name: "The Dinghy", Available: true, Fuel: 120, BurnRate: 1}, {Name: "Old Bessie", Available: false, Fuel: 300, BurnRate: 1}},
+			"?distance=200", http.StatusServiceUnavailable, "range for 200 light-years",
+		},
+		{
+			"skips ships too small",
+			[]Ship{{Name: "The Dinghy", Available: true, Fuel: 120, BurnRate: 1, MaxCargoKG: 200, MaxCargoM3: 2}, {Name: "Old Bessie", Available: true, Fuel: 300, BurnRate: 1, MaxCargoKG: 2000, MaxCargoM3: 20}},
+			"?weight=500", http.StatusOK, `"name":"Old Bessie"`,
+		},
+		{
+			"no free ship has the hold",
+			[]Ship{{Name: "The Dinghy", Available: true, Fuel: 120, BurnRate: 1, MaxCargoKG: 200, MaxCargoM3: 2}, {Name: "Old Bessie", Available: false, Fuel: 300, BurnRate: 1, MaxCargoKG: 2000, MaxCargoM3: 20}},
+			"?weight=500", http.StatusServiceUnavailable, "hold for 500 kg",
+		},
+		{
+			"too big for every ship",
+			[]Ship{{Name: "Old Bessie", Available: true, Fuel: 300, BurnRate: 1, MaxCargoKG: 2000, MaxCargoM3: 20}},
+			"?volume=50", http.StatusUnprocessableEntity, "doesn't fit in any ship",
+		},
+		{
+			"none free",
+			[]Ship{{Name: "Old Bessie", Available: false, Fuel: 300, BurnRate: 1}},
+			"", http.StatusServiceUnavailable, "No ship available",
+		},
+		{
+			"bad distance",
+			[]Ship{{Name: "Old Bessie", Available: true, Fuel: 300, BurnRate: 1}},
+			"?distance=-1", http.StatusBadRequest, "non-negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.ships {
+				tt.ships[i].FuelCapacity = tt.ships[i].Fuel
+				tt.ships[i].RefuelledAt = start
+			}
+			useFleet(t, tt.ships)
+			w := httptest.NewRecorder()
+			reserveShip(w, httptest.NewRequest(http.MethodPost, "/ship/reserve"+tt.query, nil))
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("reserve%s = %d %q, want %d containing %q", tt.query, w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
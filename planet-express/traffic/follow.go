@@ -0,0 +1,223 @@
+// traffic/follow.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// distances from Planet Express HQ to known destinations, in light-years.
+// Keep in sync with delivery-service.
+var distances = map[string]float64{
+	"New New York":        10,
+	"Sewer City":          10,
+	"Luna Park":           15,
+	"Mars Vegas":          25,
+	"Central Bureaucracy": 30,
+	"Doop Headquarters":   40,
+	"Neptune":             50,
+	"Robonia":             60,
+	"Omicron Persei 8":    100,
+}
+
+func calcDistance(address string) float64 {
+	if d, ok := distances[address]; ok {
+		return d
+	}
+	return 30 // default mid-range distance for unknown destinations
+}
+
+// expectedFlightTime is how long the ticket's package should take to arrive.
+// That is the ETA delivery-service gave it, which takes batching, routing
+// and drops before it into account. Tickets without one fall back to the
+// direct distance at the ship's speed.
+func expectedFlightTime(t DeliveryTicket) time.Duration {
+	if eta := t.Package.ETA; eta != nil {
+		from := clock.Now()
+		if t.Package.DispatchedAt != nil {
+			from = *t.Package.DispatchedAt
+		}
+		return max(eta.Sub(from), 0)
+	}
+	if t.Ship.Speed <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) * calcDistance(t.Package.Address) / t.Ship.Speed)
+}
+
+// follower polls a sample of packages until they reach a final status, as a
+// black-box check that the whole delivery pipeline completes.
+type follower struct {
+	packageURL   string
+	sampleRate   float64
+	pollInterval time.Duration
+	stuckFactor  float64
+	timeout      time.Duration
+	slots        chan struct{}
+}
+
+func newFollowerFromEnv() (*follower, error) {
+	f := &follower{
+		packageURL:   getEnv("FOLLOW_PACKAGE_URL", "http://package-service"),
+		pollInterval: 2 * time.Second,
+		stuckFactor:  3,
+		timeout:      10 * time.Minute,
+	}
+
+	var err error
+	if f.sampleRate, err = parseFloatEnv("FOLLOW_SAMPLE_RATE", 0); err != nil {
+		return nil, err
+	}
+	if f.stuckFactor, err = parseFloatEnv("FOLLOW_STUCK_FACTOR", f.stuckFactor); err != nil {
+		return nil, err
+	}
+	if f.pollInterval, err = parseDurationEnv("FOLLOW_POLL_INTERVAL", f.pollInterval); err != nil {
+		return nil, err
+	}
+	if f.timeout, err = parseDurationEnv("FOLLOW_TIMEOUT", f.timeout); err != nil {
+		return nil, err
+	}
+	maxFollows, err := strconv.Atoi(getEnv("FOLLOW_MAX_IN_FLIGHT", "100"))
+	if err != nil {
+		return nil, fmt.Errorf("FOLLOW_MAX_IN_FLIGHT: %w", err)
+	}
+	if maxFollows <= 0 {
+		slog.Warn("Ignoring FOLLOW_MAX_IN_FLIGHT, it must be positive", "value", maxFollows)
+		maxFollows = 100
+	}
+	f.slots = make(chan struct{}, maxFollows)
+	return f, nil
+}
+
+// parseFloatEnv and parseDurationEnv reject values that don't parse, and
+// fall back to def for ones that aren't positive.
+func parseFloatEnv(key string, def float64) (float64, error) {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	v, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	if v <= 0 {
+		slog.Warn("Ignoring setting, it must be positive", "key", key, "value", val)
+		return def, nil
+	}
+	return v, nil
+}
+
+func parseDurationEnv(key string, def time.Duration) (time.Duration, error) {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	v, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	if v <= 0 {
+		slog.Warn("Ignoring setting, it must be positive", "key", key, "value", val)
+		return def, nil
+	}
+	return v, nil
+}
+
+func (f *follower) enabled() bool {
+	return f != nil && f.sampleRate > 0
+}
+
+// maybeFollow starts following t if it is picked by the sample and a slot is free.
+func (f *follower) maybeFollow(t TrackedTicket) {
+	if !f.enabled() || rng.Float64() >= f.sampleRate {
+		return
+	}
+	select {
+	case f.slots <- struct{}{}:
+	default:
+		slog.Debug("Too many deliveries being followed, skipping", "package_id", t.Ticket.Package.ID)
+		return
+	}
+	followsInProgress.Inc()
+	go func() {
+		defer func() {
+			followsInProgress.Dec()
+			<-f.slots
+		}()
+		f.follow(t)
+	}()
+}
+
+func (f *follower) follow(t TrackedTicket) {
+	id := t.Ticket.Package.ID
+	expected := expectedFlightTime(t.Ticket)
+	stuckAfter := time.Duration(float64(expected)*f.stuckFactor) + f.pollInterval
+	slog.Debug("Following delivery", "package_id", id, "expected", expected)
+
+	stuck := false
+	for {
+		clock.Sleep(f.pollInterval)
+		elapsed := clock.Since(t.SentAt)
+
+		pkg, found, err := f.fetchPackage(id)
+		switch {
+		case err != nil:
+			slog.Warn("Failed to poll package", "package_id", id, "err", err)
+		case !found:
+			f.record("lost", elapsed, expected)
+			slog.Error("Followed package disappeared before reaching a final status", "package_id", id, "elapsed", elapsed)
+			return
+		case pkg.Status == "delivered" || pkg.Status == "failed" || pkg.Status == "returned":
+			f.record(pkg.Status, elapsed, expected)
+			slog.Info("Followed delivery finished", "package_id", id, "status", pkg.Status, "elapsed", elapsed, "expected", expected)
+			return
+		}
+
+		if !stuck && elapsed > stuckAfter {
+			stuck = true
+			stuckDeliveries.Inc()
+			slog.Warn("Delivery looks stuck", "package_id", id, "status", pkg.Status, "elapsed", elapsed, "expected", expected,
+				"crew", t.Ticket.Crew.Name, "ship", t.Ticket.Ship.Name)
+		}
+		if elapsed > f.timeout {
+			f.record("timeout", elapsed, expected)
+			slog.Error("Gave up following delivery", "package_id", id, "status", pkg.Status, "elapsed", elapsed, "expected", expected)
+			return
+		}
+	}
+}
+
+func (f *follower) record(outcome string, elapsed, expected time.Duration) {
+	followedDeliveries.WithLabelValues(outcome).Inc()
+	timeToOutcome.WithLabelValues(outcome).Observe(elapsed.Seconds())
+	if expected > 0 && (outcome == "delivered" || outcome == "failed" || outcome == "returned") {
+		flightTimeRatio.Observe(float64(elapsed) / float64(expected))
+	}
+}
+
+// fetchPackage looks a package up in package-service. found is false on a 404.
+func (f *follower) fetchPackage(id string) (Package, bool, error) {
+	resp, err := client.Get(fmt.Sprintf("%s/packages/get?id=%s", f.packageURL, url.QueryEscape(id)))
+	if err != nil {
+		return Package{}, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Package{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Package{}, false, fmt.Errorf("package service returned %d", resp.StatusCode)
+	}
+	var pkg Package
+	if err := json.NewDecoder(resp.Body).Decode(&pkg); err != nil {
+		return Package{}, false, err
+	}
+	return pkg, true, nil
+}
@@ -0,0 +1,158 @@
+// traffic/follow_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// packageServer serves GET /packages/get from a fake package-service that
+// reports each status in turn, staying on the last one. An empty status is
+// answered with a 404.
+func packageServer(t *testing.T, statuses ...string) *httptest.Server {
+	t.Helper()
+	var polls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := min(int(polls.Add(1))-1, len(statuses)-1)
+		switch statuses[i] {
+		case "":
+			http.NotFound(w, r)
+		case "error":
+			http.Error(w, "down", http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(Package{ID: r.URL.Query().Get("id"), Status: statuses[i]})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestExpectedFlightTime(t *testing.T) {
+	dispatched := time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+	eta := dispatched.Add(7 * time.Second)
+	early := dispatched.Add(-time.Second)
+	tests := []struct {
+		address    string
+		speed      float64
+		dispatched *time.Time
+		eta        *time.Time
+		want       time.Duration
+	}{
+		{"Mars Vegas", 10, nil, nil, 2500 * time.Millisecond},
+		{"Omicron Persei 8", 20, nil, nil, 5 * time.Second},
+		{"Nowhere", 10, nil, nil, 3 * time.Second},
+		{"Mars Vegas", 0, nil, nil, 0},
+		{"Mars Vegas", 10, &dispatched, &eta, 7 * time.Second},
+		{"Mars Vegas", 0, &dispatched, &eta, 7 * time.Second},
+		{"Mars Vegas", 10, &dispatched, &early, 0},
+	}
+	for _, tt := range tests {
+		ticket := DeliveryTicket{Ship: ShipInfo{Speed: tt.speed}, Package: Package{Address: tt.address, DispatchedAt: tt.dispatched, ETA: tt.eta}}
+		if got := expectedFlightTime(ticket); got != tt.want {
+			t.Errorf("expectedFlightTime(%s at speed %v, eta %v) = %s, want %s", tt.address, tt.speed, tt.eta, got, tt.want)
+		}
+	}
+}
+
+func TestNewFollowerFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    follower
+		wantErr bool
+	}{
+		{"defaults", nil, follower{pollInterval: 2 * time.Second, stuckFactor: 3, timeout: 10 * time.Minute}, false},
+		{"set", map[string]string{"FOLLOW_SAMPLE_RATE": "0.1", "FOLLOW_POLL_INTERVAL": "500ms", "FOLLOW_TIMEOUT": "1m"},
+			follower{sampleRate: 0.1, pollInterval: 500 * time.Millisecond, stuckFactor: 3, timeout: time.Minute}, false},
+		{"bad rate", map[string]string{"FOLLOW_SAMPLE_RATE": "often"}, follower{}, true},
+		{"bad interval", map[string]string{"FOLLOW_POLL_INTERVAL": "2"}, follower{}, true},
+		{"bad max in flight", map[string]string{"FOLLOW_MAX_IN_FLIGHT": "lots"}, follower{}, true},
+		{"non-positive ignored", map[string]string{"FOLLOW_STUCK_FACTOR": "0", "FOLLOW_POLL_INTERVAL": "-1s", "FOLLOW_TIMEOUT": "0s", "FOLLOW_MAX_IN_FLIGHT": "0"},
+			follower{pollInterval: 2 * time.Second, stuckFactor: 3, timeout: 10 * time.Minute}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			f, err := newFollowerFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newFollowerFromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if f.sampleRate != tt.want.sampleRate || f.pollInterval != tt.want.pollInterval ||
+				f.stuckFactor != tt.want.stuckFactor || f.timeout != tt.want.timeout || cap(f.slots) <= 0 {
+				t.Errorf("newFollowerFromEnv() = %+v, want %+v", *f, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchPackage(t *testing.T) {
+	tests := []struct {
+		status    string
+		wantFound bool
+		wantErr   bool
+	}{
+		{"in-transit", true, false},
+		{"", false, false},
+		{"error", false, true},
+	}
+	for _, tt := range tests {
+		f := &follower{packageURL: packageServer(t, tt.status).URL}
+		pkg, found, err := f.fetchPackage("P 1")
+		if found != tt.wantFound || (err != nil) != tt.wantErr {
+			t.Errorf("fetchPackage() for %q = %v, %v, want %v, error %v", tt.status, found, err, tt.wantFound, tt.wantErr)
+		}
+		if found && (pkg.ID != "P 1" || pkg.Status != tt.status) {
+			t.Errorf("fetchPackage() = %+v, want P 1 %s", pkg, tt.status)
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []string
+		timeout   time.Duration
+		speed     float64 // expect Mars Vegas to take 25s / speed
+		want      string
+		wantStuck bool
+	}{
+		{"delivered", []string{"pending", "in-transit", "delivered"}, time.Minute, 1, "delivered", false},
+		{"failed", []string{"in-transit", "failed"}, time.Minute, 1, "failed", false},
+		{"lost", []string{"pending", ""}, time.Minute, 1, "lost", false},
+		{"poll errors are retried", []string{"error", "delivered"}, time.Minute, 1, "delivered", false},
+		{"timeout", []string{"pending"}, 20 * time.Millisecond, 5000, "timeout", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &follower{
+				packageURL:   packageServer(t, tt.statuses...).URL,
+				pollInterval: time.Millisecond,
+				stuckFactor:  1,
+				timeout:      tt.timeout,
+			}
+			outcomes := followedDeliveries.WithLabelValues(tt.want)
+			before, stuckBefore := testutil.ToFloat64(outcomes), testutil.ToFloat64(stuckDeliveries)
+
+			ticket := DeliveryTicket{Ship: ShipInfo{Speed: tt.speed}, Package: Package{ID: "P1", Address: "Mars Vegas"}}
+			f.follow(TrackedTicket{Ticket: ticket, SentAt: time.Now()})
+
+			if got := testutil.ToFloat64(outcomes) - before; got != 1 {
+				t.Errorf("recorded %v %s outcomes, want 1", got, tt.want)
+			}
+			if stuck := testutil.ToFloat64(stuckDeliveries) > stuckBefore; stuck != tt.wantStuck {
+				t.Errorf("reported stuck = %v, want %v", stuck, tt.wantStuck)
+			}
+		})
+	}
+}
@@ -4,24 +4,39 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
 	"math/rand/v2"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/gingercookie/planet-express/internal/sim"
+	"github.com/gingercookie/planet-express/internal/tlsconfig"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type DeliveryRequest struct {
-	Recipient string `json:"recipient"`
-	Address   string `json:"address"`
-	Contents  string `json:"contents"`
+	Recipient string  `json:"recipient"`
+	Address   string  `json:"address"`
+	Contents  string  `json:"contents"`
+	WeightKG  float64 `json:"weight_kg"`
+	VolumeM3  float64 `json:"volume_m3"`
 }
 
 var (
+	// clock and rng drive everything simulated. main replaces them from
+	// the SIM_* variables at startup.
+	clock sim.Clock = sim.RealClock{}
+	rng             = sim.NewRand(rand.Uint64())
+
 	apiURL = getEnv("API_URL", "http://planetexpress-api/deliveries")
+	apiKey = os.Getenv("API_KEY")
+
+	client = &http.Client{Timeout: 30 * time.Second}
 
 	requestsGenerated = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -29,6 +44,107 @@ var (
 			Help: "The total number of requests generated by the traffic generator service",
 		},
 	)
+
+	requestsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "planet_express_traffic_requests_dropped_total",
+			Help: "The total number of scheduled requests dropped because the concurrency limit was reached",
+		},
+	)
+
+	requestsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "planet_express_traffic_requests_in_flight",
+			Help: "The number of requests currently waiting on a response",
+		},
+	)
+
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "planet_express_traffic_request_duration_seconds",
+			Help:    "End-to-end latency of delivery requests as seen by the traffic generator",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		[]string{"code"},
+	)
+
+	responsesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_traffic_responses_total",
+			Help: "The total number of delivery requests by outcome class (2xx, 4xx, 5xx, error)",
+		},
+		[]string{"class"},
+	)
+
+	ticketsReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "planet_express_traffic_tickets_received_total",
+			Help: "The total number of delivery tickets returned by the api",
+		},
+	)
+
+	invalidTickets = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "planet_express_traffic_invalid_tickets_total",
+			Help: "The total number of successful responses without a usable delivery ticket",
+		},
+	)
+
+	duplicatePackageIDs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "planet_express_traffic_duplicate_package_ids_total",
+			Help: "The total number of tickets carrying a package ID that was already tracked",
+		},
+	)
+
+	trackedPackages = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "planet_express_traffic_tracked_packages",
+			Help: "The number of package IDs currently tracked by the traffic generator",
+		},
+	)
+
+	followsInProgress = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "planet_express_traffic_follows_in_progress",
+			Help: "The number of deliveries currently being followed to completion",
+		},
+	)
+
+	followedDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "planet_express_traffic_followed_deliveries_total",
+			Help: "The total number of followed deliveries by final outcome (delivered, failed, returned, lost, timeout)",
+		},
+		[]string{"outcome"},
+	)
+
+	stuckDeliveries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "planet_express_traffic_stuck_deliveries_total",
+			Help: "The total number of followed deliveries that took much longer than their expected flight time",
+		},
+	)
+
+	timeToOutcome = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "planet_express_traffic_time_to_outcome_seconds",
+			Help:    "Time from sending a delivery request until the package reached its final status",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		},
+		[]string{"outcome"},
+	)
+
+	flightTimeRatio = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "planet_express_traffic_flight_time_ratio",
+			Help:    "Observed time to outcome divided by the expected flight time",
+			Buckets: []float64{0.5, 0.9, 1, 1.1, 1.25, 1.5, 2, 3, 5, 10},
+		},
+	)
+
+	tracker = newTicketTracker(10000)
+	follow  *follower
 )
 
 func getEnv(key, def string) string {
@@ -55,27 +171,82 @@ var contents = []string{
 }
 
 func randomChoice(list []string) string {
-	return list[rand.IntN(len(list))]
+	return list[rng.IntN(len(list))]
 }
 
-func sendDelivery() {
-	req := DeliveryRequest{
+// randomDelivery leaves out the hazard class; delivery-service works it out
+// from the contents.
+func randomDelivery() DeliveryRequest {
+	return DeliveryRequest{
 		Recipient: randomChoice(recipients),
 		Address:   randomChoice(addresses),
 		Contents:  randomChoice(contents),
+		WeightKG:  0.5 + rng.Float64()*50,
+		VolumeM3:  0.01 + rng.Float64()*0.5,
 	}
+}
 
+// responseClass buckets a status code into 2xx, 4xx, 5xx and so on.
+func responseClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+func sendDelivery(req DeliveryRequest) {
 	data, _ := json.Marshal(req)
 	requestsGenerated.Inc()
 
-	resp, err := http.Post(apiURL, "application/json", bytes.NewBuffer(data))
+	sentAt := clock.Now()
+	start := time.Now()
+	httpReq, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewBuffer(data))
 	if err != nil {
+		slog.Error("Failed to build delivery request", "err", err)
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		httpReq.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		requestDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		responsesReceived.WithLabelValues("error").Inc()
 		slog.Error("Failed to send delivery", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
-	slog.Info("Sent delivery", "recipient", req.Recipient, "address", req.Address, "contents", req.Contents, "status", resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	latency := time.Since(start)
+	if err != nil {
+		requestDuration.WithLabelValues("error").Observe(latency.Seconds())
+		responsesReceived.WithLabelValues("error").Inc()
+		slog.Error("Failed to read delivery response", "status", resp.StatusCode, "err", err)
+		return
+	}
+	requestDuration.WithLabelValues(strconv.Itoa(resp.StatusCode)).Observe(latency.Seconds())
+	responsesReceived.WithLabelValues(responseClass(resp.StatusCode)).Inc()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Delivery rejected", "recipient", req.Recipient, "address", req.Address, "contents", req.Contents, "status", resp.StatusCode, "latency", latency, "body", string(body))
+		return
+	}
+
+	var ticket DeliveryTicket
+	if err := json.Unmarshal(body, &ticket); err != nil || ticket.Package.ID == "" {
+		invalidTickets.Inc()
+		slog.Error("Response did not contain a delivery ticket", "status", resp.StatusCode, "body", string(body), "err", err)
+		return
+	}
+	ticketsReceived.Inc()
+	tracked := TrackedTicket{Ticket: ticket, SentAt: sentAt, Latency: latency.Seconds()}
+	if tracker.add(tracked) {
+		duplicatePackageIDs.Inc()
+		slog.Error("Received a package ID that is already tracked", "package_id", ticket.Package.ID)
+	}
+	follow.maybeFollow(tracked)
+
+	slog.Info("Sent delivery", "recipient", req.Recipient, "address", req.Address, "contents", req.Contents, "status", resp.StatusCode,
+		"latency", latency, "package_id", ticket.Package.ID, "crew", ticket.Crew.Name, "ship", ticket.Ship.Name)
 }
 
 func main() {
@@ -86,15 +257,68 @@ func main() {
 	}
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
 
+	var err error
+	if clock, rng, err = sim.FromEnv(); err != nil {
+		slog.Error("Invalid simulation settings", "err", err)
+		os.Exit(1)
+	}
+
+	// Without a scenario file, fall back to one random delivery every
+	// INTERVAL_SECONDS, as before.
 	interval := 1 * time.Second
 	if val, ok := os.LookupEnv("INTERVAL_SECONDS"); ok {
 		if val, err := time.ParseDuration(val + "s"); err == nil {
 			interval = val
 		}
 	}
+	scenario := Scenario{
+		Stages: []Stage{{Name: "default", Profile: "constant", RPS: 1 / interval.Seconds()}},
+	}
+	if path := os.Getenv("SCENARIO_FILE"); path != "" {
+		sc, err := loadScenario(path)
+		if err != nil {
+			slog.Error("Unable to load scenario", "path", path, "err", err)
+			os.Exit(1)
+		}
+		scenario = sc
+	}
+	if val, err := strconv.Atoi(getEnv("CONCURRENCY", "")); err == nil {
+		scenario.Concurrency = val
+	}
+	if scenario.Concurrency <= 0 {
+		scenario.Concurrency = 10
+	}
+
+	certs, err := tlsconfig.FromEnv()
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "err", err)
+		os.Exit(1)
+	}
+	if certs != nil {
+		client.Transport = certs.Transport()
+	}
+
+	if follow, err = newFollowerFromEnv(); err != nil {
+		slog.Error("Invalid follow-through configuration", "err", err)
+		os.Exit(1)
+	}
 
 	prometheus.MustRegister(requestsGenerated)
+	prometheus.MustRegister(requestsDropped)
+	prometheus.MustRegister(requestsInFlight)
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(responsesReceived)
+	prometheus.MustRegister(ticketsReceived)
+	prometheus.MustRegister(invalidTickets)
+	prometheus.MustRegister(duplicatePackageIDs)
+	prometheus.MustRegister(trackedPackages)
+	prometheus.MustRegister(followsInProgress)
+	prometheus.MustRegister(followedDeliveries)
+	prometheus.MustRegister(stuckDeliveries)
+	prometheus.MustRegister(timeToOutcome)
+	prometheus.MustRegister(flightTimeRatio)
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/tickets", tracker.listTickets)
 
 	go func() {
 		slog.Info("Prometheus metrics endpoint running", "addr", ":2112")
@@ -105,9 +329,10 @@ func main() {
 		}
 	}()
 
-	slog.Info("Delivery Traffic Generator running", "url", apiURL, "interval", interval)
-	for {
-		sendDelivery()
-		time.Sleep(interval)
-	}
+	slog.Info("Delivery Traffic Generator running", "url", apiURL, "stages", len(scenario.Stages), "concurrency", scenario.Concurrency,
+		"follow_sample_rate", follow.sampleRate, "mtls", certs != nil)
+	runScenario(scenario, sendDelivery)
+
+	// Keep serving metrics after a non-looping scenario has finished.
+	select {}
 }
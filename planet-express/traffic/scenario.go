@@ -0,0 +1,344 @@
+// traffic/scenario.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Duration wraps time.Duration so it can be written as "5m" or "1.5s" in
+// scenario files. Plain numbers are read as seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		secs, err := strconv.ParseFloat(string(b), 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %s", b)
+		}
+		*d = Duration(secs * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Scenario is a reproducible sequence of load stages read from SCENARIO_FILE.
+type Scenario struct {
+	// Concurrency caps the number of requests in flight at once. Requests
+	// scheduled while the cap is reached are dropped and counted.
+	Concurrency int `json:"concurrency"`
+	// Loop restarts the first stage once the last one finishes.
+	Loop bool `json:"loop"`
+	// RecordFile, if set, appends every sent request to a trace file that
+	// a "replay" stage can play back later.
+	RecordFile string  `json:"record_file"`
+	Stages     []Stage `json:"stages"`
+}
+
+type Stage struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile"` // "constant", "ramp", "sine", "burst", "replay"
+	// Duration of the stage. Zero runs forever, or until the trace ends
+	// for replay stages.
+	Duration Duration `json:"duration"`
+
+	// constant, and the baseline rate for burst
+	RPS float64 `json:"rps"`
+
+	// ramp
+	FromRPS float64 `json:"from_rps"`
+	ToRPS   float64 `json:"to_rps"`
+
+	// sine: rate = base_rps + amplitude * sin(2π * (t + phase) / period)
+	BaseRPS   float64  `json:"base_rps"`
+	Amplitude float64  `json:"amplitude"`
+	Period    Duration `json:"period"`
+	Phase     Duration `json:"phase"`
+
+	// burst: burst_rps for burst_length out of every burst_every
+	BurstRPS    float64  `json:"burst_rps"`
+	BurstEvery  Duration `json:"burst_every"`
+	BurstLength Duration `json:"burst_length"`
+
+	// replay
+	TraceFile string  `json:"trace_file"`
+	Speed     float64 `json:"speed"` // playback speed multiplier, defaults to 1
+}
+
+// TraceEntry is one line of a recorded trace: the request and when it was
+// sent relative to the start of the recording.
+type TraceEntry struct {
+	Offset Duration `json:"offset"`
+	DeliveryRequest
+}
+
+// A loadProfile schedules requests within a stage.
+type loadProfile interface {
+	// next returns the offset from the start of the stage at which the
+	// request following the one at prev should be sent. A nil request
+	// means a random delivery. ok is false once the profile is exhausted.
+	next(prev time.Duration) (at time.Duration, req *DeliveryRequest, ok bool)
+}
+
+// rateProfile sends requests at a rate that varies over time. The next send
+// time is found by integrating the rate until one whole request is due. The
+// rate is taken as constant over each rateStep, and the send time is placed
+// exactly where the integral reaches one within its step, so nothing is lost
+// between calls and rates aren't rounded to whole steps.
+type rateProfile struct {
+	rate    func(t time.Duration) float64
+	horizon time.Duration
+}
+
+const rateStep = 10 * time.Millisecond
+
+func (p rateProfile) next(prev time.Duration) (time.Duration, *DeliveryRequest, bool) {
+	due := 0.0
+	for t := prev; t < p.horizon; t += rateStep {
+		rate := math.Max(p.rate(t), 0)
+		step := min(rateStep, p.horizon-t).Seconds()
+		if rate > 0 && due+rate*step >= 1 {
+			at := t + time.Duration((1-due)/rate*float64(time.Second))
+			return max(at, prev+1), nil, true
+		}
+		due += rate * step
+	}
+	return 0, nil, false
+}
+
+type replayProfile struct {
+	entries []TraceEntry
+	speed   float64
+	pos     int
+}
+
+func (p *replayProfile) next(time.Duration) (time.Duration, *DeliveryRequest, bool) {
+	if p.pos >= len(p.entries) {
+		return 0, nil, false
+	}
+	e := p.entries[p.pos]
+	p.pos++
+	return time.Duration(float64(e.Offset) / p.speed), &e.DeliveryRequest, true
+}
+
+func loadScenario(path string) (Scenario, error) {
+	var sc Scenario
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return sc, err
+	}
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return sc, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(sc.Stages) == 0 {
+		return sc, fmt.Errorf("scenario %s has no stages", path)
+	}
+	for i, st := range sc.Stages {
+		if _, err := newProfile(st); err != nil {
+			return sc, fmt.Errorf("stage %d (%s): %w", i, st.Name, err)
+		}
+	}
+	return sc, nil
+}
+
+func loadTrace(path string) ([]TraceEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []TraceEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e TraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	return entries, nil
+}
+
+func newProfile(st Stage) (loadProfile, error) {
+	// Rate profiles without a duration run for as long as the generator does.
+	horizon := time.Duration(st.Duration)
+	if horizon == 0 {
+		horizon = time.Duration(math.MaxInt64)
+	}
+
+	switch st.Profile {
+	case "constant", "":
+		if st.RPS <= 0 {
+			return nil, fmt.Errorf("constant profile needs rps > 0")
+		}
+		return rateProfile{horizon: horizon, rate: func(time.Duration) float64 { return st.RPS }}, nil
+
+	case "ramp":
+		if st.Duration <= 0 {
+			return nil, fmt.Errorf("ramp profile needs a duration")
+		}
+		return rateProfile{horizon: horizon, rate: func(t time.Duration) float64 {
+			frac := math.Min(float64(t)/float64(st.Duration), 1)
+			return st.FromRPS + (st.ToRPS-st.FromRPS)*frac
+		}}, nil
+
+	case "sine":
+		period := time.Duration(st.Period)
+		if period == 0 {
+			period = 24 * time.Hour
+		}
+		if st.BaseRPS <= 0 {
+			return nil, fmt.Errorf("sine profile needs base_rps > 0")
+		}
+		return rateProfile{horizon: horizon, rate: func(t time.Duration) float64 {
+			angle := 2 * math.Pi * float64(t+time.Duration(st.Phase)) / float64(period)
+			return st.BaseRPS + st.Amplitude*math.Sin(angle)
+		}}, nil
+
+	case "burst":
+		if st.BurstEvery <= 0 || st.BurstLength <= 0 || st.BurstRPS <= 0 {
+			return nil, fmt.Errorf("burst profile needs burst_rps, burst_every and burst_length")
+		}
+		return rateProfile{horizon: horizon, rate: func(t time.Duration) float64 {
+			if t%time.Duration(st.BurstEvery) < time.Duration(st.BurstLength) {
+				return st.BurstRPS
+			}
+			return st.RPS
+		}}, nil
+
+	case "replay":
+		entries, err := loadTrace(st.TraceFile)
+		if err != nil {
+			return nil, err
+		}
+		speed := st.Speed
+		if speed <= 0 {
+			speed = 1
+		}
+		return &replayProfile{entries: entries, speed: speed}, nil
+	}
+
+	return nil, fmt.Errorf("unknown profile %q", st.Profile)
+}
+
+// traceRecorder appends sent requests to a trace file in the format read by
+// replay stages.
+type traceRecorder struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	start time.Time
+}
+
+func newTraceRecorder(path string) (*traceRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &traceRecorder{enc: json.NewEncoder(f), start: clock.Now()}, nil
+}
+
+func (t *traceRecorder) record(req DeliveryRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry := TraceEntry{Offset: Duration(clock.Since(t.start)), DeliveryRequest: req}
+	if err := t.enc.Encode(entry); err != nil {
+		slog.Error("Failed to record trace entry", "err", err)
+	}
+}
+
+// runScenario drives the stages of sc, sending each request on its own
+// goroutine while keeping at most sc.Concurrency requests in flight.
+func runScenario(sc Scenario, send func(DeliveryRequest)) {
+	var recorder *traceRecorder
+	if sc.RecordFile != "" {
+		var err error
+		if recorder, err = newTraceRecorder(sc.RecordFile); err != nil {
+			slog.Error("Unable to open trace record file", "path", sc.RecordFile, "err", err)
+		}
+	}
+
+	sem := make(chan struct{}, max(sc.Concurrency, 1))
+	dispatch := func(req *DeliveryRequest) {
+		r := randomDelivery()
+		if req != nil {
+			r = *req
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			slog.Warn("Concurrency limit reached, dropping request", "limit", cap(sem))
+			requestsDropped.Inc()
+			return
+		}
+		if recorder != nil {
+			recorder.record(r)
+		}
+		requestsInFlight.Inc()
+		go func() {
+			defer func() {
+				requestsInFlight.Dec()
+				<-sem
+			}()
+			send(r)
+		}()
+	}
+
+	for {
+		for i, st := range sc.Stages {
+			runStage(i, st, dispatch)
+		}
+		if !sc.Loop {
+			slog.Info("Scenario complete")
+			return
+		}
+	}
+}
+
+func runStage(i int, st Stage, dispatch func(*DeliveryRequest)) {
+	profile, err := newProfile(st)
+	if err != nil {
+		slog.Error("Skipping stage", "stage", i, "name", st.Name, "err", err)
+		return
+	}
+	slog.Info("Starting stage", "stage", i, "name", st.Name, "profile", st.Profile, "duration", time.Duration(st.Duration))
+
+	start := clock.Now()
+	var prev time.Duration
+	for {
+		at, req, ok := profile.next(prev)
+		if !ok || (st.Duration > 0 && at > time.Duration(st.Duration)) {
+			break
+		}
+		clock.Sleep(at - clock.Since(start))
+		dispatch(req)
+		prev = at
+	}
+	// Rate profiles finish on their last send; wait out the rest of the stage.
+	clock.Sleep(time.Duration(st.Duration) - clock.Since(start))
+}
@@ -0,0 +1,158 @@
+// traffic/scenario_test.go
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sends counts the requests p schedules up to until.
+func sends(p loadProfile, until time.Duration) (n int) {
+	var prev time.Duration
+	for {
+		at, _, ok := p.next(prev)
+		if !ok || at > until {
+			return n
+		}
+		n++
+		prev = at
+	}
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{`"5m"`, 5 * time.Minute, false},
+		{`"1.5s"`, 1500 * time.Millisecond, false},
+		{`2`, 2 * time.Second, false},
+		{`0.25`, 250 * time.Millisecond, false},
+		{`"soon"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tt := range tests {
+		var d Duration
+		err := json.Unmarshal([]byte(tt.in), &d)
+		if (err != nil) != tt.wantErr || time.Duration(d) != tt.want {
+			t.Errorf("Unmarshal(%s) = %s, %v, want %s, error %v", tt.in, time.Duration(d), err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRateProfiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		stage Stage
+		// want is the number of sends in the stage, give or take one for
+		// rates that don't divide evenly into rateStep.
+		want int
+	}{
+		{"constant", Stage{Profile: "constant", RPS: 50, Duration: Duration(time.Second)}, 50},
+		{"constant by default", Stage{RPS: 25, Duration: Duration(2 * time.Second)}, 50},
+		{"ramp up", Stage{Profile: "ramp", FromRPS: 0, ToRPS: 100, Duration: Duration(time.Second)}, 50},
+		{"ramp down", Stage{Profile: "ramp", FromRPS: 100, ToRPS: 0, Duration: Duration(time.Second)}, 50},
+		{"sine over a whole period", Stage{Profile: "sine", BaseRPS: 20, Amplitude: 10, Period: Duration(time.Second), Duration: Duration(2 * time.Second)}, 40},
+		{"sine below zero sends nothing", Stage{Profile: "sine", BaseRPS: 1, Amplitude: 100, Phase: Duration(750 * time.Millisecond), Period: Duration(time.Minute), Duration: Duration(100 * time.Millisecond)}, 0},
+		{"burst", Stage{Profile: "burst", RPS: 10, BurstRPS: 100, BurstEvery: Duration(time.Second), BurstLength: Duration(200 * time.Millisecond), Duration: Duration(2 * time.Second)}, 2 * (20 + 8)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newProfile(tt.stage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sends(p, time.Duration(tt.stage.Duration)); got < tt.want-1 || got > tt.want+1 {
+				t.Errorf("sent %d requests, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateProfileOrder(t *testing.T) {
+	p, err := newProfile(Stage{RPS: 1000, Duration: Duration(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prev time.Duration
+	for range 100 {
+		at, req, ok := p.next(prev)
+		if !ok || at <= prev || req != nil {
+			t.Fatalf("next(%s) = %s, %v, %v, want a later random request", prev, at, req, ok)
+		}
+		prev = at
+	}
+}
+
+func TestNewProfileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		stage Stage
+		want  string
+	}{
+		{"constant without a rate", Stage{Profile: "constant"}, "rps > 0"},
+		{"ramp without a duration", Stage{Profile: "ramp", ToRPS: 10}, "duration"},
+		{"sine without a base", Stage{Profile: "sine", Amplitude: 10}, "base_rps"},
+		{"burst without a length", Stage{Profile: "burst", BurstRPS: 10, BurstEvery: Duration(time.Second)}, "burst_length"},
+		{"replay without a trace", Stage{Profile: "replay", TraceFile: filepath.Join(t.TempDir(), "missing.jsonl")}, "no such file"},
+		{"unknown", Stage{Profile: "square"}, "unknown profile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newProfile(tt.stage); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("newProfile() error = %v, want it to mention %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayProfile(t *testing.T) {
+	trace := filepath.Join(t.TempDir(), "trace.jsonl")
+	lines := `{"offset":"2s","recipient":"Leela","address":"Mars Vegas","contents":"Popplers"}
+
+{"offset":"1s","recipient":"Fry","address":"Neptune","contents":"Slurm"}
+{"offset":4,"recipient":"Bender","address":"Luna Park","contents":"Beer"}
+`
+	if err := os.WriteFile(trace, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		speed float64
+		want  []time.Duration
+	}{
+		{0, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{2, []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}},
+	}
+	for _, tt := range tests {
+		p, err := newProfile(Stage{Profile: "replay", TraceFile: trace, Speed: tt.speed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipients := []string{"Fry", "Leela", "Bender"}
+		for i, want := range tt.want {
+			at, req, ok := p.next(0)
+			if !ok || at != want || req == nil || req.Recipient != recipients[i] {
+				t.Fatalf("speed %v: entry %d = %s, %+v, %v, want %s for %s", tt.speed, i, at, req, ok, want, recipients[i])
+			}
+		}
+		if _, _, ok := p.next(0); ok {
+			t.Errorf("speed %v: replay continued past the end of the trace", tt.speed)
+		}
+	}
+}
+
+func TestLoadTraceBadLine(t *testing.T) {
+	trace := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := os.WriteFile(trace, []byte("{\"offset\":\"1s\"}\nnot json\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTrace(trace); err == nil || !strings.Contains(err.Error(), "trace.jsonl:2") {
+		t.Errorf("loadTrace() error = %v, want it to name line 2", err)
+	}
+}
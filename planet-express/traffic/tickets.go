@@ -0,0 +1,103 @@
+// traffic/tickets.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type CrewMember struct {
+	Name string  `json:"name"`
+	Risk float64 `json:"risk"`
+}
+
+type ShipInfo struct {
+	Name      string  `json:"name"`
+	Available bool    `json:"available"`
+	Speed     float64 `json:"speed"`
+}
+
+type Package struct {
+	ID           string     `json:"id"`
+	Recipient    string     `json:"recipient"`
+	Address      string     `json:"address"`
+	Status       string     `json:"status"`
+	Contents     string     `json:"contents"`
+	WeightKG     float64    `json:"weight_kg,omitempty"`
+	VolumeM3     float64    `json:"volume_m3,omitempty"`
+	Hazard       string     `json:"hazard_class,omitempty"`
+	Priority     string     `json:"priority,omitempty"`
+	Charge       float64    `json:"charge"`
+	Crew         string     `json:"crew,omitempty"`
+	Ship         string     `json:"ship,omitempty"`
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	ETA          *time.Time `json:"eta,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	FlightID     string     `json:"flight_id,omitempty"`
+}
+
+type DeliveryTicket struct {
+	Crew    CrewMember `json:"crew"`
+	Ship    ShipInfo   `json:"ship"`
+	Package Package    `json:"package"`
+}
+
+// TrackedTicket is a ticket returned by the API along with when we asked for it.
+type TrackedTicket struct {
+	Ticket  DeliveryTicket `json:"ticket"`
+	SentAt  time.Time      `json:"sent_at"`
+	Latency float64        `json:"latency_seconds"`
+}
+
+// ticketTracker remembers the most recent tickets by package ID so that
+// duplicate IDs can be spotted. The oldest entries are evicted once the
+// tracker is full.
+type ticketTracker struct {
+	mu      sync.Mutex
+	limit   int
+	tickets map[string]TrackedTicket
+	order   []string
+}
+
+func newTicketTracker(limit int) *ticketTracker {
+	return &ticketTracker{limit: limit, tickets: make(map[string]TrackedTicket)}
+}
+
+// add records t and reports whether its package ID was already being tracked.
+func (tt *ticketTracker) add(t TrackedTicket) (duplicate bool) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	id := t.Ticket.Package.ID
+	if _, ok := tt.tickets[id]; ok {
+		tt.tickets[id] = t
+		return true
+	}
+	if len(tt.order) >= tt.limit {
+		delete(tt.tickets, tt.order[0])
+		tt.order = tt.order[1:]
+	}
+	tt.tickets[id] = t
+	tt.order = append(tt.order, id)
+	trackedPackages.Set(float64(len(tt.tickets)))
+	return false
+}
+
+// recent returns up to n of the most recently tracked tickets, newest first.
+func (tt *ticketTracker) recent(n int) []TrackedTicket {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	list := make([]TrackedTicket, 0, min(n, len(tt.order)))
+	for i := len(tt.order) - 1; i >= 0 && len(list) < n; i-- {
+		list = append(list, tt.tickets[tt.order[i]])
+	}
+	return list
+}
+
+func (tt *ticketTracker) listTickets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tt.recent(100))
+}
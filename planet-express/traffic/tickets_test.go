@@ -0,0 +1,73 @@
+// traffic/tickets_test.go
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func tracked(id string) TrackedTicket {
+	return TrackedTicket{Ticket: DeliveryTicket{Package: Package{ID: id}}}
+}
+
+func TestTicketTracker(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		add       []string
+		wantDups  []string
+		wantOrder []string // newest first
+	}{
+		{"newest first", 10, []string{"A", "B", "C"}, nil, []string{"C", "B", "A"}},
+		{"duplicate spotted", 10, []string{"A", "B", "A"}, []string{"A"}, []string{"B", "A"}},
+		{"oldest evicted", 2, []string{"A", "B", "C"}, nil, []string{"C", "B"}},
+		{"evicted IDs aren't duplicates", 2, []string{"A", "B", "C", "A"}, nil, []string{"A", "C"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTicketTracker(tt.limit)
+			var dups []string
+			for _, id := range tt.add {
+				if tr.add(tracked(id)) {
+					dups = append(dups, id)
+				}
+			}
+			if !slices.Equal(dups, tt.wantDups) {
+				t.Errorf("duplicates = %v, want %v", dups, tt.wantDups)
+			}
+			var got []string
+			for _, tk := range tr.recent(100) {
+				got = append(got, tk.Ticket.Package.ID)
+			}
+			if !slices.Equal(got, tt.wantOrder) {
+				t.Errorf("recent() = %v, want %v", got, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestTicketTrackerRecentLimit(t *testing.T) {
+	tr := newTicketTracker(10)
+	for _, id := range []string{"A", "B", "C"} {
+		tr.add(tracked(id))
+	}
+	if got := tr.recent(2); len(got) != 2 || got[0].Ticket.Package.ID != "C" {
+		t.Errorf("recent(2) = %+v, want C and B", got)
+	}
+}
+
+func TestResponseClass(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{200, "2xx"},
+		{429, "4xx"},
+		{503, "5xx"},
+	}
+	for _, tt := range tests {
+		if got := responseClass(tt.code); got != tt.want {
+			t.Errorf("responseClass(%d) = %s, want %s", tt.code, got, tt.want)
+		}
+	}
+}